@@ -0,0 +1,109 @@
+package api
+
+import (
+	"../metadata"
+	"../util"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Create bucket, "PUT /buckets/:bucket", returns 409 if it exists already. Objects of
+// the bucket are under "/buckets/:bucket/objects/*key", and never share content with
+// objects of other buckets
+func (s *Server) CreateBucket(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("bucket")
+	if !util.IsValidBucketName(name) {
+		log.Printf("Invalid bucket name %s", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, err := s.meta.CreateBucket(name)
+	if err == metadata.ErrBucketExists {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to create bucket %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created bucket %s", name)
+}
+
+// Delete bucket, "DELETE /buckets/:bucket", returns 409 if it still holds any object
+// version, delete markers included, or multipart or resumable uploads in progress target it
+func (s *Server) DeleteBucket(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("bucket")
+	err := s.meta.DeleteBucket(name)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == metadata.ErrBucketNotEmpty {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete bucket %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Deleted bucket %s", name)
+}
+
+// List buckets, "GET /buckets", sorted by name
+func (s *Server) ListBuckets(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	buckets, err := s.meta.Buckets()
+	if err != nil {
+		log.Printf("Unable to list buckets, error: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"buckets": buckets,
+	})
+}
+
+// Returns the bucket and name of object in request params, objects outside buckets are
+// under "/objects/:name", objects of a bucket under "/buckets/:bucket/objects/*key".
+// Returns false after writing 404 if the bucket does not exist
+func (s *Server) objectName(w http.ResponseWriter, p httprouter.Params) (string, string, bool) {
+	bucket := p.ByName("bucket")
+	if bucket == "" {
+		return "", p.ByName("name"), true
+	}
+
+	if !s.isBucket(w, bucket) {
+		return "", "", false
+	}
+
+	name := strings.TrimPrefix(p.ByName("key"), "/")
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return "", "", false
+	}
+	return bucket, name, true
+}
+
+// Determines if bucket exists, objects outside buckets are in bucket "". Writes 404
+// if it does not
+func (s *Server) isBucket(w http.ResponseWriter, bucket string) bool {
+	if bucket == "" {
+		return true
+	}
+
+	_, err := s.meta.GetBucket(bucket)
+	if err == metadata.ErrNotFound {
+		log.Printf("Bucket %s not found", bucket)
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Printf("Unable to get bucket %s, error: %s", bucket, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
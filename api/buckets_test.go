@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"../metadata"
+)
+
+func TestCreateAndListBuckets(t *testing.T) {
+	h := apiRouter(NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t)}))
+
+	for _, name := range []string{"videos", "photos"} {
+		if w := serve(h, "PUT", "/buckets/"+name, ""); w.Code != http.StatusOK {
+			t.Fatalf("creating bucket %s returned %d", name, w.Code)
+		}
+	}
+	if w := serve(h, "PUT", "/buckets/photos", ""); w.Code != http.StatusConflict {
+		t.Errorf("creating bucket twice returned %d", w.Code)
+	}
+	for _, name := range []string{"ab", "Photos", "pho_tos"} {
+		if w := serve(h, "PUT", "/buckets/"+name, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("creating bucket %s returned %d", name, w.Code)
+		}
+	}
+
+	var result struct {
+		Buckets []metadata.Bucket `json:"buckets"`
+	}
+	json.Unmarshal(serve(h, "GET", "/buckets", "").Body.Bytes(), &result)
+	if len(result.Buckets) != 2 || result.Buckets[0].Name != "photos" || result.Buckets[1].Name != "videos" {
+		t.Errorf("buckets are %+v", result.Buckets)
+	}
+
+	if w := put(h, "/buckets/missing/objects/obj", "content"); w.Code != http.StatusNotFound {
+		t.Errorf("PUT to missing bucket returned %d", w.Code)
+	}
+	if w := serve(h, "DELETE", "/buckets/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleting missing bucket returned %d", w.Code)
+	}
+}
+
+func TestBucketObjectsAreSeparate(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+	serve(h, "PUT", "/buckets/photos", "")
+
+	if w := put(h, "/buckets/photos/objects/2024/beach.jpg", "same content"); w.Code != http.StatusOK {
+		t.Fatalf("PUT of key with slashes is %d", w.Code)
+	}
+	put(h, "/objects/beach.jpg", "same content")
+
+	if w := serve(h, "GET", "/buckets/photos/objects/2024/beach.jpg", ""); w.Body.String() != "same content" {
+		t.Errorf("GET of bucket object is %q", w.Body.String())
+	}
+	if w := serve(h, "GET", "/buckets/photos/objects/beach.jpg", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of object outside bucket by its key is %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/beach.jpg", ""); w.Body.String() != "same content" {
+		t.Errorf("GET of object outside bucket is %q", w.Body.String())
+	}
+
+	// identical content is not shared across buckets
+	hash := hashOf("same content")
+	if !s.isObjectExistsAt(addrs[0], "/buckets/photos/objects/"+hash) || !s.isObjectExistsAt(addrs[0], "/objects/"+hash) {
+		t.Errorf("content not stored for both bucket and objects outside buckets")
+	}
+	serve(h, "DELETE", "/objects/beach.jpg", "")
+	if w := serve(h, "GET", "/buckets/photos/objects/2024/beach.jpg", ""); w.Body.String() != "same content" {
+		t.Errorf("GET of bucket object after delete outside bucket is %q", w.Body.String())
+	}
+}
+
+func TestDeleteBucketOnlyWhenEmpty(t *testing.T) {
+	h := apiRouter(NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t)}))
+	serve(h, "PUT", "/buckets/photos", "")
+	v1 := put(h, "/buckets/photos/objects/obj", "content").Header().Get(versionIdHeader)
+	marker := serve(h, "DELETE", "/buckets/photos/objects/obj", "").Header().Get(versionIdHeader)
+
+	// delete markers keep the bucket from being deleted as well
+	if w := serve(h, "DELETE", "/buckets/photos", ""); w.Code != http.StatusConflict {
+		t.Errorf("deleting bucket with versions returned %d", w.Code)
+	}
+	for _, version := range []string{v1, marker} {
+		if w := serve(h, "DELETE", "/buckets/photos/objects/obj?versionId="+version, ""); w.Code != http.StatusOK {
+			t.Fatalf("DELETE of version %s is %d", version, w.Code)
+		}
+	}
+	if w := serve(h, "DELETE", "/buckets/photos", ""); w.Code != http.StatusOK {
+		t.Errorf("deleting empty bucket returned %d", w.Code)
+	}
+	if w := serve(h, "GET", "/buckets/photos/objects/obj", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET in deleted bucket is %d", w.Code)
+	}
+}
+
+func TestMultipartUploadToBucket(t *testing.T) {
+	h := apiRouter(NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t)}))
+	if w := serve(h, "POST", "/uploads?name=big&bucket=photos", ""); w.Code != http.StatusNotFound {
+		t.Errorf("initiating upload to missing bucket returned %d", w.Code)
+	}
+	serve(h, "PUT", "/buckets/photos", "")
+
+	w := serve(h, "POST", "/uploads?name=big&bucket=photos", "")
+	var info UploadInfo
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if info.UploadId == "" || info.Bucket != "photos" {
+		t.Fatalf("initiating upload returned %d %q", w.Code, w.Body.String())
+	}
+	contents := []string{"first,", "second"}
+	for i, content := range contents {
+		put(h, "/uploads/"+info.UploadId+"/parts/"+strconv.Itoa(i+1), content)
+	}
+
+	// an upload in progress keeps the bucket from being deleted
+	if w := serve(h, "DELETE", "/buckets/photos", ""); w.Code != http.StatusConflict {
+		t.Errorf("deleting bucket with upload in progress returned %d", w.Code)
+	}
+	if w := completeUpload(h, info.UploadId, []int{1, 2}, contents); w.Code != http.StatusOK {
+		t.Fatalf("completing returned %d", w.Code)
+	}
+	if w := serve(h, "GET", "/buckets/photos/objects/big", ""); w.Body.String() != "first,second" {
+		t.Errorf("GET of completed object is %q", w.Body.String())
+	}
+	if w := serve(h, "GET", "/objects/big", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of completed object outside bucket is %d", w.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"../util"
+	"io"
+	"log"
+	"net/http"
+)
+
+// checksumReader reads the body of a client request and verifies it against the
+// checksums in its "Content-MD5" and "X-Checksum-Crc32c" headers or trailers, the end of
+// body is reported as errChecksumMismatch if they differ, so nothing is stored.
+// The SHA-256 hash is verified by putContent
+type checksumReader struct {
+	r        *http.Request
+	hash     string
+	expected util.Checksums
+	cw       *util.ChecksumWriter
+}
+
+// Create checksumReader of the body of r, hash is the SHA-256 hash of content
+func newChecksumReader(r *http.Request, hash string) *checksumReader {
+	expected := util.GetChecksums(r.Header)
+	_, md5Trailer := r.Trailer["Content-Md5"]
+	return &checksumReader{
+		r:        r,
+		hash:     hash,
+		expected: expected,
+		cw:       util.NewChecksumWriter(nil, expected.MD5 != "" || md5Trailer),
+	}
+}
+
+// Implements the Read method
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Body.Read(p)
+	cr.cw.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	// trailers are only known once the whole body is read
+	expected := cr.expected.Merge(cr.r.Trailer)
+	if expected.SHA256 != "" && expected.SHA256 != cr.hash {
+		log.Printf("Object %s does not match hash %s", util.ChecksumSHA256Header, cr.hash)
+		return n, errChecksumMismatch
+	}
+
+	expected.SHA256 = ""
+	if mismatch := expected.Mismatch(cr.cw.Sums()); mismatch != "" {
+		log.Printf("Object %s checksum mismatch", mismatch)
+		return n, errChecksumMismatch
+	}
+	return n, io.EOF
+}
@@ -0,0 +1,339 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"../util"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DrainStatus is the progress of draining a data provider server, returned by the
+// admin endpoint
+type DrainStatus struct {
+	Id       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	Status   string    `json:"status"`
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Total    int       `json:"total"`
+	Moved    int       `json:"moved"`
+	Failed   int       `json:"failed"`
+}
+
+// drain is a data provider server being drained
+type drain struct {
+	status DrainStatus
+	mutex  sync.Mutex
+}
+
+// Set status of data provider server by id, returns false if it is not registered
+func (s *Server) setDataProviderStatus(id string, status Status) (DataProvider, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dp, ok := s.dp[id]
+	if !ok {
+		return dp, false
+	}
+
+	dp.status = status
+	s.dp[id] = dp
+	return dp, true
+}
+
+// Returns the data provider server by id, false if it is not registered
+func (s *Server) getDataProvider(id string) (DataProvider, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dp, ok := s.dp[id]
+	return dp, ok
+}
+
+// Admin API, drain data provider server by id, "POST /providers/:id/drain". No more
+// content is placed on it, and all content it holds is copied to other servers. Once
+// no object refers to it, it is decommissioned and can be deregistered and shut down.
+// Draining again retries content that failed to move
+func (s *Server) DrainDataProvider(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	dp, ok := s.getDataProvider(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// the data server keeps its state, so API servers restarted or not draining it learn it
+	err := putDataProviderState(dp.addr, STOPPING)
+	if err != nil {
+		log.Printf("Unable to set state of data provider server %s at %s, error: %s", id, dp.addr, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	s.drainsMutex.Lock()
+	d := s.drains[id]
+	if d == nil {
+		d = &drain{}
+		s.drains[id] = d
+	}
+	s.drainsMutex.Unlock()
+
+	d.mutex.Lock()
+	if d.status.Running {
+		d.mutex.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	d.status = DrainStatus{
+		Id:      id,
+		Addr:    dp.addr,
+		Status:  STOPPING.String(),
+		Running: true,
+		Started: time.Now().UTC(),
+	}
+	d.mutex.Unlock()
+
+	s.setDataProviderStatus(id, STOPPING)
+	log.Printf("Draining data provider server %s at %s", id, dp.addr)
+	go s.drain(dp, d)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Admin API, get progress of draining data provider server by id
+func (s *Server) GetDrainStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.drainsMutex.Lock()
+	d := s.drains[p.ByName("id")]
+	s.drainsMutex.Unlock()
+
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	d.mutex.Lock()
+	status := d.status
+	d.mutex.Unlock()
+	writeJSON(w, status)
+}
+
+// Move all content held by data provider server dp to other servers
+func (s *Server) drain(dp DataProvider, d *drain) {
+	status := STOPPING
+	contents, err := s.meta.Contents()
+	if err != nil {
+		// what dp holds is unknown, it is left stopping for the next drain
+		log.Printf("Unable to list contents to drain %s, error: %s", dp.addr, err)
+	} else {
+		s.moveAllFrom(dp, d, contents)
+
+		d.mutex.Lock()
+		failed := d.status.Failed
+		d.mutex.Unlock()
+
+		// content written meanwhile may still be placed there by a PUT that started earlier,
+		// and staging files of resumable uploads can't be moved, they are waited for
+		if failed == 0 && !s.isReferenced(dp.addr) && !s.isStaging(dp.addr) {
+			err = putDataProviderState(dp.addr, DECOMMISSIONED)
+			if err != nil {
+				log.Printf("Unable to set state of data provider server %s at %s, error: %s", dp.id, dp.addr, err)
+			} else {
+				status = DECOMMISSIONED
+				log.Printf("Data provider server %s at %s decommissioned", dp.id, dp.addr)
+			}
+		}
+	}
+	s.setDataProviderStatus(dp.id, status)
+
+	d.mutex.Lock()
+	d.status.Status = status.String()
+	d.status.Running = false
+	d.status.Finished = time.Now().UTC()
+	d.mutex.Unlock()
+}
+
+// Move the contents held by data provider server dp to other servers, counting moves and
+// failures in the status of d
+func (s *Server) moveAllFrom(dp DataProvider, d *drain, contents []metadata.Content) {
+	held := make([]metadata.Content, 0)
+	for _, content := range contents {
+		if indexOf(content.Locations, dp.addr) >= 0 {
+			held = append(held, content)
+		}
+	}
+
+	d.mutex.Lock()
+	d.status.Total = len(held)
+	d.mutex.Unlock()
+
+	throttle := util.NewThrottle(s.copyRate)
+	for _, content := range held {
+		var moveErr error
+		s.withContent(content, func(content metadata.Content) {
+			moveErr = s.moveContentFrom(dp.addr, content, throttle)
+		})
+
+		d.mutex.Lock()
+		if moveErr != nil {
+			log.Printf("Failed to move content %s from %s, error: %s", content.Hash, dp.addr, moveErr)
+			d.status.Failed++
+		} else {
+			d.status.Moved++
+		}
+		d.mutex.Unlock()
+	}
+}
+
+// Copy content from data provider server at addr to another server. Replicas are copied
+// from any replica, other replicas first to spare the server being drained, and verified by
+// the receiving data server against the hash of content. Shards are reconstructed from the
+// other shards, or the shard on the server being drained if they are not enough, and the
+// decoded content is verified against its hash
+func (s *Server) moveContentFrom(addr string, content metadata.Content, throttle *util.Throttle) error {
+	// moved meanwhile by another pass
+	if indexOf(content.Locations, addr) < 0 {
+		return nil
+	}
+
+	exclude := map[string]bool{}
+	for _, other := range s.dataProviders() {
+		if indexOf(content.Locations, other.addr) >= 0 {
+			exclude[other.id] = true
+		}
+	}
+
+	target, err := s.selectDataProvider(exclude)
+	if err != nil {
+		return err
+	}
+
+	locations := append([]string(nil), content.Locations...)
+	i := indexOf(locations, addr)
+	var copied placedObject
+	if content.DataShards > 0 {
+		targets := make([]string, len(locations))
+		targets[i] = target.addr
+		sources := append([]string(nil), locations...)
+		sources[i] = ""
+		err = s.reconstructShards(content, sources, targets, throttle)
+		if err != nil {
+			log.Printf("Failed to reconstruct shard %d of content %s without %s, error: %s", i, content.Hash, addr, err)
+			err = s.reconstructShards(content, locations, targets, throttle)
+		}
+		copied = placedObject{target.addr, streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i))}
+	} else {
+		path := streams.ObjectPath(content.Bucket, content.Hash)
+		sources := append(append([]string(nil), locations[:i]...), locations[i+1:]...)
+		err = s.copyFromAny(append(sources, addr), target.addr, path, content.Hash, throttle)
+		copied = placedObject{target.addr, path}
+	}
+	if err != nil {
+		return err
+	}
+
+	locations[i] = target.addr
+	if !s.commitLocations(content, locations, []placedObject{copied}, nil) {
+		log.Printf("Content %s deleted while moving it from %s", content.Hash, addr)
+	}
+	return nil
+}
+
+// Decode content from shards at sources and encode it again, writing the shards with a
+// target address only, the encoding is deterministic so they equal the lost ones. The shards
+// written are discarded unless the decoded content matches its hash
+func (s *Server) reconstructShards(content metadata.Content, sources []string, targets []string,
+	throttle *util.Throttle) error {
+	getStream, err := streams.NewRSGetStream(sources, content.Bucket, content.Hash, content.Size,
+		content.DataShards, content.ParityShards, 0)
+	if err != nil {
+		return err
+	}
+	defer getStream.Close()
+
+	putStream, err := streams.NewRSPutStream(targets, content.Bucket, content.Hash, content.DataShards, content.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(putStream, io.TeeReader(throttle.Reader(getStream), h))
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != content.Hash {
+		err = errHashMismatch
+	}
+	if err != nil {
+		putStream.Abort()
+		return err
+	}
+	return putStream.Close()
+}
+
+// Determines if any content is located at data provider server at addr
+func (s *Server) isReferenced(addr string) bool {
+	contents, err := s.meta.Contents()
+	if err != nil {
+		return true
+	}
+
+	for _, content := range contents {
+		if indexOf(content.Locations, addr) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines if a resumable upload session stages its content on data provider server at addr
+func (s *Server) isStaging(addr string) bool {
+	sessions, err := s.meta.Sessions()
+	if err != nil {
+		return true
+	}
+
+	for _, sess := range sessions {
+		if sess.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the state of data provider server at addr, it is persisted by the server and
+// reported to every API server
+func putDataProviderState(addr string, status Status) error {
+	body, _ := json.Marshal(map[string]string{"state": status.String()})
+	req, err := http.NewRequest("PUT", "http://"+addr+"/state", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("data server returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Returns the index of addr in addrs, -1 if not found
+func indexOf(addrs []string, addr string) int {
+	for i := range addrs {
+		if addrs[i] == addr {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"../metadata"
+)
+
+// Name data provider servers at addrs "dp0" to "dp<n-1>" on h, in order
+func nameDataProviders(t *testing.T, h http.Handler, addrs []string) {
+	t.Helper()
+	for i, addr := range addrs {
+		if code := register(h, "dp"+strconv.Itoa(i), addr); code != http.StatusOK {
+			t.Fatalf("registering %s returned %d", addr, code)
+		}
+	}
+}
+
+// Drain data provider server by id on h and wait for draining to finish, returns its progress
+func drainNow(t *testing.T, h http.Handler, id string) DrainStatus {
+	t.Helper()
+	if w := serve(h, "POST", "/providers/"+id+"/drain", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("draining %s returned %d", id, w.Code)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var status DrainStatus
+		json.Unmarshal(serve(h, "GET", "/providers/"+id+"/drain", "").Body.Bytes(), &status)
+		if !status.Running {
+			return status
+		}
+	}
+	t.Fatalf("draining %s did not finish", id)
+	return DrainStatus{}
+}
+
+// Returns the state data provider server at addr keeps in its storage root
+func savedState(addr string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(dataStorages[addr], "state"))
+	return strings.TrimSpace(string(data))
+}
+
+func TestDrainMovesReplicasAndDecommissions(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta, Replicas: 2})
+	h := apiRouter(s)
+	nameDataProviders(t, h, addrs)
+	putObjects(t, h, 10)
+
+	status := drainNow(t, h, "dp0")
+	if status.Status != "decommissioned" || status.Failed != 0 || status.Moved != status.Total {
+		t.Errorf("drain status is %+v", status)
+	}
+	if state := savedState(addrs[0]); state != "decommissioned" {
+		t.Errorf("state saved by data server is %q", state)
+	}
+	if info := listProviders(h)["dp0"]; info.Status != "decommissioned" {
+		t.Errorf("drained data server is %+v", info)
+	}
+
+	for i := 0; i < 10; i++ {
+		name, content := "obj"+strconv.Itoa(i), "content "+strconv.Itoa(i)
+		rec, _ := meta.Get("", name)
+		if len(rec.Locations) != 2 || indexOf(rec.Locations, addrs[0]) >= 0 || rec.Locations[0] == rec.Locations[1] {
+			t.Errorf("%s located at %v", name, rec.Locations)
+		}
+		if held := holders(s, addrs[1:], hashOf(content)); len(held) != 2 {
+			t.Errorf("%s held by %v", name, held)
+		}
+		if w := serve(h, "GET", "/objects/"+name, ""); w.Body.String() != content {
+			t.Errorf("GET of %s is %q", name, w.Body.String())
+		}
+	}
+
+	// no new content is placed on a drained server
+	put(h, "/objects/new", "new content")
+	if rec, _ := meta.Get("", "new"); indexOf(rec.Locations, addrs[0]) >= 0 {
+		t.Errorf("new content placed on drained server, at %v", rec.Locations)
+	}
+
+	if w := serve(h, "GET", "/providers/missing/drain", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET drain of unknown server is %d", w.Code)
+	}
+}
+
+func TestDrainRebuildsShards(t *testing.T) {
+	addrs := startDataServers(t, 4, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta, DataShards: 2, ParityShards: 1})
+	h := apiRouter(s)
+	nameDataProviders(t, h, addrs)
+	putObjects(t, h, 5)
+
+	status := drainNow(t, h, "dp0")
+	if status.Status != "decommissioned" || status.Failed != 0 {
+		t.Errorf("drain status is %+v", status)
+	}
+	for i := 0; i < 5; i++ {
+		name, content := "obj"+strconv.Itoa(i), "content "+strconv.Itoa(i)
+		rec, _ := meta.Get("", name)
+		if indexOf(rec.Locations, addrs[0]) >= 0 || len(dedupAddrs(rec.Locations)) != 3 {
+			t.Errorf("shards of %s located at %v", name, rec.Locations)
+		}
+		if w := serve(h, "GET", "/objects/"+name, ""); w.Body.String() != content {
+			t.Errorf("GET of %s is %q", name, w.Body.String())
+		}
+	}
+}
+
+func TestDrainWaitsForStagedSessions(t *testing.T) {
+	addrs := startDataServers(t, 2, nil)
+	s := NewServer(Config{DataProviders: addrs[:1], LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+	nameDataProviders(t, h, addrs[:1])
+	path := createSession(t, h, "obj", 4)
+	register(h, "dp1", addrs[1])
+
+	if status := drainNow(t, h, "dp0"); status.Status != "stopping" {
+		t.Errorf("drain status with a staged session is %+v", status)
+	}
+
+	patchSession(h, path, 0, strings.NewReader("data"))
+	if w := finishSession(h, path, "data"); w.Code != http.StatusOK {
+		t.Fatalf("finishing session on draining server returned %d", w.Code)
+	}
+	if status := drainNow(t, h, "dp0"); status.Status != "decommissioned" {
+		t.Errorf("drain status after session finished is %+v", status)
+	}
+}
+
+// contentsFailingStore is a metadata store failing to list contents
+type contentsFailingStore struct {
+	*metadata.DiskStore
+}
+
+// Implements the Contents method, always fails
+func (contentsFailingStore) Contents() ([]metadata.Content, error) {
+	return nil, errors.New("contents unavailable")
+}
+
+func TestDrainKeepsStoppingIfContentsFail(t *testing.T) {
+	addrs := startDataServers(t, 2, nil)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP,
+		Metadata: contentsFailingStore{newTestMetadata(t)}})
+	h := apiRouter(s)
+	nameDataProviders(t, h, addrs)
+
+	// what the server holds is unknown, it must not be decommissioned
+	if status := drainNow(t, h, "dp0"); status.Status != "stopping" || status.Total != 0 {
+		t.Errorf("drain status is %+v", status)
+	}
+	if state := savedState(addrs[0]); state != "stopping" {
+		t.Errorf("state saved by data server is %q", state)
+	}
+}
+
+func TestDataProviderStateSurvivesAPIServerRestart(t *testing.T) {
+	addrs := startDataServers(t, 2, nil)
+	h := apiRouter(NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)}))
+	nameDataProviders(t, h, addrs)
+	drainNow(t, h, "dp0")
+
+	// another API server learns the state from heartbeats
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: newTestMetadata(t),
+		HeartbeatInterval: 10 * time.Millisecond})
+	info := waitDataProvider(t, s, addrs[0], func(info DataProviderInfo) bool { return info.Status == "decommissioned" })
+	if info.Status != "decommissioned" {
+		t.Errorf("data server is %+v", info)
+	}
+	if info := waitDataProvider(t, s, addrs[1], func(info DataProviderInfo) bool { return info.LastPing > 0 }); info.Status != "running" {
+		t.Errorf("data server not drained is %+v", info)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+)
+
+// Split content read from body into data and parity shards with Reed-Solomon code, and
+// write every shard to a distinct data provider server in parallel, content.Locations[i]
+// holds shard i. Every shard must be written, so newly stored content can lose
+// any ParityShards of them
+func (s *Server) storeErasureCoded(content *metadata.Content, body io.Reader) error {
+	dps := s.selectDataProvidersFor(content.Hash, s.dataShards+s.parityShards)
+	if len(dps) < s.dataShards+s.parityShards {
+		log.Printf("Need %d data servers for erasure coding, only %d available", s.dataShards+s.parityShards, len(dps))
+		return errNoDataProvider
+	}
+
+	addrs := make([]string, len(dps))
+	for i := range dps {
+		addrs[i] = dps[i].addr
+	}
+
+	putStream, err := streams.NewRSPutStream(addrs, content.Bucket, content.Hash, s.dataShards, s.parityShards)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(putStream, io.TeeReader(body, h))
+	if err != nil {
+		putStream.Abort()
+		return err
+	}
+
+	// shards are not verified by data servers, they must not be kept if content is wrong
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != content.Hash {
+		log.Printf("Content hash mismatch, expected %s, actual %s", content.Hash, actual)
+		putStream.Abort()
+		return errHashMismatch
+	}
+
+	err = putStream.Close()
+	if err != nil {
+		return err
+	}
+
+	content.Size = size
+	content.Locations = addrs
+	content.DataShards = s.dataShards
+	content.ParityShards = s.parityShards
+	return nil
+}
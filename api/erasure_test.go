@@ -0,0 +1,119 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../streams"
+)
+
+func TestPutAndGetErasureCoded(t *testing.T) {
+	addrs := startDataServers(t, 6, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta,
+		DataShards: 4, ParityShards: 2})
+	h := apiRouter(s)
+
+	content := strings.Repeat("erasure coded content ", 20000)
+	if w := put(h, "/objects/obj", content); w.Code != http.StatusOK {
+		t.Fatalf("PUT is %d", w.Code)
+	}
+
+	rec, err := meta.Get("", "obj")
+	if err != nil || rec.DataShards != 4 || rec.ParityShards != 2 || len(rec.Locations) != 6 {
+		t.Fatalf("record is %v, error: %v", rec, err)
+	}
+	for i, addr := range rec.Locations {
+		if held := holders(s, addrs, streams.ShardName(rec.Hash, i)); len(held) != 1 || held[0] != addr {
+			t.Errorf("shard %d held by %v, placed at %s", i, held, addr)
+		}
+	}
+
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != content {
+		t.Errorf("GET returned %d bytes", w.Body.Len())
+	}
+
+	// identical content is not stored again
+	if w := put(h, "/objects/copy", content); w.Code != http.StatusOK {
+		t.Fatalf("PUT is %d", w.Code)
+	}
+	if copied, _ := meta.Get("", "copy"); strings.Join(copied.Locations, ",") != strings.Join(rec.Locations, ",") {
+		t.Errorf("copy placed at %v, content at %v", copied.Locations, rec.Locations)
+	}
+
+	// two shards on servers down
+	degraded := rec
+	degraded.Name = "degraded"
+	degraded.Locations = append([]string{"127.0.0.1:1", ""}, rec.Locations[2:]...)
+	meta.PutVersion(degraded)
+	if w := serve(h, "GET", "/objects/degraded", ""); w.Body.String() != content {
+		t.Errorf("GET without two shards returned %d bytes", w.Body.Len())
+	}
+}
+
+func TestPutErasureCodedNeedsEnoughDataServers(t *testing.T) {
+	s := NewServer(Config{DataProviders: startDataServers(t, 5, nil), LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t), DataShards: 4, ParityShards: 2})
+
+	if w := put(apiRouter(s), "/objects/obj", "content"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("PUT to 5 data servers is %d", w.Code)
+	}
+}
+
+// Flip a byte in the middle of object name stored at data server addr
+func corruptObject(t *testing.T, addr string, name string) {
+	t.Helper()
+	file := filepath.Join(dataStorages[addr], "objects", name)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetErasureCodedWithCorruptShards(t *testing.T) {
+	addrs := startDataServers(t, 6, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta,
+		DataShards: 4, ParityShards: 2})
+	h := apiRouter(s)
+
+	content := strings.Repeat("erasure coded content ", 50000)
+	put(h, "/objects/obj", content)
+	rec, _ := meta.Get("", "obj")
+
+	// a corrupt shard is reconstructed like a lost one, whole or ranged
+	corruptObject(t, rec.Locations[0], streams.ShardName(rec.Hash, 0))
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != content {
+		t.Errorf("GET with a corrupt shard returned %d bytes", w.Body.Len())
+	}
+	r := httptest.NewRequest("GET", "/objects/obj", nil)
+	r.Header.Set("Range", "bytes=100000-")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != content[100000:] {
+		t.Errorf("ranged GET with a corrupt shard is %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	// more corrupt shards than parity shards fail the stream, instead of returning corrupt content
+	corruptObject(t, rec.Locations[1], streams.ShardName(rec.Hash, 1))
+	corruptObject(t, rec.Locations[4], streams.ShardName(rec.Hash, 4))
+	for _, offset := range []int64{0, 100000} {
+		stream, err := streams.NewRSGetStream(rec.Locations, "", rec.Hash, rec.Size, 4, 2, offset)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(stream)
+		stream.Close()
+		if err == nil {
+			t.Errorf("read %d bytes from offset %d with 3 corrupt shards", len(data), offset)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A data provider server is down after missing this many heartbeats in a row,
+// and up again after answering one
+const maxMissedHeartbeats = 3
+
+// Capacity and load reported by a data provider server in "GET /status"
+type providerStatus struct {
+	Id       string `json:"id"`
+	Capacity struct {
+		TotalBytes  uint64 `json:"totalBytes"`
+		FreeBytes   uint64 `json:"freeBytes"`
+		TotalInodes uint64 `json:"totalInodes"`
+		FreeInodes  uint64 `json:"freeInodes"`
+	} `json:"capacity"`
+	Requests int64  `json:"requests"`
+	State    string `json:"state"`
+}
+
+// DataProviderInfo is the state of a data provider server, shown on index page
+type DataProviderInfo struct {
+	Id         string `json:"id"`
+	Addr       string `json:"addr"`
+	Status     string `json:"status"`
+	Alive      bool   `json:"alive"`
+	LastPing   int64  `json:"lastPing"`
+	FreeBytes  uint64 `json:"freeBytes"`
+	FreeInodes uint64 `json:"freeInodes"`
+	Requests   int64  `json:"requests"`
+}
+
+// Determines if data provider server is alive, servers never probed yet are
+func (dp DataProvider) alive() bool {
+	return dp.missed < maxMissedHeartbeats
+}
+
+// Returns a snapshot of DataProviders alive
+func (s *Server) liveDataProviders() []DataProvider {
+	dps := make([]DataProvider, 0)
+	for _, dp := range s.dataProviders() {
+		if dp.alive() {
+			dps = append(dps, dp)
+		}
+	}
+	return dps
+}
+
+// Probe every data provider server each interval, to keep their liveness, capacity and load
+func (s *Server) monitorDataProviders(interval time.Duration) {
+	for {
+		var wg sync.WaitGroup
+		for _, dp := range s.dataProviders() {
+			wg.Add(1)
+			go func(dp DataProvider) {
+				defer wg.Done()
+				status, err := probeDataProvider(dp.addr, interval)
+				s.updateDataProvider(dp.id, status, err)
+			}(dp)
+		}
+		wg.Wait()
+
+		time.Sleep(interval)
+	}
+}
+
+// Get status of data provider server at addr, waiting no longer than timeout
+func probeDataProvider(addr string, timeout time.Duration) (providerStatus, error) {
+	var status providerStatus
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", "http://"+addr+"/status", nil)
+	if err != nil {
+		return status, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("data server returned status code %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// Record the result of a heartbeat of data provider server by id
+func (s *Server) updateDataProvider(id string, status providerStatus, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dp, ok := s.dp[id]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		dp.missed++
+		if dp.missed == maxMissedHeartbeats {
+			log.Printf("Data provider server %s is down, error: %s", dp.addr, err)
+			s.scheduleRepair(addrScope(dp.addr))
+		}
+	} else {
+		if !dp.alive() {
+			// replicas made while it was down may be removed, and shards left there deleted
+			log.Printf("Data provider server %s is up", dp.addr)
+			s.scheduleRepair(addrScope(dp.addr))
+		}
+		dp.missed = 0
+		dp.lastPing = time.Now().Unix()
+		dp.freeBytes = status.Capacity.FreeBytes
+		dp.totalInodes = status.Capacity.TotalInodes
+		dp.freeInodes = status.Capacity.FreeInodes
+		dp.requests = status.Requests
+		dp.placed = 0
+		dp.status = adoptState(dp, status.State)
+	}
+	s.dp[id] = dp
+
+	// servers given at startup are known by their node ID once they answer
+	if err == nil && status.Id != "" && status.Id != id {
+		if _, ok := s.dp[status.Id]; !ok {
+			log.Printf("Data provider server %s has node ID %s", dp.addr, status.Id)
+			dp.id = status.Id
+			s.dp[status.Id] = dp
+		}
+		delete(s.dp, id)
+		s.rebuildRing()
+	}
+}
+
+// Returns the status of data provider server dp given the state it reports, which is set
+// by API servers draining it, servers reporting none keep their status
+func adoptState(dp DataProvider, state string) Status {
+	st := parseStatus(state)
+	if st == PENDING || st == dp.status {
+		return dp.status
+	}
+
+	log.Printf("Data provider server %s at %s is %s", dp.id, dp.addr, st)
+	return st
+}
+
+// Returns the state of all data provider servers
+func (s *Server) dataProviderInfo() []DataProviderInfo {
+	dps := s.dataProviders()
+	info := make([]DataProviderInfo, 0, len(dps))
+	for _, dp := range dps {
+		info = append(info, DataProviderInfo{
+			Id:         dp.id,
+			Addr:       dp.addr,
+			Status:     dp.status.String(),
+			Alive:      dp.alive(),
+			LastPing:   dp.lastPing,
+			FreeBytes:  dp.freeBytes,
+			FreeInodes: dp.freeInodes,
+			Requests:   dp.requests,
+		})
+	}
+	return info
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Returns the state of data provider server at addr once cond holds for it
+func waitDataProvider(t *testing.T, s *Server, addr string, cond func(DataProviderInfo) bool) DataProviderInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, info := range s.dataProviderInfo() {
+			if info.Addr == addr && cond(info) {
+				return info
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("data provider server %s did not reach the expected state", addr)
+	return DataProviderInfo{}
+}
+
+func TestHeartbeatsMarkDataProvidersDown(t *testing.T) {
+	live := startDataServers(t, 1, nil)[0]
+	dead := "127.0.0.1:1"
+	s := NewServer(Config{DataProviders: []string{live, dead}, LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t), HeartbeatInterval: 10 * time.Millisecond})
+	h := apiRouter(s)
+
+	waitDataProvider(t, s, dead, func(info DataProviderInfo) bool { return !info.Alive })
+	info := waitDataProvider(t, s, live, func(info DataProviderInfo) bool { return info.LastPing != 0 })
+	if !info.Alive || info.FreeBytes == 0 || info.FreeInodes == 0 {
+		t.Errorf("live data server is %+v", info)
+	}
+
+	// data servers down are not written to
+	for i := 0; i < 5; i++ {
+		content := "content " + strconv.Itoa(i)
+		if w := put(h, "/objects/obj"+strconv.Itoa(i), content); w.Code != http.StatusOK {
+			t.Fatalf("PUT is %d", w.Code)
+		}
+		if rec, _ := s.meta.Get("", "obj"+strconv.Itoa(i)); len(rec.Locations) != 1 || rec.Locations[0] != live {
+			t.Errorf("object placed at %v", rec.Locations)
+		}
+	}
+
+	var index struct {
+		DataProviders []DataProviderInfo `json:"dataProviders"`
+	}
+	json.Unmarshal(serve(h, "GET", "/", "").Body.Bytes(), &index)
+	if len(index.DataProviders) != 2 {
+		t.Errorf("index shows data servers %v", index.DataProviders)
+	}
+}
+
+func TestDataProviderUpAfterHeartbeat(t *testing.T) {
+	s := NewServer(Config{DataProviders: []string{"127.0.0.1:1"}, LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	id := s.dataProviders()[0].id
+
+	for i := 1; i <= maxMissedHeartbeats; i++ {
+		if len(s.liveDataProviders()) != 1 {
+			t.Fatalf("data server down after %d missed heartbeats", i-1)
+		}
+		s.updateDataProvider(id, providerStatus{}, errors.New("connection refused"))
+	}
+	if len(s.liveDataProviders()) != 0 {
+		t.Fatalf("data server alive after %d missed heartbeats", maxMissedHeartbeats)
+	}
+	if _, err := s.selectDataProvider(nil); err == nil {
+		t.Errorf("selected a data server down")
+	}
+
+	var status providerStatus
+	status.Capacity.FreeBytes = 100
+	status.Requests = 2
+	s.updateDataProvider(id, status, nil)
+	if dps := s.liveDataProviders(); len(dps) != 1 || dps[0].freeBytes != 100 || dps[0].requests != 2 || dps[0].lastPing == 0 {
+		t.Errorf("data servers alive after heartbeat are %+v", dps)
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default and max number of entries in a listing page
+	defaultListLimit = 1000
+)
+
+// ObjectInfo is an object entry in listing
+type ObjectInfo struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// ListResult is the response of object listing, objects whose names contain delimiter
+// after prefix are rolled up into CommonPrefixes. If IsTruncated, the next page is
+// listed by passing NextMarker as marker
+type ListResult struct {
+	Prefix         string       `json:"prefix"`
+	Delimiter      string       `json:"delimiter"`
+	Marker         string       `json:"marker"`
+	NextMarker     string       `json:"nextMarker,omitempty"`
+	IsTruncated    bool         `json:"isTruncated"`
+	Objects        []ObjectInfo `json:"objects"`
+	CommonPrefixes []string     `json:"commonPrefixes"`
+}
+
+// List objects, "GET /objects?prefix=&delimiter=&marker=&limit=", or "GET /buckets/:bucket?..."
+// for objects of a bucket, objects are listed from metadata
+func (s *Server) ListObjects(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bucket := p.ByName("bucket")
+	if !s.isBucket(w, bucket) {
+		return
+	}
+
+	query := r.URL.Query()
+	result := ListResult{
+		Prefix:         query.Get("prefix"),
+		Delimiter:      query.Get("delimiter"),
+		Marker:         query.Get("marker"),
+		Objects:        []ObjectInfo{},
+		CommonPrefixes: []string{},
+	}
+
+	limit := defaultListLimit
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if limit > defaultListLimit {
+			limit = defaultListLimit
+		}
+	}
+
+	records, err := s.meta.List(bucket, result.Prefix, result.Marker)
+	if err != nil {
+		log.Printf("Unable to list objects, error: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	count := 0
+	for _, rec := range records {
+		commonPrefix := ""
+		if result.Delimiter != "" {
+			i := strings.Index(rec.Name[len(result.Prefix):], result.Delimiter)
+			if i != -1 {
+				commonPrefix = rec.Name[:len(result.Prefix)+i+len(result.Delimiter)]
+			}
+		}
+
+		// objects under the common prefix given as marker are listed already
+		if commonPrefix != "" && commonPrefix == result.Marker {
+			continue
+		}
+		// objects under the same common prefix are rolled up into one entry
+		n := len(result.CommonPrefixes)
+		if commonPrefix != "" && n > 0 && result.CommonPrefixes[n-1] == commonPrefix {
+			continue
+		}
+
+		if count == limit {
+			result.IsTruncated = true
+			break
+		}
+		count++
+
+		if commonPrefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix)
+			result.NextMarker = commonPrefix
+		} else {
+			result.Objects = append(result.Objects, ObjectInfo{
+				Name:         rec.Name,
+				Size:         rec.Size,
+				Hash:         rec.Hash,
+				LastModified: rec.Created,
+			})
+			result.NextMarker = rec.Name
+		}
+	}
+
+	if !result.IsTruncated {
+		result.NextMarker = ""
+	}
+
+	writeJSON(w, result)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"../metadata"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// List objects of bucket with query, returns the response status and result
+func list(s *Server, bucket string, query url.Values) (int, ListResult) {
+	r := httptest.NewRequest("GET", "/buckets/"+bucket+"?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	s.ListObjects(w, r, httprouter.Params{{Key: "bucket", Value: bucket}})
+
+	var result ListResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result
+}
+
+// Returns the objects then the common prefixes of result
+func entries(result ListResult) []string {
+	names := make([]string, 0)
+	for _, obj := range result.Objects {
+		names = append(names, obj.Name)
+	}
+	return append(names, result.CommonPrefixes...)
+}
+
+func TestListObjectsPages(t *testing.T) {
+	store := newTestMetadata(t)
+	s := NewServer(Config{Metadata: store, LocateMode: LocateByHTTP})
+	store.CreateBucket("photos")
+	for _, name := range []string{"a/1", "a/2", "a/3/x", "b", "c/1", "c/2", "d", "e"} {
+		store.PutVersion(metadata.Record{Name: name, Content: metadata.Content{Bucket: "photos", Hash: "h"}})
+	}
+	store.PutVersion(metadata.Record{Name: "outside", Content: metadata.Content{Hash: "h"}})
+
+	for _, tc := range []struct {
+		query url.Values
+		want  []string
+	}{
+		{url.Values{}, []string{"a/1", "a/2", "a/3/x", "b", "c/1", "c/2", "d", "e"}},
+		{url.Values{"delimiter": {"/"}}, []string{"b", "d", "e", "a/", "c/"}},
+		{url.Values{"delimiter": {"/"}, "prefix": {"a/"}}, []string{"a/1", "a/2", "a/3/"}},
+		{url.Values{"prefix": {"c"}}, []string{"c/1", "c/2"}},
+	} {
+		// pages of 2 entries chained by NextMarker list the same entries as a single page
+		got := make([]string, 0)
+		query := url.Values{}
+		for key, value := range tc.query {
+			query[key] = value
+		}
+		for pages := 0; ; pages++ {
+			if pages > len(tc.want) {
+				t.Fatalf("listing %v does not end", tc.query)
+			}
+
+			query.Set("limit", "2")
+			code, result := list(s, "photos", query)
+			if code != http.StatusOK {
+				t.Fatalf("listing %v returned %d", tc.query, code)
+			}
+			if n := len(entries(result)); n > 2 || (result.IsTruncated && n != 2) {
+				t.Errorf("page of %d entries, truncated: %v", n, result.IsTruncated)
+			}
+
+			got = append(got, entries(result)...)
+			if !result.IsTruncated {
+				if result.NextMarker != "" {
+					t.Errorf("last page has next marker %s", result.NextMarker)
+				}
+				break
+			}
+			query.Set("marker", result.NextMarker)
+		}
+
+		_, single := list(s, "photos", tc.query)
+		if !sameEntries(got, tc.want) {
+			t.Errorf("listing %v by pages is %v, want %v", tc.query, got, tc.want)
+		}
+		if !sameEntries(entries(single), tc.want) {
+			t.Errorf("listing %v is %v, want %v", tc.query, entries(single), tc.want)
+		}
+	}
+}
+
+// Determines if a and b hold the same entries, in any order
+func sameEntries(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := map[string]int{}
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+		if count[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListObjectsErrors(t *testing.T) {
+	s := NewServer(Config{Metadata: newTestMetadata(t), LocateMode: LocateByHTTP})
+	for _, limit := range []string{"0", "-1", "x"} {
+		if code, _ := list(s, "", url.Values{"limit": {limit}}); code != http.StatusBadRequest {
+			t.Errorf("limit %s returned %d", limit, code)
+		}
+	}
+	if code, _ := list(s, "missing", url.Values{}); code != http.StatusNotFound {
+		t.Errorf("listing missing bucket returned %d", code)
+	}
+	if code, result := list(s, "", url.Values{}); code != http.StatusOK || len(entries(result)) != 0 {
+		t.Errorf("listing no object returned %d, %v", code, entries(result))
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"../streams"
+	"context"
+	"errors"
+	uuid2 "github.com/satori/go.uuid"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Locate objects by publishing a query on the locate bus and waiting for a reply
+	LocateByBus = "bus"
+
+	// Locate objects by sending HEAD requests to every data provider server
+	LocateByHTTP = "http"
+)
+
+var (
+	// Returned when no data provider server holds the object
+	errObjectNotFound = errors.New("object not found")
+
+	// Timeout of locating object through the locate bus
+	busLocateTimeout = 20 * time.Second
+
+	// Timeout of locating object through HTTP fan-out
+	httpLocateTimeout = 5 * time.Second
+
+	// Wait time before subscribing to location replies again
+	resubscribeInterval = time.Second
+)
+
+// Locate object by bucket and name, returns address of a data provider server holding it
+func (s *Server) locate(bucket string, name string) (string, error) {
+	switch s.locateMode {
+	case LocateByHTTP:
+		return s.locateByHTTP(bucket, name)
+	default:
+		return s.locateByBus(bucket, name)
+	}
+}
+
+// Publish a location query and wait for the reply carrying the same uid,
+// replies are dispatched by listenToLocateReplies
+func (s *Server) locateByBus(bucket string, name string) (string, error) {
+	uuid := uuid2.Must(uuid2.NewV4()).String()
+	msg := map[string]string{
+		"bucket": bucket,
+		"name":   name,
+		"uid":    uuid,
+	}
+
+	// register before publishing, so a fast reply won't be missed
+	replyC := make(chan string, 1)
+	s.pendingMutex.Lock()
+	s.pending[uuid] = replyC
+	s.pendingMutex.Unlock()
+
+	defer func() {
+		s.pendingMutex.Lock()
+		delete(s.pending, uuid)
+		s.pendingMutex.Unlock()
+	}()
+
+	err := s.locateBus.PublishQuery(msg)
+	if err != nil {
+		log.Printf("Unable to send location query message, error: %s", err)
+		return "", err
+	}
+
+	select {
+	case addr := <-replyC:
+		return addr, nil
+	case <-time.After(busLocateTimeout):
+		log.Printf("Query object %s location timeout", name)
+		// TODO: delete message
+		return "", errObjectNotFound
+	}
+}
+
+// Consume location replies for the lifetime of API server, dispatch each reply to the
+// request waiting for its uid. Replies nobody waits for are late replies of timed out
+// requests, or belong to another API server, they are not acknowledged
+func (s *Server) listenToLocateReplies() {
+	for {
+		sub, err := s.locateBus.SubscribeReplies()
+		if err != nil {
+			log.Printf("Unable to subscribe to location replies, error: %s", err)
+			time.Sleep(resubscribeInterval)
+			continue
+		}
+
+		for reply := range sub.Messages() {
+			req := reply.Body
+			log.Printf("Consume message %v", req)
+
+			s.pendingMutex.Lock()
+			replyC, ok := s.pending[req["uid"]]
+			s.pendingMutex.Unlock()
+
+			if !ok {
+				log.Printf("No pending request for location reply %s, dropping", req["uid"])
+				continue
+			}
+
+			// the first reply wins, the channel holds one address only
+			select {
+			case replyC <- req["addr"]:
+			default:
+			}
+
+			err := reply.Ack()
+			if err != nil {
+				log.Printf("Failed to acknowledge message %v, error: %s", req, err)
+			}
+		}
+
+		// the bus went away, e.g. broker restarted
+		sub.Close()
+		log.Printf("Location reply subscription closed, resubscribing")
+		time.Sleep(resubscribeInterval)
+	}
+}
+
+// Send HEAD request to every data provider server alive concurrently, returns the first
+// server that holds the object and cancels the remaining requests
+func (s *Server) locateByHTTP(bucket string, name string) (string, error) {
+	dps := s.liveDataProviders()
+	ctx, cancel := context.WithTimeout(context.Background(), httpLocateTimeout)
+	defer cancel()
+
+	// buffered, so goroutines finishing after we return won't block
+	found := make(chan string, len(dps))
+	for _, dp := range dps {
+		go func(addr string) {
+			req, err := http.NewRequest("HEAD", "http://"+addr+streams.ObjectPath(bucket, name), nil)
+			if err != nil {
+				found <- ""
+				return
+			}
+
+			resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+			if err != nil {
+				found <- ""
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				found <- ""
+				return
+			}
+			found <- addr
+		}(dp.addr)
+	}
+
+	for range dps {
+		addr := <-found
+		if addr != "" {
+			return addr, nil
+		}
+	}
+
+	return "", errObjectNotFound
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../bus"
+	"../util"
+)
+
+// Put content directly on the data provider server at addr, returns its hash
+func putObjectAt(t *testing.T, addr string, content string) string {
+	t.Helper()
+	hash := hashOf(content)
+	req, _ := http.NewRequest("PUT", "http://"+addr+"/objects/"+hash, strings.NewReader(content))
+	req.Header.Set("Digest", util.DigestHeader(hash))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT of %s to %s is %d", hash, addr, resp.StatusCode)
+	}
+	return hash
+}
+
+func TestLocateByHTTP(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	hash := putObjectAt(t, addrs[1], "content")
+
+	// a server down does not keep the object from being located
+	dps := append([]string{"127.0.0.1:1"}, addrs...)
+	s := NewServer(Config{DataProviders: dps, LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+
+	addr, err := s.locate("", hash)
+	if err != nil || addr != addrs[1] {
+		t.Errorf("content located at %s, error: %v", addr, err)
+	}
+
+	addr, err = s.locate("", hashOf("missing"))
+	if err != errObjectNotFound {
+		t.Errorf("missing object located at %s, error: %v", addr, err)
+	}
+}
+
+func TestLocateByHTTPWithoutDataServers(t *testing.T) {
+	s := NewServer(Config{LocateMode: LocateByHTTP})
+	if addr, err := s.locate("", hashOf("content")); err != errObjectNotFound {
+		t.Errorf("content located at %s, error: %v", addr, err)
+	}
+}
+
+// Wait until objects names are located through the locate bus of s, that is until
+// the subscriptions of servers started meanwhile are in place
+func waitLocatable(t *testing.T, s *Server, names ...string) {
+	t.Helper()
+	timeout := busLocateTimeout
+	busLocateTimeout = 100 * time.Millisecond
+	defer func() { busLocateTimeout = timeout }()
+
+	for _, name := range names {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := s.locate("", name); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not located", name)
+			}
+		}
+	}
+}
+
+func TestLocateByBusDispatchesReplies(t *testing.T) {
+	locateBus := bus.NewMemoryBus()
+	addrs := startDataServers(t, 2, locateBus)
+	hashes := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hashes[i] = putObjectAt(t, addr, fmt.Sprintf("content%d", i))
+	}
+	s := NewServer(Config{DataProviders: addrs, LocateBus: locateBus, LocateMode: LocateByBus})
+	waitLocatable(t, s, hashes...)
+
+	// a reply nobody waits for is dropped
+	locateBus.PublishReply(map[string]string{"name": hashes[0], "uid": "unknown", "addr": addrs[1]})
+
+	// concurrent requests each get the reply of their own query
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addr, err := s.locate("", hashes[i%2])
+			if err != nil || addr != addrs[i%2] {
+				t.Errorf("content%d located at %s, error: %v", i%2, addr, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestLocateByBusTimeout(t *testing.T) {
+	timeout := busLocateTimeout
+	busLocateTimeout = 100 * time.Millisecond
+	defer func() { busLocateTimeout = timeout }()
+
+	locateBus := bus.NewMemoryBus()
+	s := NewServer(Config{DataProviders: startDataServers(t, 1, locateBus), LocateBus: locateBus})
+
+	addr, err := s.locate("", hashOf("missing"))
+	if err != errObjectNotFound {
+		t.Errorf("missing object located at %s, error: %v", addr, err)
+	}
+
+	s.pendingMutex.Lock()
+	pending := len(s.pending)
+	s.pendingMutex.Unlock()
+	if pending != 0 {
+		t.Errorf("%d requests still pending", pending)
+	}
+}
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"../metadata"
+	"../util"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	uuid2 "github.com/satori/go.uuid"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max part number of multipart upload
+const maxPartNumber = 10000
+
+// How often uploads are checked for expiry
+const uploadSweepInterval = 10 * time.Minute
+
+// PartInfo is a part entry in part listing and in the manifest completing an upload
+type PartInfo struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size,omitempty"`
+}
+
+// UploadInfo is the response of initiating an upload and listing its parts
+type UploadInfo struct {
+	UploadId string     `json:"uploadId"`
+	Bucket   string     `json:"bucket,omitempty"`
+	Name     string     `json:"name"`
+	Parts    []PartInfo `json:"parts,omitempty"`
+}
+
+// Manifest is the request body completing an upload, parts in ascending order
+type Manifest struct {
+	Parts []PartInfo `json:"parts"`
+}
+
+// Get upload by ID, writes the response status if it is not found or the store fails
+func (s *Server) getUpload(w http.ResponseWriter, id string) (metadata.Upload, bool) {
+	u, err := s.meta.GetUpload(id)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return u, false
+	} else if err != nil {
+		log.Printf("Unable to get upload %s, error: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return u, false
+	}
+	return u, true
+}
+
+// Abort uploads initiated longer than expiry ago, each uploadSweepInterval
+func (s *Server) expireUploads(expiry time.Duration) {
+	for {
+		time.Sleep(uploadSweepInterval)
+		s.expireUploadsBefore(time.Now().Add(-expiry))
+	}
+}
+
+// Abort uploads initiated before deadline
+func (s *Server) expireUploadsBefore(deadline time.Time) {
+	uploads, err := s.meta.Uploads()
+	if err != nil {
+		log.Printf("Unable to list uploads, error: %s", err)
+		return
+	}
+
+	for _, u := range uploads {
+		if !u.Created.Before(deadline) {
+			continue
+		}
+
+		_, err = s.meta.DeleteUpload(u.Id)
+		if err != nil {
+			// completed or aborted meanwhile
+			continue
+		}
+		s.deleteUnreferenced(uploadContents(u))
+		log.Printf("Expired upload %s of object %s, initiated at %s", u.Id, u.Name, u.Created)
+	}
+}
+
+// Returns contents of upload parts
+func uploadContents(u metadata.Upload) []metadata.Content {
+	contents := make([]metadata.Content, len(u.Parts))
+	for i := range u.Parts {
+		contents[i] = u.Parts[i].Content
+	}
+	return contents
+}
+
+// Initiate a multipart upload of object, "POST /uploads?name=<object name>&bucket=<bucket>",
+// bucket is optional, returns the upload ID used by the rest of the upload
+func (s *Server) CreateUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	if !s.isBucket(w, bucket) {
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	u := metadata.Upload{
+		Id:          uuid2.Must(uuid2.NewV4()).String(),
+		Bucket:      bucket,
+		Name:        name,
+		ContentType: contentType,
+		Created:     time.Now().UTC(),
+	}
+	err := s.meta.CreateUpload(u)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to save upload of object %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Initiated upload %s of object %s", u.Id, name)
+	writeJSON(w, UploadInfo{UploadId: u.Id, Bucket: bucket, Name: name})
+}
+
+// Upload a part, "PUT /uploads/:id/parts/:part", like PutObject, the SHA-256 hash of part
+// must be sent in "Digest" header, it is returned as ETag of the part. A part uploaded
+// again with the same number replaces the previous one, whose content is deleted
+func (s *Server) UploadPart(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, ok := s.getUpload(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(p.ByName("part"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hash := util.GetHashFromHeader(r.Header)
+	if hash == "" {
+		log.Printf("Missing or malformed Digest header of upload %s part %d", u.Id, number)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lockContent(u.Bucket, hash)
+	content, err := s.putContent(u.Bucket, hash, newChecksumReader(r, hash))
+	if err != nil {
+		s.unlockContent(u.Bucket, hash)
+		log.Printf("Failed to put upload %s part %d, error: %s", u.Id, number, err)
+		w.WriteHeader(putContentErrorStatus(err))
+		return
+	}
+
+	old, err := s.meta.PutPart(u.Id, metadata.Part{Number: number, Content: content})
+	s.unlockContent(u.Bucket, hash)
+	if err != nil {
+		log.Printf("Failed to save upload %s part %d, error: %s", u.Id, number, err)
+		// the upload ended meanwhile, the content may be referenced by nothing else
+		s.deleteUnreferenced([]metadata.Content{content})
+		if err == metadata.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	for _, part := range old.Parts {
+		if part.Number == number && part.Hash != hash {
+			s.deleteUnreferenced([]metadata.Content{part.Content})
+		}
+	}
+
+	log.Printf("Uploaded upload %s part %d, hash %s", u.Id, number, hash)
+	w.Header().Set("ETag", `"`+hash+`"`)
+}
+
+// List uploaded parts, "GET /uploads/:id"
+func (s *Server) ListParts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, ok := s.getUpload(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+
+	info := UploadInfo{UploadId: u.Id, Bucket: u.Bucket, Name: u.Name, Parts: []PartInfo{}}
+	for _, part := range u.Parts {
+		info.Parts = append(info.Parts, PartInfo{
+			PartNumber: part.Number,
+			ETag:       `"` + part.Hash + `"`,
+			Size:       part.Size,
+		})
+	}
+	writeJSON(w, info)
+}
+
+// Complete an upload, "POST /uploads/:id" with a Manifest listing the parts making up the
+// object in ascending order. The object is saved as a new version and the upload removed
+// at once, then parts not in the manifest are deleted
+func (s *Server) CompleteUpload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, ok := s.getUpload(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var manifest Manifest
+	err := json.NewDecoder(r.Body).Decode(&manifest)
+	if err != nil || len(manifest.Parts) == 0 {
+		log.Printf("Invalid manifest of upload %s, error: %v", u.Id, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	parts := map[int]metadata.Part{}
+	for _, part := range u.Parts {
+		parts[part.Number] = part
+	}
+
+	rec := metadata.Record{
+		Name:        u.Name,
+		Content:     metadata.Content{Bucket: u.Bucket},
+		ContentType: u.ContentType,
+	}
+	used := map[int]bool{}
+	h := sha256.New()
+	for i, info := range manifest.Parts {
+		part, ok := parts[info.PartNumber]
+		if !ok || strings.Trim(info.ETag, `"`) != part.Hash ||
+			(i > 0 && info.PartNumber <= manifest.Parts[i-1].PartNumber) {
+			log.Printf("Manifest of upload %s does not match part %d", u.Id, info.PartNumber)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		sum, _ := hex.DecodeString(part.Hash)
+		h.Write(sum)
+		rec.Size += part.Size
+		rec.Parts = append(rec.Parts, part)
+		used[part.Number] = true
+	}
+
+	rec.Hash = fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(rec.Parts))
+	rec, err = s.meta.CompleteUpload(u.Id, rec)
+	switch err {
+	case nil:
+	case metadata.ErrNotFound:
+		// completed or aborted meanwhile, or the bucket was deleted
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case metadata.ErrConflict:
+		log.Printf("Parts of upload %s replaced while completing", u.Id)
+		w.WriteHeader(http.StatusConflict)
+		return
+	default:
+		log.Printf("Failed to save metadata of object %s, error: %s", u.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	unused := make([]metadata.Content, 0)
+	for _, part := range u.Parts {
+		if !used[part.Number] {
+			unused = append(unused, part.Content)
+		}
+	}
+	s.deleteUnreferenced(unused)
+
+	log.Printf("Completed upload %s, object %s version %d, %d parts", u.Id, u.Name, rec.Version, len(rec.Parts))
+	w.Header().Set("ETag", `"`+rec.Hash+`"`)
+	w.Header().Set(versionIdHeader, versionId(rec))
+	writeJSON(w, map[string]interface{}{
+		"name":    rec.Name,
+		"version": rec.Version,
+		"etag":    rec.Hash,
+	})
+}
+
+// Abort an upload, "DELETE /uploads/:id", uploaded parts are deleted
+func (s *Server) AbortUpload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.meta.DeleteUpload(p.ByName("id"))
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to remove upload %s, error: %s", p.ByName("id"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.deleteUnreferenced(uploadContents(u))
+	log.Printf("Aborted upload %s of object %s", u.Id, u.Name)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"../metadata"
+)
+
+// Initiate an upload of object name on h, returns the upload ID
+func createUpload(t *testing.T, h http.Handler, name string) string {
+	t.Helper()
+	w := serve(h, "POST", "/uploads?name="+name, "")
+	var info UploadInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.UploadId == "" {
+		t.Fatalf("initiating upload returned %d %q", w.Code, w.Body.String())
+	}
+	return info.UploadId
+}
+
+// Complete upload id on h with parts of the given numbers and contents
+func completeUpload(h http.Handler, id string, numbers []int, contents []string) *httptest.ResponseRecorder {
+	manifest := Manifest{}
+	for i, number := range numbers {
+		manifest.Parts = append(manifest.Parts, PartInfo{PartNumber: number, ETag: `"` + hashOf(contents[i]) + `"`})
+	}
+	body, _ := json.Marshal(manifest)
+	return serve(h, "POST", "/uploads/"+id, string(body))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+
+	id := createUpload(t, h, "big")
+	for number, content := range map[int]string{3: "third,", 1: "first,", 2: "replaced", 4: "unused"} {
+		if w := put(h, "/uploads/"+id+"/parts/"+strconv.Itoa(number), content); w.Code != http.StatusOK {
+			t.Fatalf("PUT of part %d is %d", number, w.Code)
+		}
+	}
+	// uploading a part again replaces it
+	put(h, "/uploads/"+id+"/parts/2", "second,")
+	if held := holders(s, addrs, hashOf("replaced")); len(held) != 0 {
+		t.Errorf("replaced part held by %v", held)
+	}
+
+	w := serve(h, "GET", "/uploads/"+id, "")
+	var info UploadInfo
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if len(info.Parts) != 4 || info.Parts[0].PartNumber != 1 || info.Parts[1].ETag != `"`+hashOf("second,")+`"` {
+		t.Errorf("parts are %v", info.Parts)
+	}
+
+	// parts out of order or not matching the uploaded ones
+	if w := completeUpload(h, id, []int{3, 1}, []string{"third,", "first,"}); w.Code != http.StatusBadRequest {
+		t.Errorf("completing with parts out of order returned %d", w.Code)
+	}
+	if w := completeUpload(h, id, []int{1, 2}, []string{"first,", "replaced"}); w.Code != http.StatusBadRequest {
+		t.Errorf("completing with replaced part returned %d", w.Code)
+	}
+
+	if w := completeUpload(h, id, []int{1, 2, 3}, []string{"first,", "second,", "third,"}); w.Code != http.StatusOK {
+		t.Fatalf("completing returned %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/big", ""); w.Body.String() != "first,second,third," {
+		t.Errorf("GET of completed object is %q", w.Body.String())
+	}
+	if held := holders(s, addrs, hashOf("unused")); len(held) != 0 {
+		t.Errorf("part left out of manifest held by %v", held)
+	}
+
+	if w := completeUpload(h, id, []int{1}, []string{"first,"}); w.Code != http.StatusNotFound {
+		t.Errorf("completing twice returned %d", w.Code)
+	}
+	if w := put(h, "/uploads/"+id+"/parts/1", "first,"); w.Code != http.StatusNotFound {
+		t.Errorf("PUT of part of completed upload is %d", w.Code)
+	}
+}
+
+func TestUploadsSurviveRestart(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	root := t.TempDir()
+	meta, err := metadata.NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := apiRouter(NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta}))
+	id := createUpload(t, h, "big")
+	put(h, "/uploads/"+id+"/parts/1", "before restart,")
+
+	meta, err = metadata.NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = apiRouter(NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta}))
+	put(h, "/uploads/"+id+"/parts/2", " after restart")
+	if w := completeUpload(h, id, []int{1, 2}, []string{"before restart,", " after restart"}); w.Code != http.StatusOK {
+		t.Fatalf("completing after restart returned %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/big", ""); w.Body.String() != "before restart, after restart" {
+		t.Errorf("GET of completed object is %q", w.Body.String())
+	}
+}
+
+func TestAbortAndExpireUploads(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+
+	aborted := createUpload(t, h, "aborted")
+	put(h, "/uploads/"+aborted+"/parts/1", "aborted part")
+	// content shared with an object is kept
+	put(h, "/uploads/"+aborted+"/parts/2", "shared part")
+	put(h, "/objects/shared", "shared part")
+	if w := serve(h, "DELETE", "/uploads/"+aborted, ""); w.Code != http.StatusOK {
+		t.Fatalf("aborting returned %d", w.Code)
+	}
+	if w := serve(h, "DELETE", "/uploads/"+aborted, ""); w.Code != http.StatusNotFound {
+		t.Errorf("aborting twice returned %d", w.Code)
+	}
+	if held := holders(s, addrs, hashOf("aborted part")); len(held) != 0 {
+		t.Errorf("part of aborted upload held by %v", held)
+	}
+	if held := holders(s, addrs, hashOf("shared part")); len(held) != 1 {
+		t.Errorf("content of object held by %v", held)
+	}
+
+	stale := createUpload(t, h, "stale")
+	put(h, "/uploads/"+stale+"/parts/1", "stale part")
+	time.Sleep(10 * time.Millisecond)
+	deadline := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	fresh := createUpload(t, h, "fresh")
+	put(h, "/uploads/"+fresh+"/parts/1", "fresh part")
+
+	s.expireUploadsBefore(deadline)
+	if _, err := meta.GetUpload(stale); err != metadata.ErrNotFound {
+		t.Errorf("stale upload kept, error: %v", err)
+	}
+	if held := holders(s, addrs, hashOf("stale part")); len(held) != 0 {
+		t.Errorf("part of expired upload held by %v", held)
+	}
+	if _, err := meta.GetUpload(fresh); err != nil {
+		t.Errorf("fresh upload expired, error: %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often deleting orphans left on data provider servers is retried
+const orphanRetryInterval = time.Minute
+
+var (
+	// Returned when object content does not match the hash given by client
+	errHashMismatch = errors.New("object hash mismatch")
+
+	// Returned when object content does not match other checksums given by client
+	errChecksumMismatch = errors.New("object checksum mismatch")
+
+	// Returned when there is no data provider server to store objects
+	errNoDataProvider = errors.New("no data server available")
+)
+
+// contentLock serializes storing content and deleting it once unreferenced, so content
+// found stored is not deleted before the new object referencing it is saved
+type contentLock struct {
+	sync.Mutex
+
+	// Goroutines holding or waiting for the lock, the lock is dropped at 0
+	refs int
+}
+
+// Lock content of bucket by hash
+func (s *Server) lockContent(bucket string, hash string) {
+	key := bucket + "/" + hash
+	s.contentLocksMutex.Lock()
+	l := s.contentLocks[key]
+	if l == nil {
+		l = &contentLock{}
+		s.contentLocks[key] = l
+	}
+	l.refs++
+	s.contentLocksMutex.Unlock()
+
+	l.Lock()
+}
+
+// Unlock content of bucket by hash
+func (s *Server) unlockContent(bucket string, hash string) {
+	key := bucket + "/" + hash
+	s.contentLocksMutex.Lock()
+	l := s.contentLocks[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(s.contentLocks, key)
+	}
+	s.contentLocksMutex.Unlock()
+
+	l.Unlock()
+}
+
+// Store content of bucket read from body unless identical content is stored in bucket
+// already, hash is the expected SHA-256 hash of content given by client. Returns the stored
+// content. Callers hold the content lock until the content is referenced in metadata
+func (s *Server) putContent(bucket string, hash string, body io.Reader) (metadata.Content, error) {
+	existing, err := s.meta.FindContent(bucket, hash)
+	held := 0
+	if err == nil {
+		held = s.heldCopies(existing)
+	}
+	if err == nil && isReadable(existing, held) {
+		// identical content stored already, the body is still verified against hash
+		h := sha256.New()
+		_, err = io.Copy(h, body)
+		if err != nil {
+			return metadata.Content{}, err
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+			log.Printf("Content hash mismatch, expected %s, actual %s", hash, actual)
+			return metadata.Content{}, errHashMismatch
+		}
+
+		// copies missing from servers down or lost are restored by the repairer
+		if held < len(existing.Locations) {
+			s.scheduleRepair(repairScope{contents: map[string]bool{contentKey(bucket, hash): true}})
+		}
+
+		log.Printf("Content %s already stored on %v", hash, existing.Locations)
+		return existing, nil
+	}
+
+	found := err == nil
+	content := metadata.Content{Bucket: bucket, Hash: hash}
+	err = s.storeContent(&content, body)
+	if err != nil {
+		return metadata.Content{}, err
+	}
+
+	// objects referring to the lost content refer to the stored one as well, what is left
+	// of it, e.g. on servers down, is deleted as orphans
+	if found {
+		err = s.meta.UpdateLocations(bucket, hash, existing.Locations, content.Locations)
+		if err != nil {
+			log.Printf("Failed to save locations of content %s, error: %s", hash, err)
+		} else {
+			s.orphanDisplaced(existing, content)
+		}
+	}
+
+	log.Printf("Successfully put content %s to data servers %v", hash, content.Locations)
+	return content, nil
+}
+
+// Returns the response status of errors returned by putContent
+func putContentErrorStatus(err error) int {
+	switch err {
+	case errHashMismatch, errChecksumMismatch:
+		return http.StatusBadRequest
+	case errNoDataProvider:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Store content read from body, content.Hash is the expected hash of content,
+// the size and placement of content are filled into content
+func (s *Server) storeContent(content *metadata.Content, body io.Reader) error {
+	if s.dataShards > 0 {
+		return s.storeErasureCoded(content, body)
+	}
+
+	return s.storeReplicated(content, body)
+}
+
+// Returns how many of the replicas or shards of content are held at their locations, every
+// location is probed concurrently, so one server down does not hide the copies of the others
+func (s *Server) heldCopies(content metadata.Content) int {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	held := 0
+	for i, addr := range content.Locations {
+		if addr == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr string, path string) {
+			defer wg.Done()
+			if s.isObjectExistsAt(addr, path) {
+				mutex.Lock()
+				held++
+				mutex.Unlock()
+			}
+		}(addr, locationPath(content, i))
+	}
+	wg.Wait()
+
+	return held
+}
+
+// Determines if content can be read with held of its replicas or shards
+func isReadable(content metadata.Content, held int) bool {
+	if content.DataShards > 0 {
+		return held >= content.DataShards
+	}
+	return held > 0
+}
+
+// Returns the path of the replica or shard of content at its location i
+func locationPath(content metadata.Content, i int) string {
+	if content.DataShards > 0 {
+		return streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i))
+	}
+	return streams.ObjectPath(content.Bucket, content.Hash)
+}
+
+// Record the replicas or shards of old placement of content that content no longer places
+// as orphans, collectOrphans deletes them
+func (s *Server) orphanDisplaced(old metadata.Content, content metadata.Content) {
+	orphans := make([]metadata.Orphan, 0)
+	for i, addr := range old.Locations {
+		path := locationPath(old, i)
+		if addr != "" && !isPlacedAt(content, addr, path) {
+			orphans = append(orphans, metadata.Orphan{Addr: addr, Bucket: old.Bucket, Hash: old.Hash, Path: path})
+		}
+	}
+
+	if len(orphans) == 0 {
+		return
+	}
+	err := s.meta.PutOrphans(orphans)
+	if err != nil {
+		log.Printf("Failed to record %d orphans of content %s, error: %s", len(orphans), old.Hash, err)
+	}
+}
+
+// Determines if data provider server at addr holds object at path
+func (s *Server) isObjectExistsAt(addr string, path string) bool {
+	resp, err := http.Head("http://" + addr + path)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// Returns paths of data provider server objects holding content,
+// the shards of erasure coded content, or its hash
+func contentPaths(content metadata.Content) []string {
+	if content.DataShards == 0 {
+		return []string{streams.ObjectPath(content.Bucket, content.Hash)}
+	}
+
+	paths := make([]string, content.DataShards+content.ParityShards)
+	for i := range paths {
+		paths[i] = streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i))
+	}
+	return paths
+}
+
+// Delete contents no longer referenced by any object version from data provider servers,
+// identical content may be shared by other objects
+func (s *Server) deleteUnreferenced(contents []metadata.Content) {
+	deleted := map[string]bool{}
+	for _, content := range contents {
+		if deleted[content.Bucket+"/"+content.Hash] {
+			continue
+		}
+		deleted[content.Bucket+"/"+content.Hash] = true
+
+		s.lockContent(content.Bucket, content.Hash)
+		if _, err := s.meta.FindContent(content.Bucket, content.Hash); err != nil {
+			s.deleteContent(content)
+		}
+		s.unlockContent(content.Bucket, content.Hash)
+	}
+}
+
+// Delete content from every data provider server, besides the recorded locations,
+// copies left by failed or partial writes are deleted as well. Objects failing to delete
+// are recorded as orphans and deleted later by collectOrphans
+func (s *Server) deleteContent(content metadata.Content) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	orphans := make([]metadata.Orphan, 0)
+	for _, dp := range s.dataProviders() {
+		for _, path := range contentPaths(content) {
+			wg.Add(1)
+			go func(addr string, path string) {
+				defer wg.Done()
+				err := deleteObjectAt(addr, path)
+				if err != nil {
+					log.Printf("Failed to delete object %s from %s, error: %s", path, addr, err)
+					mutex.Lock()
+					orphans = append(orphans, metadata.Orphan{Addr: addr, Bucket: content.Bucket, Hash: content.Hash, Path: path})
+					mutex.Unlock()
+				}
+			}(dp.addr, path)
+		}
+	}
+	wg.Wait()
+
+	if len(orphans) == 0 {
+		return
+	}
+	err := s.meta.PutOrphans(orphans)
+	if err != nil {
+		log.Printf("Failed to record %d orphans of content %s, error: %s", len(orphans), content.Hash, err)
+	}
+}
+
+// Retry deleting orphans each orphanRetryInterval. An orphan is dropped once deleted, once its
+// data provider server is no longer known, or once its content is stored again with the
+// orphan in its locations, since deleting that content later deletes it from every data
+// provider server anyway
+func (s *Server) collectOrphans() {
+	for {
+		time.Sleep(orphanRetryInterval)
+
+		orphans, err := s.meta.Orphans()
+		if err != nil {
+			log.Printf("Unable to list orphans, error: %s", err)
+			continue
+		}
+
+		known := map[string]bool{}
+		for _, dp := range s.dataProviders() {
+			known[dp.addr] = true
+		}
+
+		for _, orphan := range orphans {
+			s.collectOrphan(orphan, known[orphan.Addr])
+		}
+	}
+}
+
+// Delete orphan unless its content places it where it is, known tells if its data provider
+// server is still known
+func (s *Server) collectOrphan(orphan metadata.Orphan, known bool) {
+	s.lockContent(orphan.Bucket, orphan.Hash)
+	defer s.unlockContent(orphan.Bucket, orphan.Hash)
+
+	content, err := s.meta.FindContent(orphan.Bucket, orphan.Hash)
+	if err != nil && err != metadata.ErrNotFound {
+		log.Printf("Failed to find content %s of orphan, error: %s", orphan.Hash, err)
+		return
+	}
+
+	if known && (err == metadata.ErrNotFound || !isPlacedAt(content, orphan.Addr, orphan.Path)) {
+		err = deleteObjectAt(orphan.Addr, orphan.Path)
+		if err != nil {
+			log.Printf("Failed to delete orphan %s from %s, error: %s", orphan.Path, orphan.Addr, err)
+			return
+		}
+		log.Printf("Deleted orphan %s from %s", orphan.Path, orphan.Addr)
+	}
+
+	err = s.meta.DeleteOrphan(orphan)
+	if err != nil {
+		log.Printf("Failed to remove orphan %s of %s, error: %s", orphan.Path, orphan.Addr, err)
+	}
+}
+
+// Determines if content places object at path, a replica or a shard of it, on data provider
+// server at addr
+func isPlacedAt(content metadata.Content, addr string, path string) bool {
+	for i, p := range contentPaths(content) {
+		if p != path {
+			continue
+		}
+		if content.DataShards > 0 {
+			return i < len(content.Locations) && content.Locations[i] == addr
+		}
+		for _, location := range content.Locations {
+			if location == addr {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Delete object at path from data provider server at addr, an absent object is not an error
+func deleteObjectAt(addr string, path string) error {
+	req, err := http.NewRequest("DELETE", "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("data server returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"../metadata"
+)
+
+func TestDeleteRecordsOrphans(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: append(addrs, "127.0.0.1:1"), LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+
+	hash := putObjectAt(t, addrs[0], "content")
+	rec, _ := meta.PutVersion(metadata.Record{Name: "obj", Content: metadata.Content{Hash: hash, Size: 7, Locations: addrs}})
+	if w := serve(h, "DELETE", "/objects/obj?versionId="+versionId(rec), ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE is %d", w.Code)
+	}
+
+	// the server down keeps what it may hold
+	orphan := metadata.Orphan{Addr: "127.0.0.1:1", Hash: hash, Path: "/objects/" + hash}
+	orphans, err := meta.Orphans()
+	if err != nil || len(orphans) != 1 || orphans[0] != orphan {
+		t.Fatalf("orphans are %v, error: %v", orphans, err)
+	}
+	if held := holders(s, addrs, hash); len(held) != 0 {
+		t.Errorf("deleted content held by %v", held)
+	}
+
+	// deleting is retried while the server is known, and given up once it is not
+	s.collectOrphan(orphan, true)
+	if orphans, _ := meta.Orphans(); len(orphans) != 1 {
+		t.Errorf("orphans are %v after failed retry", orphans)
+	}
+	s.collectOrphan(orphan, false)
+	if orphans, _ := meta.Orphans(); len(orphans) != 0 {
+		t.Errorf("orphans are %v after the server left", orphans)
+	}
+}
+
+func TestCollectOrphan(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta})
+
+	// content stored again is not deleted
+	stored := putObjectAt(t, addrs[0], "stored again")
+	meta.PutVersion(metadata.Record{Name: "obj", Content: metadata.Content{Hash: stored, Size: 12, Locations: addrs}})
+	deleted := putObjectAt(t, addrs[0], "deleted")
+	orphans := []metadata.Orphan{{Addr: addrs[0], Hash: stored, Path: "/objects/" + stored},
+		{Addr: addrs[0], Hash: deleted, Path: "/objects/" + deleted}}
+	meta.PutOrphans(orphans)
+
+	for _, orphan := range orphans {
+		s.collectOrphan(orphan, true)
+	}
+
+	if left, _ := meta.Orphans(); len(left) != 0 {
+		t.Errorf("orphans are %v", left)
+	}
+	if !s.isObjectExistsAt(addrs[0], "/objects/"+stored) {
+		t.Error("content stored again was deleted")
+	}
+	if s.isObjectExistsAt(addrs[0], "/objects/"+deleted) {
+		t.Error("orphan was not deleted")
+	}
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Placement policy names, see NewPlacementPolicy
+const (
+	PlaceRandomly    = "random"
+	PlaceByFreeSpace = "weighted"
+	PlaceLeastLoaded = "least-loaded"
+	PlaceTwoChoices  = "p2c"
+
+	// Content is placed on consistent hash ring, see Config.RingVirtualNodes
+	PlaceByRing = "ring"
+)
+
+// Data provider servers with less free space are not selected for new objects
+const minFreeBytes = 64 << 20
+
+// PlacementPolicy selects the data provider server a new object, replica or shard
+// is written to
+type PlacementPolicy interface {
+	// Select one of candidates, there is at least one of them
+	Select(candidates []DataProvider) DataProvider
+}
+
+// Create placement policy by name:
+//
+//	"random", any data provider server with the same probability
+//	"weighted", data provider servers with probability proportional to their free space
+//	"least-loaded", the data provider server serving the fewest requests, counting those
+//	placed on it since its load was last sampled
+//	"p2c", the one with more free space of two data provider servers picked randomly
+func NewPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case PlaceRandomly:
+		return randomPlacement{}, nil
+	case PlaceByFreeSpace:
+		return weightedPlacement{}, nil
+	case PlaceLeastLoaded:
+		return leastLoadedPlacement{}, nil
+	case PlaceTwoChoices:
+		return twoChoicesPlacement{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement policy %s", name)
+}
+
+// Determines if data provider server has room for new objects, servers not probed yet
+// are assumed to have
+func (dp DataProvider) hasRoom() bool {
+	if dp.lastPing == 0 {
+		return true
+	}
+
+	// some file systems have no inode limit and report no inodes at all
+	return dp.freeBytes >= minFreeBytes && (dp.totalInodes == 0 || dp.freeInodes > 0)
+}
+
+type randomPlacement struct{}
+
+// Implements PlacementPolicy
+func (randomPlacement) Select(candidates []DataProvider) DataProvider {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+type weightedPlacement struct{}
+
+// Implements PlacementPolicy, falls back to random if free space of candidates is unknown
+func (weightedPlacement) Select(candidates []DataProvider) DataProvider {
+	var total uint64
+	for _, dp := range candidates {
+		total += dp.freeBytes
+	}
+	if total == 0 {
+		return randomPlacement{}.Select(candidates)
+	}
+
+	n := uint64(rand.Int63n(int64(total>>20)+1)) << 20
+	for _, dp := range candidates {
+		if n < dp.freeBytes {
+			return dp
+		}
+		n -= dp.freeBytes
+	}
+	return candidates[len(candidates)-1]
+}
+
+type leastLoadedPlacement struct{}
+
+// Returns the load of data provider server, requests sampled by the last heartbeat and
+// placements since, so servers are not picked over and over between heartbeats
+func (dp DataProvider) load() int64 {
+	return dp.requests + dp.placed
+}
+
+// Implements PlacementPolicy, ties are broken randomly
+func (leastLoadedPlacement) Select(candidates []DataProvider) DataProvider {
+	best := make([]DataProvider, 0, len(candidates))
+	for _, dp := range candidates {
+		if len(best) > 0 && dp.load() > best[0].load() {
+			continue
+		}
+		if len(best) > 0 && dp.load() < best[0].load() {
+			best = best[:0]
+		}
+		best = append(best, dp)
+	}
+	return randomPlacement{}.Select(best)
+}
+
+type twoChoicesPlacement struct{}
+
+// Implements PlacementPolicy
+func (twoChoicesPlacement) Select(candidates []DataProvider) DataProvider {
+	a := candidates[rand.Intn(len(candidates))]
+	b := candidates[rand.Intn(len(candidates))]
+	if b.freeBytes > a.freeBytes {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestNewPlacementPolicy(t *testing.T) {
+	for _, name := range []string{PlaceRandomly, PlaceByFreeSpace, PlaceLeastLoaded, PlaceTwoChoices} {
+		if _, err := NewPlacementPolicy(name); err != nil {
+			t.Errorf("policy %s, error: %s", name, err)
+		}
+	}
+	if _, err := NewPlacementPolicy("unknown"); err == nil {
+		t.Error("created unknown placement policy")
+	}
+}
+
+func TestHasRoom(t *testing.T) {
+	for _, tc := range []struct {
+		dp   DataProvider
+		want bool
+	}{
+		{DataProvider{}, true},
+		{DataProvider{lastPing: 1, freeBytes: minFreeBytes}, true},
+		{DataProvider{lastPing: 1, freeBytes: minFreeBytes - 1}, false},
+		{DataProvider{lastPing: 1, freeBytes: minFreeBytes, totalInodes: 10, freeInodes: 1}, true},
+		{DataProvider{lastPing: 1, freeBytes: minFreeBytes, totalInodes: 10}, false},
+	} {
+		if got := tc.dp.hasRoom(); got != tc.want {
+			t.Errorf("hasRoom of %+v is %v", tc.dp, got)
+		}
+	}
+}
+
+// Returns how many times each data provider server is selected by policy out of n
+func countSelections(policy PlacementPolicy, candidates []DataProvider, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[policy.Select(candidates).id]++
+	}
+	return counts
+}
+
+func TestWeightedPlacement(t *testing.T) {
+	candidates := []DataProvider{
+		{id: "full", freeBytes: 0},
+		{id: "small", freeBytes: 100 << 20},
+		{id: "large", freeBytes: 300 << 20},
+	}
+	counts := countSelections(weightedPlacement{}, candidates, 4000)
+	if counts["full"] != 0 {
+		t.Errorf("server without free space selected %d times", counts["full"])
+	}
+	if counts["large"] < 2*counts["small"] {
+		t.Errorf("selections are %v, want about 3 times more for large", counts)
+	}
+
+	// free space unknown
+	counts = countSelections(weightedPlacement{}, []DataProvider{{id: "a"}, {id: "b"}}, 1000)
+	if counts["a"] == 0 || counts["b"] == 0 {
+		t.Errorf("selections are %v without free space", counts)
+	}
+}
+
+func TestLeastLoadedPlacement(t *testing.T) {
+	candidates := []DataProvider{
+		{id: "busy", requests: 10},
+		{id: "placed", requests: 1, placed: 5},
+		{id: "idle1", requests: 2},
+		{id: "idle2", requests: 1, placed: 1},
+	}
+	counts := countSelections(leastLoadedPlacement{}, candidates, 1000)
+	if counts["busy"] != 0 || counts["placed"] != 0 {
+		t.Errorf("selections are %v, want only the least loaded", counts)
+	}
+	if counts["idle1"] == 0 || counts["idle2"] == 0 {
+		t.Errorf("selections are %v, want ties broken randomly", counts)
+	}
+}
+
+func TestTwoChoicesPlacement(t *testing.T) {
+	candidates := []DataProvider{
+		{id: "small", freeBytes: 1},
+		{id: "medium", freeBytes: 2},
+		{id: "large", freeBytes: 3},
+	}
+	counts := countSelections(twoChoicesPlacement{}, candidates, 9000)
+
+	// the one with less free space of two picks is never selected unless picked twice,
+	// with 1/9 probability for the smallest
+	if counts["small"] > 1500 || counts["large"] < 4000 {
+		t.Errorf("selections are %v", counts)
+	}
+	if got := (twoChoicesPlacement{}).Select(candidates[:1]); got.id != "small" {
+		t.Errorf("selected %s out of one candidate", got.id)
+	}
+}
+
+func TestSelectDataProviderCountsPlacements(t *testing.T) {
+	s := NewServer(Config{DataProviders: []string{"a:1", "b:1", "full:1"}, LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t), Placement: leastLoadedPlacement{}})
+	for _, dp := range s.dataProviders() {
+		var status providerStatus
+		status.Capacity.FreeBytes = minFreeBytes
+		if dp.addr == "full:1" {
+			status.Capacity.FreeBytes = 0
+		}
+		s.updateDataProvider(dp.id, status, nil)
+	}
+
+	// placements since the last heartbeat spread objects over idle servers
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		dp, err := s.selectDataProvider(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[dp.addr]++
+	}
+	if counts["a:1"] != 5 || counts["b:1"] != 5 {
+		t.Errorf("selections are %v", counts)
+	}
+
+	// a heartbeat samples the load again
+	for _, dp := range s.dataProviders() {
+		if dp.addr == "a:1" {
+			var status providerStatus
+			status.Capacity.FreeBytes = minFreeBytes
+			s.updateDataProvider(dp.id, status, nil)
+		}
+	}
+	if dp, _ := s.selectDataProvider(nil); dp.addr != "a:1" {
+		t.Errorf("selected %s after heartbeat", dp.addr)
+	}
+}
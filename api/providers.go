@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+)
+
+// Registration of a data provider server, its node ID, the address it is reached at and
+// the state set by API servers draining it
+type registration struct {
+	Id    string `json:"id"`
+	Addr  string `json:"addr"`
+	State string `json:"state"`
+}
+
+// Add or update data provider server with node ID id at addr in state. A server known by
+// its address under another ID, like one given at startup, takes the node ID
+func (s *Server) registerDataProvider(id string, addr string, state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dp, ok := s.dp[id]
+	known := ok
+	for otherId, other := range s.dp {
+		if other.addr == addr && otherId != id {
+			if !ok {
+				dp, ok = other, true
+			}
+			delete(s.dp, otherId)
+		}
+	}
+
+	if !ok {
+		log.Printf("Registered data provider server %s at %s", id, addr)
+		dp = DataProvider{status: RUNNING}
+	} else if dp.id != id || dp.addr != addr {
+		log.Printf("Data provider server %s at %s is now %s at %s", dp.id, dp.addr, id, addr)
+	}
+
+	// a server deregistered or found down is up again, like when it answers a heartbeat
+	if ok && !dp.alive() {
+		log.Printf("Data provider server %s is up", addr)
+		dp.missed = 0
+		s.scheduleRepair(addrScope(addr))
+	}
+
+	dp.id = id
+	dp.addr = addr
+	dp.status = adoptState(dp, state)
+	s.dp[id] = dp
+	if !known {
+		s.rebuildRing()
+		s.scheduleRebalance()
+	}
+}
+
+// RESTful API, register a data provider server, "POST /providers" with its node ID and
+// address, {"id": <node ID>, "addr": "host:port"}. Registering again is harmless
+func (s *Server) RegisterDataProvider(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var reg registration
+	err := json.NewDecoder(r.Body).Decode(&reg)
+	if err != nil || reg.Id == "" || reg.Addr == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.registerDataProvider(reg.Id, reg.Addr, reg.State)
+}
+
+// RESTful API, deregister a data provider server by node ID when it shuts down, it is down
+// until it registers again or answers a heartbeat. No more objects are placed on it, and the
+// objects it holds stay there, so restarting a server moves nothing. Servers leaving for
+// good are drained first, see DrainDataProvider
+func (s *Server) DeregisterDataProvider(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+
+	s.mutex.Lock()
+	dp, ok := s.dp[id]
+	if ok {
+		dp.missed = maxMissedHeartbeats
+		s.dp[id] = dp
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Printf("Deregistered data provider server %s at %s", id, dp.addr)
+}
+
+// RESTful API, list data provider servers and their state
+func (s *Server) ListDataProviders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, s.dataProviderInfo())
+}
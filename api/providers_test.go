@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Register data provider server with node ID id at addr on h, returns the response status
+func register(h http.Handler, id string, addr string) int {
+	body, _ := json.Marshal(registration{Id: id, Addr: addr})
+	return serve(h, "POST", "/providers", string(body)).Code
+}
+
+// List data provider servers on h
+func listProviders(h http.Handler) map[string]DataProviderInfo {
+	var infos []DataProviderInfo
+	json.Unmarshal(serve(h, "GET", "/providers", "").Body.Bytes(), &infos)
+	byId := map[string]DataProviderInfo{}
+	for _, info := range infos {
+		byId[info.Id] = info
+	}
+	return byId
+}
+
+func TestRegisterDataProvider(t *testing.T) {
+	addrs := startDataServers(t, 2, nil)
+	s := NewServer(Config{DataProviders: addrs[:1], LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+
+	if status := register(h, "", addrs[1]); status != http.StatusBadRequest {
+		t.Errorf("registering without node ID is %d", status)
+	}
+
+	// a server given at startup takes its node ID, registering again is harmless
+	for i := 0; i < 2; i++ {
+		if status := register(h, "node-a", addrs[0]); status != http.StatusOK {
+			t.Fatalf("registering is %d", status)
+		}
+	}
+	register(h, "node-b", addrs[1])
+	providers := listProviders(h)
+	if len(providers) != 2 || providers["node-a"].Addr != addrs[0] || providers["node-b"].Addr != addrs[1] {
+		t.Fatalf("data servers are %v", providers)
+	}
+
+	// a server moved to another address keeps its node ID
+	register(h, "node-b", "127.0.0.1:1")
+	if providers := listProviders(h); len(providers) != 2 || providers["node-b"].Addr != "127.0.0.1:1" {
+		t.Errorf("data servers after moving are %v", providers)
+	}
+}
+
+func TestDeregisterMarksDataProviderDown(t *testing.T) {
+	addrs := startDataServers(t, 2, nil)
+	s := NewServer(Config{LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+	register(h, "node-a", addrs[0])
+
+	put(h, "/objects/obj", "content")
+	register(h, "node-b", addrs[1])
+
+	if w := serve(h, "DELETE", "/providers/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("deregistering unknown data server is %d", w.Code)
+	}
+	if w := serve(h, "DELETE", "/providers/node-a", ""); w.Code != http.StatusOK {
+		t.Fatalf("deregistering is %d", w.Code)
+	}
+	if providers := listProviders(h); len(providers) != 2 || providers["node-a"].Alive || !providers["node-b"].Alive {
+		t.Fatalf("data servers after deregistering are %v", providers)
+	}
+
+	// content stays where it is, no more is placed there
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "content" {
+		t.Errorf("GET of object on data server deregistered is %d %q", w.Code, w.Body.String())
+	}
+	if held := holders(s, addrs, hashOf("content")); len(held) != 1 || held[0] != addrs[0] {
+		t.Errorf("content held by %v", held)
+	}
+	put(h, "/objects/other", "other content")
+	if held := holders(s, addrs, hashOf("other content")); len(held) != 1 || held[0] != addrs[1] {
+		t.Errorf("content written after deregistering held by %v", held)
+	}
+
+	// up again once registered
+	register(h, "node-a", addrs[0])
+	if providers := listProviders(h); !providers["node-a"].Alive {
+		t.Errorf("data server registered again is %v", providers["node-a"])
+	}
+}
+
+func TestHeartbeatTakesNodeId(t *testing.T) {
+	addr := startDataServers(t, 1, nil)[0]
+	s := NewServer(Config{DataProviders: []string{addr}, LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t), HeartbeatInterval: 10 * time.Millisecond})
+	id := s.dataProviders()[0].id
+
+	info := waitDataProvider(t, s, addr, func(info DataProviderInfo) bool { return info.Id != id })
+	if len(s.dataProviders()) != 1 || !info.Alive {
+		t.Errorf("data servers after heartbeat are %v", s.dataProviderInfo())
+	}
+}
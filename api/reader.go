@@ -0,0 +1,204 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"errors"
+	"io"
+	"log"
+)
+
+// objectReader reads the content of an object from data provider servers, it implements
+// io.ReadSeeker so ranges can be served with http.ServeContent. A seek only moves the
+// offset, the next read reopens the stream if it is not at the offset. Parts of a multipart
+// object are read one after another
+type objectReader struct {
+	s        *Server
+	size     int64
+	contents []metadata.Content
+
+	// Current offset, and the stream with the offset it reads from next, nil if not opened
+	offset       int64
+	stream       io.ReadCloser
+	streamOffset int64
+
+	// Content the stream reads, its offset in object, and the replica address
+	current     int
+	currentBase int64
+	addr        string
+
+	// Replicas of current content that failed, they are skipped when reopening the stream
+	failed map[string]bool
+
+	// The error that ended reading, if any
+	err error
+}
+
+// Create objectReader of object described by rec, the stream is opened at once so an
+// unavailable object is reported before any response is written
+func (s *Server) newObjectReader(rec metadata.Record) (*objectReader, error) {
+	or := &objectReader{
+		s:        s,
+		size:     rec.Size,
+		contents: rec.Contents(),
+		current:  -1,
+	}
+
+	err := or.open()
+	if err != nil {
+		return nil, err
+	}
+	return or, nil
+}
+
+// Open stream of the content holding current offset
+func (or *objectReader) open() error {
+	i, base := 0, int64(0)
+	for i < len(or.contents)-1 && or.offset >= base+or.contents[i].Size {
+		base += or.contents[i].Size
+		i++
+	}
+
+	if i != or.current {
+		or.current = i
+		or.currentBase = base
+		or.failed = map[string]bool{}
+	}
+
+	content := or.contents[i]
+	offset := or.offset - base
+	if content.DataShards > 0 {
+		stream, err := streams.NewRSGetStream(content.Locations, content.Bucket, content.Hash, content.Size,
+			content.DataShards, content.ParityShards, offset)
+		if err != nil {
+			return err
+		}
+		or.stream = stream
+		or.streamOffset = or.offset
+		return nil
+	}
+
+	// the owners of content on ring and the recorded locations (replicas) are tried in order,
+	// if none of them has the content, data provider servers are queried by hash
+	for _, addr := range or.s.replicaAddrs(content) {
+		if or.failed[addr] {
+			continue
+		}
+
+		objNameWithAddr := addr + streams.ObjectPath(content.Bucket, content.Hash)
+		stream, err := streams.NewRangeGetStream(objNameWithAddr, offset)
+		if err != nil {
+			log.Printf("Failed to get object %s, error: %s", objNameWithAddr, err)
+			or.failed[addr] = true
+			continue
+		}
+
+		or.stream = stream
+		or.streamOffset = or.offset
+		or.addr = addr
+		return nil
+	}
+
+	addr, err := or.s.locate(content.Bucket, content.Hash)
+	if err != nil {
+		return err
+	}
+	if or.failed[addr] {
+		return errors.New("all replicas failed")
+	}
+
+	stream, err := streams.NewRangeGetStream(addr+streams.ObjectPath(content.Bucket, content.Hash), offset)
+	if err != nil {
+		return err
+	}
+	or.stream = stream
+	or.streamOffset = or.offset
+	or.addr = addr
+	return nil
+}
+
+// Implements the Read method
+func (or *objectReader) Read(p []byte) (int, error) {
+	n, err := or.read(p)
+	if err != nil && err != io.EOF {
+		or.err = err
+	}
+	return n, err
+}
+
+// Read from the current stream, if a replica fails while reading, the stream is
+// reopened from the next replica at the same offset
+func (or *objectReader) read(p []byte) (int, error) {
+	for {
+		if or.offset >= or.size {
+			return 0, io.EOF
+		}
+
+		// a seek moved the offset away from the stream
+		if or.stream != nil && or.streamOffset != or.offset {
+			or.stream.Close()
+			or.stream = nil
+		}
+
+		if or.stream == nil {
+			err := or.open()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := or.stream.Read(p)
+		or.offset += int64(n)
+		or.streamOffset = or.offset
+		if err == nil || n > 0 {
+			return n, nil
+		}
+
+		or.stream.Close()
+		or.stream = nil
+		content := or.contents[or.current]
+		if err == io.EOF {
+			// move on to the next part
+			if or.offset == or.currentBase+content.Size {
+				continue
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		// erasure coded streams already recover from failing shards, and content already
+		// read from a corrupt replica can't be taken back
+		if content.DataShards > 0 || err == streams.ErrChecksumMismatch {
+			return 0, err
+		}
+
+		log.Printf("Failed to read object %s from %s at offset %d, error: %s, trying next replica",
+			content.Hash, or.addr, or.offset, err)
+		or.failed[or.addr] = true
+	}
+}
+
+// Implements the Seek method, the size of object is known from metadata. The stream is left
+// open, seeking away and back before reading, as http.ServeContent does, costs nothing
+func (or *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += or.offset
+	case io.SeekEnd:
+		offset += or.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	or.offset = offset
+	return offset, nil
+}
+
+// Close the current stream
+func (or *objectReader) Close() error {
+	if or.stream == nil {
+		return nil
+	}
+	return or.stream.Close()
+}
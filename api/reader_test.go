@@ -0,0 +1,103 @@
+package api
+
+import (
+	"../metadata"
+	"bytes"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a fake data provider server serving objects by path, returns its address
+func startObjectServer(t *testing.T, objects map[string][]byte) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// Get object name with the given request headers
+func getObject(s *Server, name string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/objects/"+name, nil)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	s.GetObject(w, r, httprouter.Params{{Key: "name", Value: name}})
+	return w
+}
+
+func TestGetObjectRanges(t *testing.T) {
+	store := newTestMetadata(t)
+	s := NewServer(Config{Metadata: store, LocateMode: LocateByHTTP})
+	data := []byte("0123456789abcdefghij")
+	addr := startObjectServer(t, map[string][]byte{"/objects/h": data})
+
+	// the first replica is unreachable, the object is read from the second one
+	store.PutVersion(metadata.Record{Name: "obj", Content: metadata.Content{
+		Size: int64(len(data)), Hash: "h", Locations: []string{"127.0.0.1:1", addr}}})
+
+	for _, tc := range []struct {
+		headers map[string]string
+		code    int
+		body    []byte
+	}{
+		{nil, http.StatusOK, data},
+		{map[string]string{"Range": "bytes=5-9"}, http.StatusPartialContent, data[5:10]},
+		{map[string]string{"Range": "bytes=15-"}, http.StatusPartialContent, data[15:]},
+		{map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, data[17:]},
+		{map[string]string{"Range": "bytes=30-"}, http.StatusRequestedRangeNotSatisfiable, nil},
+		{map[string]string{"Range": "bytes=5-9", "If-Range": `"h"`}, http.StatusPartialContent, data[5:10]},
+		{map[string]string{"Range": "bytes=5-9", "If-Range": `"other"`}, http.StatusOK, data},
+	} {
+		w := getObject(s, "obj", tc.headers)
+		if w.Code != tc.code {
+			t.Errorf("GET with %v returned %d, want %d", tc.headers, w.Code, tc.code)
+			continue
+		}
+		if tc.body != nil && !bytes.Equal(w.Body.Bytes(), tc.body) {
+			t.Errorf("GET with %v is %q, want %q", tc.headers, w.Body.Bytes(), tc.body)
+		}
+	}
+
+	if w := getObject(s, "missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing object returned %d", w.Code)
+	}
+}
+
+func TestObjectReaderSeeks(t *testing.T) {
+	s := NewServer(Config{Metadata: newTestMetadata(t), LocateMode: LocateByHTTP})
+	data := []byte("0123456789abcdefghij")
+	addr := startObjectServer(t, map[string][]byte{"/objects/h": data})
+
+	or, err := s.newObjectReader(metadata.Record{Content: metadata.Content{
+		Size: int64(len(data)), Hash: "h", Locations: []string{addr}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer or.Close()
+
+	// seeking to the end and back, as http.ServeContent does, keeps the stream
+	stream := or.stream
+	or.Seek(0, io.SeekEnd)
+	or.Seek(0, io.SeekStart)
+	p := make([]byte, 4)
+	if n, _ := or.Read(p); string(p[:n]) != "0123" || or.stream != stream {
+		t.Errorf("read %q, stream reopened: %v", p[:n], or.stream != stream)
+	}
+
+	or.Seek(10, io.SeekStart)
+	if n, _ := or.Read(p); string(p[:n]) != "abcd" {
+		t.Errorf("read %q after seeking", p[:n])
+	}
+}
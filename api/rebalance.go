@@ -0,0 +1,590 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"../util"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Delay between a data provider server joining or leaving and rebalancing, so servers
+// joining or leaving together are rebalanced in one pass
+const rebalanceDelay = 10 * time.Second
+
+// rebalancer moves content to where it belongs after data provider servers join or leave.
+// With consistent hash ring, content belongs to its owners on ring, otherwise content on
+// servers that left, or on servers holding more than their share, is copied to servers
+// selected by placement policy
+type rebalancer struct {
+	// Bytes copied per second
+	rate int64
+
+	// Starts a pass after rebalanceDelay, or at once
+	trigger chan struct{}
+	start   chan struct{}
+
+	// Progress
+	status RebalanceStatus
+
+	// mutex on status
+	mutex sync.Mutex
+}
+
+// RebalanceStatus is the progress of rebalancer, returned by the admin endpoint
+type RebalanceStatus struct {
+	Running  bool      `json:"running"`
+	Passes   int       `json:"passes"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Total    int       `json:"total"`
+	Checked  int       `json:"checked"`
+	Copied   int       `json:"copied"`
+	Removed  int       `json:"removed"`
+	Failed   int       `json:"failed"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Start rebalancer copying at most rate bytes per second
+func (s *Server) startRebalancer(rate int64) {
+	rb := &rebalancer{
+		rate:    rate,
+		trigger: make(chan struct{}, 1),
+		start:   make(chan struct{}, 1),
+	}
+	s.rebalancer = rb
+
+	go func() {
+		for {
+			select {
+			case <-rb.trigger:
+				select {
+				case <-time.After(rebalanceDelay):
+				case <-rb.start:
+				}
+			case <-rb.start:
+			}
+
+			// servers joining or leaving meanwhile are handled by this pass
+			select {
+			case <-rb.trigger:
+			default:
+			}
+			s.rebalance()
+		}
+	}()
+}
+
+// Schedule a rebalance pass, called when data provider servers join or leave
+func (s *Server) scheduleRebalance() {
+	if s.rebalancer == nil {
+		return
+	}
+
+	select {
+	case s.rebalancer.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run a rebalance pass over all content
+func (s *Server) rebalance() {
+	rb := s.rebalancer
+	contents, err := s.meta.Contents()
+	if err != nil {
+		log.Printf("Rebalancer unable to list contents, error: %s", err)
+		return
+	}
+
+	rb.mutex.Lock()
+	rb.status = RebalanceStatus{
+		Running: true,
+		Passes:  rb.status.Passes,
+		Started: time.Now().UTC(),
+		Total:   len(contents),
+	}
+	rb.mutex.Unlock()
+	log.Printf("Rebalancer started, %d contents", len(contents))
+
+	var sp *spread
+	if s.ringVirtualNodes == 0 {
+		sp = s.measureSpread(contents)
+	}
+
+	throttle := util.NewThrottle(rb.rate)
+	for _, content := range contents {
+		s.withContent(content, func(content metadata.Content) {
+			if content.DataShards > 0 {
+				s.rebalanceShards(content, sp, throttle)
+			} else {
+				s.rebalanceReplicas(content, sp, throttle)
+			}
+		})
+
+		rb.mutex.Lock()
+		rb.status.Checked++
+		rb.status.Bytes = throttle.Read()
+		rb.mutex.Unlock()
+	}
+
+	rb.mutex.Lock()
+	rb.status.Running = false
+	rb.status.Passes++
+	rb.status.Finished = time.Now().UTC()
+	status := rb.status
+	rb.mutex.Unlock()
+	log.Printf("Rebalancer finished, %d copied, %d removed, %d failed", status.Copied, status.Removed, status.Failed)
+}
+
+// Record the result of a copy or removal
+func (rb *rebalancer) count(copied int, removed int, failed int) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	rb.status.Copied += copied
+	rb.status.Removed += removed
+	rb.status.Failed += failed
+}
+
+// Returns the n data provider servers content by hash belongs to, current are the servers
+// holding it and size the bytes each of them holds. Without ring, the current servers still
+// registered are kept unless they hold more than their share of content, and servers
+// selected by placement policy among those holding less than their share replace the others
+func (s *Server) desiredAddrs(hash string, current []string, n int, size int64, sp *spread) []string {
+	if s.ringVirtualNodes > 0 {
+		// owners down for a while keep their place, content is copied when they are back
+		addrs := make([]string, 0, n)
+		for _, dp := range s.ringOwners(hash, n, func(dp DataProvider) bool { return dp.status == RUNNING }) {
+			addrs = append(addrs, dp.addr)
+		}
+		return addrs
+	}
+
+	registered := map[string]DataProvider{}
+	for _, dp := range s.dataProviders() {
+		registered[dp.addr] = dp
+	}
+
+	// servers holding content already are never selected to receive another copy
+	exclude := map[string]bool{}
+	for _, addr := range current {
+		if dp, ok := registered[addr]; ok {
+			exclude[dp.id] = true
+		}
+	}
+
+	addrs := make([]string, 0, n)
+	kept := map[string]bool{}
+	for _, addr := range current {
+		dp, ok := registered[addr]
+		if !ok || dp.status != RUNNING || kept[addr] || len(addrs) >= n {
+			continue
+		}
+		kept[addr] = true
+
+		if sp.over(addr) {
+			if target, ok := s.selectUnderShare(exclude, size, sp); ok {
+				exclude[target.id] = true
+				sp.add(addr, -size)
+				sp.add(target.addr, size)
+				addrs = append(addrs, target.addr)
+				continue
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+
+	for len(addrs) < n {
+		dp, ok := s.selectUnderShare(exclude, size, sp)
+		if !ok {
+			var err error
+			dp, err = s.selectDataProvider(exclude)
+			if err != nil {
+				break
+			}
+		}
+		exclude[dp.id] = true
+		sp.add(dp.addr, size)
+		addrs = append(addrs, dp.addr)
+	}
+	return addrs
+}
+
+// spread is the bytes of content held by each running data provider server and its share
+// of all content by capacity, used without ring to move content from servers holding more
+// than their share to servers holding less, such as servers that just joined
+type spread struct {
+	held  map[string]int64
+	share map[string]int64
+}
+
+// Servers holding up to 1/spreadTolerance more than their share are not moved from, so
+// content is not moved back and forth over small differences
+const spreadTolerance = 10
+
+// Returns the bytes each data provider server holds of content, one shard of erasure
+// coded content or one replica
+func heldSize(content metadata.Content) int64 {
+	if content.DataShards > 0 {
+		return (content.Size + int64(content.DataShards) - 1) / int64(content.DataShards)
+	}
+	return content.Size
+}
+
+// Measure the spread of contents over running data provider servers, the capacity of
+// a server is what it holds and its free space. Shares are equal if the free space of
+// some server is not known yet
+func (s *Server) measureSpread(contents []metadata.Content) *spread {
+	sp := &spread{held: map[string]int64{}, share: map[string]int64{}}
+	running := make([]DataProvider, 0)
+	for _, dp := range s.dataProviders() {
+		if dp.status == RUNNING {
+			running = append(running, dp)
+			sp.held[dp.addr] = 0
+		}
+	}
+	if len(running) == 0 {
+		return sp
+	}
+
+	var total int64
+	for _, content := range contents {
+		n := s.replicas
+		if content.DataShards > 0 {
+			n = len(content.Locations)
+		}
+		total += heldSize(content) * int64(n)
+
+		for _, addr := range dedupAddrs(content.Locations) {
+			if _, ok := sp.held[addr]; ok {
+				sp.held[addr] += heldSize(content)
+			}
+		}
+	}
+
+	capacity := make([]float64, len(running))
+	var totalCapacity float64
+	for i, dp := range running {
+		if dp.lastPing == 0 {
+			totalCapacity = 0
+			break
+		}
+		capacity[i] = float64(sp.held[dp.addr]) + float64(dp.freeBytes)
+		totalCapacity += capacity[i]
+	}
+
+	for i, dp := range running {
+		if totalCapacity > 0 {
+			sp.share[dp.addr] = int64(float64(total) * capacity[i] / totalCapacity)
+		} else {
+			sp.share[dp.addr] = total / int64(len(running))
+		}
+	}
+	return sp
+}
+
+// Determines if running data provider server at addr holds more than its share
+func (sp *spread) over(addr string) bool {
+	if sp == nil {
+		return false
+	}
+	share, ok := sp.share[addr]
+	return ok && sp.held[addr] > share+share/spreadTolerance
+}
+
+// Determines if running data provider server at addr can hold size more bytes within
+// its share
+func (sp *spread) under(addr string, size int64) bool {
+	if sp == nil {
+		return false
+	}
+	share, ok := sp.share[addr]
+	return ok && sp.held[addr]+size <= share
+}
+
+// Record that server at addr holds size more bytes, or less if size is negative
+func (sp *spread) add(addr string, size int64) {
+	if sp == nil {
+		return
+	}
+	if _, ok := sp.held[addr]; ok {
+		sp.held[addr] += size
+	}
+}
+
+// Select a data provider server by placement policy among those that can hold size more
+// bytes within their share, returns false if there is none
+func (s *Server) selectUnderShare(exclude map[string]bool, size int64, sp *spread) (DataProvider, bool) {
+	dps := make([]DataProvider, 0)
+	for _, dp := range s.liveDataProviders() {
+		if !exclude[dp.id] && dp.hasRoom() && dp.status == RUNNING && sp.under(dp.addr, size) {
+			dps = append(dps, dp)
+		}
+	}
+
+	if len(dps) == 0 {
+		return DataProvider{}, false
+	}
+	return s.placement.Select(dps), true
+}
+
+// Determines if a data provider server at addr is registered
+func (s *Server) isRegistered(addr string) bool {
+	for _, dp := range s.dataProviders() {
+		if dp.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy replicas of content to the servers it belongs to, and remove the replicas on other
+// servers once all copies are made
+func (s *Server) rebalanceReplicas(content metadata.Content, sp *spread, throttle *util.Throttle) {
+	desired := s.desiredAddrs(content.Hash, content.Locations, s.replicas, heldSize(content), sp)
+	holding := map[string]bool{}
+	for _, addr := range content.Locations {
+		holding[addr] = true
+	}
+
+	path := streams.ObjectPath(content.Bucket, content.Hash)
+	locations := make([]string, 0, len(desired))
+	copied := make([]placedObject, 0)
+	for _, addr := range desired {
+		if holding[addr] {
+			locations = append(locations, addr)
+			continue
+		}
+
+		err := s.copyFromAny(content.Locations, addr, path, content.Hash, throttle)
+		if err != nil {
+			log.Printf("Rebalancer failed to copy content %s to %s, error: %s", content.Hash, addr, err)
+			s.rebalancer.count(0, 0, 1)
+			continue
+		}
+		s.rebalancer.count(1, 0, 0)
+		locations = append(locations, addr)
+		copied = append(copied, placedObject{addr, path})
+	}
+
+	// replicas that are not where they belong are kept until all copies are made
+	if len(locations) < len(desired) {
+		locations = append(locations, content.Locations...)
+		locations = dedupAddrs(locations)
+	}
+
+	if len(copied) == 0 && len(locations) == len(content.Locations) {
+		return
+	}
+
+	kept := map[string]bool{}
+	for _, addr := range locations {
+		kept[addr] = true
+	}
+	s.commitLocations(content, locations, copied, func() {
+		for _, addr := range content.Locations {
+			if !kept[addr] {
+				s.removeMisplaced(addr, path)
+			}
+		}
+	})
+}
+
+// Copy shards of content that are not on a server it belongs to, to a server it belongs to
+// holding no other shard of it, and remove them from where they were
+func (s *Server) rebalanceShards(content metadata.Content, sp *spread, throttle *util.Throttle) {
+	desired := s.desiredAddrs(content.Hash, content.Locations, len(content.Locations), heldSize(content), sp)
+	wanted := map[string]bool{}
+	for _, addr := range desired {
+		wanted[addr] = true
+	}
+
+	// shards already on a server they belong to stay, one shard per server
+	used := map[string]bool{}
+	misplaced := make([]int, 0)
+	for i, addr := range content.Locations {
+		if wanted[addr] && !used[addr] {
+			used[addr] = true
+		} else {
+			misplaced = append(misplaced, i)
+		}
+	}
+
+	free := make([]string, 0)
+	for _, addr := range desired {
+		if !used[addr] {
+			free = append(free, addr)
+		}
+	}
+
+	locations := append([]string(nil), content.Locations...)
+	moved := map[int]string{}
+	copied := make([]placedObject, 0)
+	for _, i := range misplaced {
+		if len(free) == 0 {
+			break
+		}
+
+		path := streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i))
+		err := s.copyFromAny([]string{content.Locations[i]}, free[0], path, "", throttle)
+		if err != nil {
+			log.Printf("Rebalancer failed to copy shard %s to %s, error: %s", path, free[0], err)
+			s.rebalancer.count(0, 0, 1)
+			continue
+		}
+		s.rebalancer.count(1, 0, 0)
+
+		locations[i] = free[0]
+		moved[i] = content.Locations[i]
+		copied = append(copied, placedObject{free[0], path})
+		free = free[1:]
+	}
+
+	if len(moved) == 0 {
+		return
+	}
+
+	s.commitLocations(content, locations, copied, func() {
+		for i, addr := range moved {
+			s.removeMisplaced(addr, streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i)))
+		}
+	})
+}
+
+// Copy object at path from the first of srcs having it to dst, hash is sent for verification
+func (s *Server) copyFromAny(srcs []string, dst string, path string, hash string, throttle *util.Throttle) error {
+	var err error
+	for _, src := range srcs {
+		err = copyObject(src, dst, path, hash, throttle)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Copy object at path from data provider server src to dst through throttle
+func copyObject(src string, dst string, path string, hash string, throttle *util.Throttle) error {
+	getStream, err := streams.NewGetStream(src + path)
+	if err != nil {
+		return err
+	}
+	defer getStream.Close()
+
+	putStream := streams.NewPutStream(dst+path, hash)
+	_, err = io.Copy(putStream, throttle.Reader(getStream))
+	if err != nil {
+		putStream.Abort()
+		return err
+	}
+	return putStream.Close()
+}
+
+// placedObject is object at path on data provider server at addr
+type placedObject struct {
+	addr string
+	path string
+}
+
+// Run move on the current content of bucket by hash, content no longer referenced is skipped.
+// Content is copied without its content lock, so PUT and DELETE of it are not held up by a
+// throttled copy, commitLocations takes the lock to save where it was copied
+func (s *Server) withContent(content metadata.Content, move func(metadata.Content)) {
+	current, err := s.meta.FindContent(content.Bucket, content.Hash)
+	if err != nil {
+		return
+	}
+	move(current)
+}
+
+// Save the new locations of content under its content lock, so a PUT deduplicating it records
+// either the old locations, which are updated with the others, or the new ones. Then cleanup,
+// if not nil, runs under the lock to remove what content no longer places. If content was
+// deleted or moved meanwhile, the copies made of it are removed instead, except those its
+// current locations place, and false is returned
+func (s *Server) commitLocations(content metadata.Content, locations []string, copied []placedObject,
+	cleanup func()) bool {
+	s.lockContent(content.Bucket, content.Hash)
+	defer s.unlockContent(content.Bucket, content.Hash)
+
+	err := s.meta.UpdateLocations(content.Bucket, content.Hash, content.Locations, locations)
+	if err == nil {
+		if cleanup != nil {
+			cleanup()
+		}
+		return true
+	}
+
+	if err != metadata.ErrNotFound {
+		log.Printf("Failed to save locations of content %s, error: %s", content.Hash, err)
+	}
+
+	// another pass may have copied content to the same place
+	current, err := s.meta.FindContent(content.Bucket, content.Hash)
+	for _, obj := range copied {
+		if err == nil && isPlacedAt(current, obj.addr, obj.path) {
+			continue
+		}
+		deleteObjectAt(obj.addr, obj.path)
+	}
+	return false
+}
+
+// Remove object at path from data provider server at addr it does not belong to, servers
+// that left are not reachable any more
+func (s *Server) removeMisplaced(addr string, path string) {
+	if !s.isRegistered(addr) {
+		return
+	}
+
+	err := deleteObjectAt(addr, path)
+	if err != nil {
+		log.Printf("Rebalancer failed to remove %s from %s, error: %s", path, addr, err)
+		s.rebalancer.count(0, 0, 1)
+		return
+	}
+	s.rebalancer.count(0, 1, 0)
+}
+
+// Returns addrs without duplicates, in order
+func dedupAddrs(addrs []string) []string {
+	seen := map[string]bool{}
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !seen[addr] {
+			seen[addr] = true
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// Admin API, get rebalancer progress
+func (s *Server) GetRebalanceStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.rebalancer == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	s.rebalancer.mutex.Lock()
+	status := s.rebalancer.status
+	s.rebalancer.mutex.Unlock()
+	writeJSON(w, status)
+}
+
+// Admin API, start a rebalance pass now, unless one is running
+func (s *Server) StartRebalance(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.rebalancer == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case s.rebalancer.start <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+// Start a rebalance pass on h and wait for it to finish, returns its progress
+func rebalanceNow(t *testing.T, h http.Handler) RebalanceStatus {
+	t.Helper()
+	var before RebalanceStatus
+	json.Unmarshal(serve(h, "GET", "/admin/rebalance", "").Body.Bytes(), &before)
+	if w := serve(h, "POST", "/admin/rebalance", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("starting rebalance returned %d", w.Code)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var status RebalanceStatus
+		json.Unmarshal(serve(h, "GET", "/admin/rebalance", "").Body.Bytes(), &status)
+		if status.Passes > before.Passes && !status.Running {
+			return status
+		}
+	}
+	t.Fatal("rebalance pass did not finish")
+	return RebalanceStatus{}
+}
+
+// Put n objects "obj<i>" with content "content <i>" on h
+func putObjects(t *testing.T, h http.Handler, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if w := put(h, "/objects/obj"+strconv.Itoa(i), "content "+strconv.Itoa(i)); w.Code != http.StatusOK {
+			t.Fatalf("PUT of obj%d is %d", i, w.Code)
+		}
+	}
+}
+
+func TestRebalanceSpreadsContentToJoiningServer(t *testing.T) {
+	addrs := startDataServers(t, 2, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs[:1], LocateMode: LocateByHTTP, Metadata: meta, RebalanceRate: 1 << 20})
+	h := apiRouter(s)
+	putObjects(t, h, 10)
+
+	register(h, "joined", addrs[1])
+	status := rebalanceNow(t, h)
+	if status.Total != 10 || status.Checked != 10 || status.Copied == 0 || status.Copied != status.Removed ||
+		status.Failed != 0 {
+		t.Errorf("rebalance status is %+v", status)
+	}
+
+	moved := 0
+	for i := 0; i < 10; i++ {
+		name, content := "obj"+strconv.Itoa(i), "content "+strconv.Itoa(i)
+		rec, _ := meta.Get("", name)
+		held := holders(s, addrs, hashOf(content))
+		if len(held) != 1 || len(rec.Locations) != 1 || rec.Locations[0] != held[0] {
+			t.Errorf("%s held by %v, recorded at %v", name, held, rec.Locations)
+		}
+		if len(held) == 1 && held[0] == addrs[1] {
+			moved++
+		}
+		if w := serve(h, "GET", "/objects/"+name, ""); w.Body.String() != content {
+			t.Errorf("GET of %s is %q", name, w.Body.String())
+		}
+	}
+	if moved == 0 || moved == 10 {
+		t.Errorf("%d of 10 contents moved to joining server", moved)
+	}
+
+	// content is balanced, another pass moves nothing
+	if status := rebalanceNow(t, h); status.Copied != 0 || status.Removed != 0 {
+		t.Errorf("second rebalance status is %+v", status)
+	}
+}
+
+func TestRebalanceMovesContentToRingOwners(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs[:2], LocateMode: LocateByHTTP, Metadata: meta, Replicas: 2,
+		RingVirtualNodes: 16, RebalanceRate: 1 << 20})
+	h := apiRouter(s)
+	putObjects(t, h, 10)
+
+	register(h, "joined", addrs[2])
+	if status := rebalanceNow(t, h); status.Copied == 0 || status.Failed != 0 {
+		t.Errorf("rebalance status is %+v", status)
+	}
+
+	for i := 0; i < 10; i++ {
+		name, content := "obj"+strconv.Itoa(i), "content "+strconv.Itoa(i)
+		owners := make([]string, 0)
+		for _, dp := range s.ringOwners(hashOf(content), 2, DataProvider.alive) {
+			owners = append(owners, dp.addr)
+		}
+		held := holders(s, addrs, hashOf(content))
+		rec, _ := meta.Get("", name)
+		recorded := append([]string(nil), rec.Locations...)
+		sort.Strings(owners)
+		sort.Strings(held)
+		sort.Strings(recorded)
+		if len(held) != 2 || held[0] != owners[0] || held[1] != owners[1] || !equalStrings(recorded, owners) {
+			t.Errorf("%s held by %v, recorded at %v, owners are %v", name, held, rec.Locations, owners)
+		}
+	}
+}
+
+// Determines if a and b hold the same strings in the same order
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCommitLocationsRemovesCopiesOfMovedContent(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs[:1], LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+	put(h, "/objects/obj", "content")
+	rec, _ := meta.Get("", "obj")
+
+	// another API server moved content meanwhile, the copy made from the old locations goes
+	register(h, "b", addrs[1])
+	register(h, "c", addrs[2])
+	hash := hashOf("content")
+	path := "/objects/" + hash
+	if err := meta.UpdateLocations("", hash, rec.Locations, []string{addrs[1]}); err != nil {
+		t.Fatal(err)
+	}
+	err := copyObject(addrs[0], addrs[2], path, hash, util.NewThrottle(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleaned := false
+	if s.commitLocations(rec.Content, []string{addrs[2]}, []placedObject{{addrs[2], path}}, func() { cleaned = true }) {
+		t.Errorf("committed locations of moved content")
+	}
+	if cleaned || s.isObjectExistsAt(addrs[2], path) {
+		t.Errorf("copy of moved content kept, cleanup ran: %v", cleaned)
+	}
+
+	// content deleted meanwhile
+	current, _ := meta.FindContent("", hash)
+	meta.DeleteVersion("", "obj", rec.Version)
+	if s.commitLocations(current, []string{addrs[0]}, []placedObject{{addrs[0], path}}, nil) {
+		t.Errorf("committed locations of deleted content")
+	}
+	if s.isObjectExistsAt(addrs[0], path) {
+		t.Errorf("copy of deleted content kept")
+	}
+}
+
+func TestPutRestoresLostContentForEveryObject(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	meta := newTestMetadata(t)
+	h := apiRouter(NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta}))
+	put(h, "/objects/old", "content")
+
+	// the only copy is lost, storing the content again stores it for the old object as well
+	err := os.Remove(filepath.Join(dataStorages[addrs[0]], "objects", hashOf("content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := put(h, "/objects/new", "content"); w.Code != http.StatusOK {
+		t.Fatalf("PUT is %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/old", ""); w.Body.String() != "content" {
+		t.Errorf("GET of old object is %q", w.Body.String())
+	}
+	old, _ := meta.Get("", "old")
+	restored, _ := meta.Get("", "new")
+	if !equalStrings(old.Locations, restored.Locations) {
+		t.Errorf("old object at %v, new one at %v", old.Locations, restored.Locations)
+	}
+}
@@ -0,0 +1,424 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"../util"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repairer restores content that fell below its replication or erasure coding target,
+// after a data provider server is declared down or reports a corrupt object. Missing
+// replicas are copied from healthy ones, missing shards are reconstructed from the others
+type repairer struct {
+	// Bytes copied per second
+	rate int64
+
+	// Starts a pass at once when signalled
+	trigger chan struct{}
+
+	// Content the next pass checks
+	scope repairScope
+
+	// Progress
+	status RepairStatus
+
+	// mutex on scope and status
+	mutex sync.Mutex
+}
+
+// repairScope is the content a repair pass checks, all of it, or content located on
+// data provider servers that went down or came back, and content reported corrupt
+type repairScope struct {
+	all bool
+
+	// Addresses of data provider servers
+	addrs map[string]bool
+
+	// Contents by bucket and hash, see contentKey
+	contents map[string]bool
+}
+
+// Add other to scope
+func (sc *repairScope) add(other repairScope) {
+	sc.all = sc.all || other.all
+	for addr := range other.addrs {
+		if sc.addrs == nil {
+			sc.addrs = map[string]bool{}
+		}
+		sc.addrs[addr] = true
+	}
+	for key := range other.contents {
+		if sc.contents == nil {
+			sc.contents = map[string]bool{}
+		}
+		sc.contents[key] = true
+	}
+}
+
+// Determines if content is in scope
+func (sc repairScope) includes(content metadata.Content) bool {
+	if sc.all || sc.contents[contentKey(content.Bucket, content.Hash)] {
+		return true
+	}
+	for _, addr := range content.Locations {
+		if sc.addrs[addr] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key of content of bucket by hash
+func contentKey(bucket string, hash string) string {
+	return bucket + "/" + hash
+}
+
+// Returns the scope of data provider server at addr
+func addrScope(addr string) repairScope {
+	return repairScope{addrs: map[string]bool{addr: true}}
+}
+
+// RepairStatus is the progress of repairer, returned by the admin endpoint
+type RepairStatus struct {
+	Running  bool      `json:"running"`
+	Passes   int       `json:"passes"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Total    int       `json:"total"`
+	Checked  int       `json:"checked"`
+	Degraded int       `json:"degraded"`
+	Repaired int       `json:"repaired"`
+	Lost     int       `json:"lost"`
+	Failed   int       `json:"failed"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Start repairer copying at most rate bytes per second
+func (s *Server) startRepairer(rate int64) {
+	rp := &repairer{
+		rate:    rate,
+		trigger: make(chan struct{}, 1),
+	}
+	s.repairer = rp
+
+	go func() {
+		for range rp.trigger {
+			s.repair()
+		}
+	}()
+}
+
+// Schedule a repair pass of content in scope, called when a data provider server is declared
+// down or comes back, or an object is found corrupt
+func (s *Server) scheduleRepair(scope repairScope) {
+	if s.repairer == nil {
+		return
+	}
+
+	s.repairer.mutex.Lock()
+	s.repairer.scope.add(scope)
+	s.repairer.mutex.Unlock()
+
+	select {
+	case s.repairer.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run a repair pass over content in scope, only the content in scope is checked for
+// missing replicas and shards
+func (s *Server) repair() {
+	rp := s.repairer
+	rp.mutex.Lock()
+	scope := rp.scope
+	rp.scope = repairScope{}
+	rp.mutex.Unlock()
+
+	all, err := s.meta.Contents()
+	if err != nil {
+		log.Printf("Repairer unable to list contents, error: %s", err)
+		return
+	}
+
+	contents := make([]metadata.Content, 0)
+	for _, content := range all {
+		if scope.includes(content) {
+			contents = append(contents, content)
+		}
+	}
+
+	rp.mutex.Lock()
+	rp.status = RepairStatus{
+		Running: true,
+		Passes:  rp.status.Passes,
+		Started: time.Now().UTC(),
+		Total:   len(contents),
+	}
+	rp.mutex.Unlock()
+	log.Printf("Repairer started, %d contents", len(contents))
+
+	throttle := util.NewThrottle(rp.rate)
+	for _, content := range contents {
+		s.withContent(content, func(content metadata.Content) {
+			if content.DataShards > 0 {
+				s.repairShards(content, throttle)
+			} else {
+				s.repairReplicas(content, throttle)
+			}
+		})
+
+		rp.mutex.Lock()
+		rp.status.Checked++
+		rp.status.Bytes = throttle.Read()
+		rp.mutex.Unlock()
+	}
+
+	rp.mutex.Lock()
+	rp.status.Running = false
+	rp.status.Passes++
+	rp.status.Finished = time.Now().UTC()
+	status := rp.status
+	rp.mutex.Unlock()
+	log.Printf("Repairer finished, %d degraded, %d repaired, %d lost, %d failed",
+		status.Degraded, status.Repaired, status.Lost, status.Failed)
+}
+
+// Record the result of repairing a degraded content
+func (rp *repairer) count(repaired int, lost int, failed int) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	rp.status.Degraded++
+	rp.status.Repaired += repaired
+	rp.status.Lost += lost
+	rp.status.Failed += failed
+}
+
+// Determines if object at path is held by data provider server at addr
+func objectExistsAt(addr string, path string) bool {
+	req, err := http.NewRequest("HEAD", "http://"+addr+path, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Copy replicas of content from the healthy ones until there are as many as configured.
+// Replicas on servers down are kept in its locations, they count again once the servers are
+// back, then replicas beyond the target are removed. Replicas on servers that left or missing
+// the object are dropped from its locations
+func (s *Server) repairReplicas(content metadata.Content, throttle *util.Throttle) {
+	registered := map[string]DataProvider{}
+	for _, dp := range s.dataProviders() {
+		registered[dp.addr] = dp
+	}
+
+	path := streams.ObjectPath(content.Bucket, content.Hash)
+	healthy := make([]string, 0, len(content.Locations))
+	down := make([]string, 0)
+	exclude := map[string]bool{}
+	for _, addr := range dedupAddrs(content.Locations) {
+		dp, ok := registered[addr]
+		if !ok {
+			continue
+		}
+		if !dp.alive() {
+			down = append(down, addr)
+			exclude[dp.id] = true
+		} else if objectExistsAt(addr, path) {
+			healthy = append(healthy, addr)
+			exclude[dp.id] = true
+		}
+	}
+
+	if len(healthy) == s.replicas && len(healthy)+len(down) == len(content.Locations) {
+		return
+	}
+	if len(healthy) == 0 {
+		if len(down) > 0 {
+			log.Printf("Repairer found no healthy replica of content %s, %d on servers down", content.Hash, len(down))
+			s.repairer.count(0, 0, 1)
+		} else {
+			log.Printf("Repairer found no healthy replica of content %s", content.Hash)
+			s.repairer.count(0, 1, 0)
+		}
+		return
+	}
+
+	// replicas beyond the target are left by repairs made while a server was down
+	extra := make([]string, 0)
+	if len(healthy) > s.replicas {
+		extra = healthy[s.replicas:]
+		healthy = healthy[:s.replicas]
+	}
+
+	locations := append([]string(nil), healthy...)
+	copied := make([]placedObject, 0)
+	failed := 0
+	for len(locations) < s.replicas {
+		dp, err := s.selectDataProvider(exclude)
+		if err != nil {
+			log.Printf("Repairer found no data provider server for content %s, error: %s", content.Hash, err)
+			failed++
+			break
+		}
+		exclude[dp.id] = true
+
+		err = s.copyFromAny(healthy, dp.addr, path, content.Hash, throttle)
+		if err != nil {
+			log.Printf("Repairer failed to copy content %s to %s, error: %s", content.Hash, dp.addr, err)
+			failed++
+			continue
+		}
+		locations = append(locations, dp.addr)
+		copied = append(copied, placedObject{dp.addr, path})
+	}
+	locations = append(locations, down...)
+
+	s.commitLocations(content, locations, copied, func() {
+		for _, addr := range extra {
+			err := deleteObjectAt(addr, path)
+			if err != nil {
+				log.Printf("Repairer failed to remove extra replica of content %s from %s, error: %s",
+					content.Hash, addr, err)
+			}
+		}
+		log.Printf("Repaired content %s, %d of %d replicas, %d on servers down, %d extra removed",
+			content.Hash, len(locations)-len(down), s.replicas, len(down), len(extra))
+	})
+	if failed > 0 {
+		s.repairer.count(0, 0, 1)
+	} else {
+		s.repairer.count(1, 0, 0)
+	}
+}
+
+// Reconstruct shards of content on servers down or missing them from the other shards,
+// and write them to servers holding no shard of it. Shards left on servers down are
+// recorded as orphans, so they are deleted once the servers are back
+func (s *Server) repairShards(content metadata.Content, throttle *util.Throttle) {
+	registered := map[string]DataProvider{}
+	for _, dp := range s.dataProviders() {
+		registered[dp.addr] = dp
+	}
+
+	sources := make([]string, len(content.Locations))
+	missing := make([]int, 0)
+	exclude := map[string]bool{}
+	for i, addr := range content.Locations {
+		dp, ok := registered[addr]
+		if ok && dp.alive() && objectExistsAt(addr, streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i))) {
+			sources[i] = addr
+			exclude[dp.id] = true
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return
+	}
+	if len(missing) > content.ParityShards {
+		log.Printf("Repairer found %d of %d shards of content %s, need %d", len(content.Locations)-len(missing),
+			len(content.Locations), content.Hash, content.DataShards)
+		s.repairer.count(0, 1, 0)
+		return
+	}
+
+	// only the missing shards are written, to servers holding no other shard
+	targets := make([]string, len(content.Locations))
+	locations := append([]string(nil), content.Locations...)
+	copied := make([]placedObject, 0)
+	for _, i := range missing {
+		dp, err := s.selectDataProvider(exclude)
+		if err != nil {
+			log.Printf("Repairer found no data provider server for shard %d of content %s, error: %s",
+				i, content.Hash, err)
+			s.repairer.count(0, 0, 1)
+			return
+		}
+		exclude[dp.id] = true
+		targets[i] = dp.addr
+		locations[i] = dp.addr
+		copied = append(copied, placedObject{dp.addr, streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i))})
+	}
+
+	err := s.reconstructShards(content, sources, targets, throttle)
+	if err != nil {
+		log.Printf("Repairer failed to reconstruct content %s, error: %s", content.Hash, err)
+		s.repairer.count(0, 0, 1)
+		return
+	}
+
+	s.commitLocations(content, locations, copied, func() {
+		orphans := make([]metadata.Orphan, 0)
+		for _, i := range missing {
+			if dp, ok := registered[content.Locations[i]]; ok && !dp.alive() {
+				orphans = append(orphans, metadata.Orphan{Addr: dp.addr, Bucket: content.Bucket, Hash: content.Hash,
+					Path: streams.ObjectPath(content.Bucket, streams.ShardName(content.Hash, i))})
+			}
+		}
+		if len(orphans) > 0 {
+			err = s.meta.PutOrphans(orphans)
+			if err != nil {
+				log.Printf("Failed to record %d orphans of content %s, error: %s", len(orphans), content.Hash, err)
+			}
+		}
+		log.Printf("Repaired content %s, %d shards reconstructed", content.Hash, len(missing))
+	})
+	s.repairer.count(1, 0, 0)
+}
+
+// Admin API, get repairer progress
+func (s *Server) GetRepairStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.repairer == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	s.repairer.mutex.Lock()
+	status := s.repairer.status
+	s.repairer.mutex.Unlock()
+	writeJSON(w, status)
+}
+
+// Admin API, start a repair pass over all content now. Data provider servers call it after
+// they quarantine a corrupt object, with "object" query set to the object key, then only the
+// content of the object is repaired
+func (s *Server) StartRepair(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.repairer == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	scope := repairScope{all: true}
+	if key := r.URL.Query().Get("object"); key != "" {
+		scope = repairScope{contents: map[string]bool{objectContentKey(key): true}}
+	}
+	s.scheduleRepair(scope)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Returns the content key of data provider server object by key, "<bucket>/<name>" or
+// "<name>", shards are named "<hash>.<i>"
+func objectContentKey(key string) string {
+	bucket, name := "", key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		bucket, name = key[:i], key[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return contentKey(bucket, name)
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"../streams"
+)
+
+// Wait until repairer of API server on h finished passes, returns its progress
+func waitRepaired(t *testing.T, h http.Handler, passes int) RepairStatus {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var status RepairStatus
+		json.Unmarshal(serve(h, "GET", "/admin/repair", "").Body.Bytes(), &status)
+		if status.Passes >= passes && !status.Running {
+			return status
+		}
+	}
+	t.Fatalf("%d repair passes expected", passes)
+	return RepairStatus{}
+}
+
+// Start a repair pass of content in query on h and wait for it to finish, returns its progress
+func repairNow(t *testing.T, h http.Handler, query string) RepairStatus {
+	t.Helper()
+	var before RepairStatus
+	json.Unmarshal(serve(h, "GET", "/admin/repair", "").Body.Bytes(), &before)
+	if w := serve(h, "POST", "/admin/repair"+query, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("starting repair returned %d", w.Code)
+	}
+	return waitRepaired(t, h, before.Passes+1)
+}
+
+// Remove object name from storage of data provider server at addr
+func loseObject(t *testing.T, addr string, name string) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(dataStorages[addr], "objects", name)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairRestoresLostReplica(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta, Replicas: 2,
+		RepairRate: 1 << 20})
+	h := apiRouter(s)
+	put(h, "/objects/obj", "content")
+	put(h, "/objects/intact", "intact content")
+
+	hash := hashOf("content")
+	rec, _ := meta.Get("", "obj")
+	loseObject(t, rec.Locations[0], hash)
+
+	status := repairNow(t, h, "")
+	if status.Total != 2 || status.Checked != 2 || status.Degraded != 1 || status.Repaired != 1 || status.Failed != 0 {
+		t.Errorf("repair status is %+v", status)
+	}
+	rec, _ = meta.Get("", "obj")
+	held := holders(s, addrs, hash)
+	recorded := append([]string(nil), rec.Locations...)
+	sort.Strings(held)
+	sort.Strings(recorded)
+	if len(held) != 2 || !equalStrings(held, recorded) {
+		t.Errorf("content held by %v, recorded at %v", held, rec.Locations)
+	}
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "content" {
+		t.Errorf("GET is %q", w.Body.String())
+	}
+
+	// content fully replicated, another pass changes nothing
+	if status := repairNow(t, h, ""); status.Degraded != 0 {
+		t.Errorf("second repair status is %+v", status)
+	}
+}
+
+func TestRepairReconstructsLostShard(t *testing.T) {
+	addrs := startDataServers(t, 4, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta,
+		DataShards: 2, ParityShards: 1, RepairRate: 1 << 20})
+	h := apiRouter(s)
+	put(h, "/objects/obj", "erasure coded content")
+
+	hash := hashOf("erasure coded content")
+	rec, _ := meta.Get("", "obj")
+	loseObject(t, rec.Locations[1], streams.ShardName(hash, 1))
+
+	if status := repairNow(t, h, ""); status.Repaired != 1 || status.Failed != 0 {
+		t.Errorf("repair status is %+v", status)
+	}
+	rec, _ = meta.Get("", "obj")
+	for i, addr := range rec.Locations {
+		if !s.isObjectExistsAt(addr, "/objects/"+streams.ShardName(hash, i)) {
+			t.Errorf("shard %d missing from %s", i, addr)
+		}
+	}
+	if len(dedupAddrs(rec.Locations)) != 3 {
+		t.Errorf("shards located at %v", rec.Locations)
+	}
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "erasure coded content" {
+		t.Errorf("GET is %q", w.Body.String())
+	}
+}
+
+func TestRepairChecksContentOfServerDown(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta, RepairRate: 1 << 20})
+	h := apiRouter(s)
+	putObjects(t, h, 10)
+
+	onServer := 0
+	for i := 0; i < 10; i++ {
+		if rec, _ := meta.Get("", "obj"+strconv.Itoa(i)); rec.Locations[0] == addrs[0] {
+			onServer++
+		}
+	}
+	s.scheduleRepair(addrScope(addrs[0]))
+	if status := waitRepaired(t, h, 1); status.Total != onServer || status.Checked != onServer {
+		t.Errorf("repair of %d contents on server is %+v", onServer, status)
+	}
+}
+
+func TestRepairRemovesExtraReplicasOnceServerIsBack(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs[:2], LocateMode: LocateByHTTP, Metadata: meta, Replicas: 2,
+		RepairRate: 1 << 20})
+	h := apiRouter(s)
+	nameDataProviders(t, h, addrs[:2])
+	put(h, "/objects/obj", "content")
+	register(h, "dp2", addrs[2])
+
+	// replica on the server down stays recorded, another one is made meanwhile
+	serve(h, "DELETE", "/providers/dp0", "")
+	if status := repairNow(t, h, ""); status.Repaired != 1 {
+		t.Errorf("repair status with a server down is %+v", status)
+	}
+	hash := hashOf("content")
+	if rec, _ := meta.Get("", "obj"); len(rec.Locations) != 3 || indexOf(rec.Locations, addrs[0]) < 0 {
+		t.Errorf("content located at %v with a server down", rec.Locations)
+	}
+	if held := holders(s, addrs, hash); len(held) != 3 {
+		t.Errorf("content held by %v with a server down", held)
+	}
+
+	// registering again schedules a repair of content on the server
+	register(h, "dp0", addrs[0])
+	waitRepaired(t, h, 2)
+	rec, _ := meta.Get("", "obj")
+	held := holders(s, addrs, hash)
+	if len(rec.Locations) != 2 || len(held) != 2 {
+		t.Errorf("content held by %v, recorded at %v once server is back", held, rec.Locations)
+	}
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "content" {
+		t.Errorf("GET is %q", w.Body.String())
+	}
+}
+
+func TestRepairOfCorruptObjectChecksItsContent(t *testing.T) {
+	addrs := startDataServers(t, 4, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta,
+		DataShards: 2, ParityShards: 1, RepairRate: 1 << 20})
+	h := apiRouter(s)
+	put(h, "/objects/a", "content a")
+	put(h, "/objects/b", "content b")
+
+	a, b := hashOf("content a"), hashOf("content b")
+	recA, _ := meta.Get("", "a")
+	recB, _ := meta.Get("", "b")
+	loseObject(t, recA.Locations[0], streams.ShardName(a, 0))
+	loseObject(t, recB.Locations[0], streams.ShardName(b, 0))
+
+	// data provider servers report corrupt objects by key, shards are named "<hash>.<i>"
+	status := repairNow(t, h, "?object="+streams.ShardName(a, 0))
+	if status.Total != 1 || status.Repaired != 1 {
+		t.Errorf("repair status of corrupt object is %+v", status)
+	}
+	if rec, _ := meta.Get("", "a"); !s.isObjectExistsAt(rec.Locations[0], "/objects/"+streams.ShardName(a, 0)) {
+		t.Errorf("shard of corrupt object not reconstructed")
+	}
+	if rec, _ := meta.Get("", "b"); s.isObjectExistsAt(rec.Locations[0], "/objects/"+streams.ShardName(b, 0)) {
+		t.Errorf("shard of other content reconstructed")
+	}
+}
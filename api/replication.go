@@ -0,0 +1,212 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Chunks a replica may fall behind the content read from client
+const replicaLagChunks = 64
+
+var (
+	// Returned when a replica is dropped for falling behind the others
+	errReplicaLagging = errors.New("replica lagging behind")
+
+	// How long a write waits for a replica that fell replicaLagChunks behind, before the
+	// replica is dropped, if write quorum replicas remain without it
+	replicaLagTimeout = 5 * time.Second
+)
+
+// replicaWriter tees writes to every replica, each replica is written by its own goroutine
+// through a bounded buffer, so a slow replica does not hold up the others. A replica
+// failing, or staying more than the buffer behind for replicaLagTimeout, is dropped instead
+// of failing the whole write, as long as quorum replicas remain
+type replicaWriter struct {
+	streams []*replicaStream
+	quorum  int
+}
+
+// replicaStream is a PutStream to the data provider server at addr
+type replicaStream struct {
+	*streams.PutStream
+	addr string
+
+	// Chunks not written yet, closed once all content is buffered
+	chunks chan []byte
+
+	// Closed when the replica stops writing, err is the write error it stopped on, if any
+	done chan struct{}
+	err  error
+
+	// The replica failed or was dropped, and is aborted
+	failed bool
+}
+
+// Create replicaStream of object at path on data provider server at addr, hash is sent
+// for verification
+func newReplicaStream(addr string, path string, hash string) *replicaStream {
+	ps := &replicaStream{
+		PutStream: streams.NewPutStream(addr+path, hash),
+		addr:      addr,
+		chunks:    make(chan []byte, replicaLagChunks),
+		done:      make(chan struct{}),
+	}
+
+	go ps.run()
+	return ps
+}
+
+// Write buffered chunks to the data provider server until all are written or a write fails
+func (ps *replicaStream) run() {
+	defer close(ps.done)
+	for chunk := range ps.chunks {
+		_, err := ps.Write(chunk)
+		if err != nil {
+			ps.err = err
+			return
+		}
+	}
+}
+
+// Returns the number of replicas still written
+func (rw *replicaWriter) alive() int {
+	alive := 0
+	for _, ps := range rw.streams {
+		if !ps.failed {
+			alive++
+		}
+	}
+	return alive
+}
+
+// Stop writing replica ps and abort it, so its data server won't keep a partial object
+func (rw *replicaWriter) drop(ps *replicaStream, err error) {
+	log.Printf("Failed to write replica to %s, error: %s", ps.addr, err)
+	ps.failed = true
+	close(ps.chunks)
+	ps.Abort()
+}
+
+// Implements the Write method, a write waits for replicas whose buffer is full, those
+// still full after replicaLagTimeout are dropped if enough replicas remain
+func (rw *replicaWriter) Write(data []byte) (int, error) {
+	chunk := append([]byte(nil), data...)
+	for _, ps := range rw.streams {
+		if ps.failed {
+			continue
+		}
+
+		timer := time.NewTimer(replicaLagTimeout)
+		select {
+		case ps.chunks <- chunk:
+		case <-ps.done:
+			rw.drop(ps, ps.err)
+		case <-timer.C:
+			if rw.alive() > rw.quorum {
+				rw.drop(ps, errReplicaLagging)
+				break
+			}
+
+			// the replica is needed for quorum, it fails by putTimeout if it is hung
+			select {
+			case ps.chunks <- chunk:
+			case <-ps.done:
+				rw.drop(ps, ps.err)
+			}
+		}
+		timer.Stop()
+	}
+
+	if alive := rw.alive(); alive < rw.quorum {
+		return 0, fmt.Errorf("only %d replicas writable, write quorum is %d", alive, rw.quorum)
+	}
+	return len(data), nil
+}
+
+// Finish every replica still written, returns the addresses of data provider servers
+// that acknowledged their replica
+func (rw *replicaWriter) close() []string {
+	for _, ps := range rw.streams {
+		if !ps.failed {
+			close(ps.chunks)
+		}
+	}
+
+	locations := make([]string, 0, len(rw.streams))
+	for _, ps := range rw.streams {
+		if ps.failed {
+			continue
+		}
+
+		<-ps.done
+		if ps.err != nil {
+			ps.failed = true
+			ps.Abort()
+			log.Printf("Failed to write replica to %s, error: %s", ps.addr, ps.err)
+			continue
+		}
+
+		err := ps.Close()
+		if err != nil {
+			log.Printf("Failed to put replica to %s, error: %s", ps.addr, err)
+			continue
+		}
+		locations = append(locations, ps.addr)
+	}
+	return locations
+}
+
+// Abort every replica still written
+func (rw *replicaWriter) abort() {
+	for _, ps := range rw.streams {
+		if !ps.failed {
+			ps.failed = true
+			close(ps.chunks)
+			ps.Abort()
+		}
+	}
+}
+
+// Write content read from body to replicas distinct data provider servers at the same time,
+// the write succeeds if at least writeQuorum of them acknowledge, content.Locations are set
+// to the data provider servers that acknowledged
+func (s *Server) storeReplicated(content *metadata.Content, body io.Reader) error {
+	dps := s.selectDataProvidersFor(content.Hash, s.replicas)
+	if len(dps) < s.writeQuorum {
+		log.Printf("Need %d data servers for write quorum, only %d available", s.writeQuorum, len(dps))
+		return errNoDataProvider
+	}
+
+	rw := &replicaWriter{quorum: s.writeQuorum}
+	for _, dp := range dps {
+		rw.streams = append(rw.streams, newReplicaStream(dp.addr, streams.ObjectPath(content.Bucket, content.Hash), content.Hash))
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(rw, io.TeeReader(body, h))
+	if actual := hex.EncodeToString(h.Sum(nil)); err == nil && actual != content.Hash {
+		log.Printf("Content hash mismatch, expected %s, actual %s", content.Hash, actual)
+		err = errHashMismatch
+	}
+	if err != nil {
+		// data servers verify content against hash, abort anyway to save them the work
+		rw.abort()
+		return err
+	}
+
+	locations := rw.close()
+	if len(locations) < s.writeQuorum {
+		return fmt.Errorf("only %d replicas written, write quorum is %d", len(locations), s.writeQuorum)
+	}
+
+	content.Size = size
+	content.Locations = locations
+	return nil
+}
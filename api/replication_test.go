@@ -0,0 +1,115 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a data provider server that never reads what is PUT to it until the test ends,
+// returns its address
+func startHungDataServer(t *testing.T) string {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestPutObjectReplicates(t *testing.T) {
+	addrs := startDataServers(t, 4, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta, Replicas: 3})
+	h := apiRouter(s)
+
+	if w := put(h, "/objects/obj", "replicated content"); w.Code != http.StatusOK {
+		t.Fatalf("PUT is %d", w.Code)
+	}
+
+	rec, err := meta.Get("", "obj")
+	if err != nil || len(rec.Locations) != 3 {
+		t.Fatalf("record is %v, error: %v", rec, err)
+	}
+	held := holders(s, addrs, rec.Hash)
+	if strings.Join(held, ",") != strings.Join(sorted(rec.Locations, addrs), ",") {
+		t.Errorf("content held by %v, placed at %v", held, rec.Locations)
+	}
+}
+
+// Returns locations in the order of addrs
+func sorted(locations []string, addrs []string) []string {
+	placed := map[string]bool{}
+	for _, addr := range locations {
+		placed[addr] = true
+	}
+	result := make([]string, 0, len(locations))
+	for _, addr := range addrs {
+		if placed[addr] {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+func TestPutObjectWriteQuorum(t *testing.T) {
+	for _, tc := range []struct {
+		up     int
+		down   int
+		quorum int
+		status int
+	}{
+		{3, 0, 3, http.StatusOK},
+		{2, 1, 2, http.StatusOK},
+		{2, 1, 3, http.StatusInternalServerError},
+		{1, 2, 2, http.StatusInternalServerError},
+		{1, 0, 2, http.StatusServiceUnavailable},
+	} {
+		dps := startDataServers(t, tc.up, nil)
+		for i := 0; i < tc.down; i++ {
+			dps = append(dps, "127.0.0.1:1")
+		}
+		meta := newTestMetadata(t)
+		s := NewServer(Config{DataProviders: dps, LocateMode: LocateByHTTP, Metadata: meta,
+			Replicas: 3, WriteQuorum: tc.quorum})
+
+		w := put(apiRouter(s), "/objects/obj", "content")
+		if w.Code != tc.status {
+			t.Errorf("PUT with %d of %d data servers up and quorum %d is %d, want %d",
+				tc.up, tc.up+tc.down, tc.quorum, w.Code, tc.status)
+		}
+
+		rec, err := meta.Get("", "obj")
+		if tc.status == http.StatusOK && (err != nil || len(rec.Locations) != tc.up) {
+			t.Errorf("record is %v, error: %v", rec, err)
+		}
+		if tc.status != http.StatusOK && err == nil {
+			t.Errorf("record %v saved for failed PUT", rec)
+		}
+	}
+}
+
+func TestPutObjectDropsLaggingReplica(t *testing.T) {
+	timeout := replicaLagTimeout
+	replicaLagTimeout = 100 * time.Millisecond
+	defer func() { replicaLagTimeout = timeout }()
+
+	dps := append(startDataServers(t, 2, nil), startHungDataServer(t))
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: dps, LocateMode: LocateByHTTP, Metadata: meta,
+		Replicas: 3, WriteQuorum: 2})
+
+	// more than the replica buffer and the connection to the hung server take
+	content := strings.Repeat("x", 32<<20)
+	if w := put(apiRouter(s), "/objects/obj", content); w.Code != http.StatusOK {
+		t.Fatalf("PUT is %d", w.Code)
+	}
+
+	rec, err := meta.Get("", "obj")
+	if err != nil || strings.Join(sorted(rec.Locations, dps), ",") != strings.Join(dps[:2], ",") {
+		t.Errorf("record is placed at %v, error: %v", rec.Locations, err)
+	}
+}
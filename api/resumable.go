@@ -0,0 +1,410 @@
+package api
+
+import (
+	"../metadata"
+	"../streams"
+	"../util"
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	uuid2 "github.com/satori/go.uuid"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often sessions are checked for expiry
+const sessionSweepInterval = 10 * time.Minute
+
+// Returned when a chunk holds more bytes than remain to the total size of session
+var errChunkTooLarge = errors.New("chunk beyond upload length")
+
+// Resumable upload sessions are kept in the metadata store, chunks are appended to a staging
+// file on one data provider server, which tracks the committed offset. When all bytes are
+// received the staging file is stored like any other content
+
+// Get session by ID, writes the response status if it is not found or the store fails
+func (s *Server) getSession(w http.ResponseWriter, id string) (metadata.Session, bool) {
+	sess, err := s.meta.GetSession(id)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return sess, false
+	} else if err != nil {
+		log.Printf("Unable to get session %s, error: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return sess, false
+	}
+	return sess, true
+}
+
+// Abort sessions created longer than expiry ago, each sessionSweepInterval
+func (s *Server) expireSessions(expiry time.Duration) {
+	for {
+		time.Sleep(sessionSweepInterval)
+		s.expireSessionsBefore(time.Now().Add(-expiry))
+	}
+}
+
+// Abort sessions created before deadline
+func (s *Server) expireSessionsBefore(deadline time.Time) {
+	sessions, err := s.meta.Sessions()
+	if err != nil {
+		log.Printf("Unable to list sessions, error: %s", err)
+		return
+	}
+
+	for _, sess := range sessions {
+		if !sess.Created.Before(deadline) {
+			continue
+		}
+
+		_, err = s.meta.DeleteSession(sess.Id)
+		if err != nil {
+			// finished or aborted meanwhile
+			continue
+		}
+		deleteStaging(sess)
+		log.Printf("Expired upload session %s of object %s, created at %s", sess.Id, sess.Name, sess.Created)
+	}
+}
+
+// Send a request on staging file of session to its data provider server,
+// offset is sent in "Upload-Offset" header if not negative
+func stagingRequest(method string, sess metadata.Session, body io.Reader, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+sess.Addr+"/staging/"+sess.Id, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset >= 0 {
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+// Get the committed offset of session from its data provider server
+func stagingOffset(sess metadata.Session) (int64, error) {
+	resp, err := stagingRequest("HEAD", sess, nil, -1)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("data server returned status code %d", resp.StatusCode)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// Delete the staging file of session
+func deleteStaging(sess metadata.Session) {
+	resp, err := stagingRequest("DELETE", sess, nil, -1)
+	if err != nil {
+		log.Printf("Failed to delete staging file %s at %s, error: %s", sess.Id, sess.Addr, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// Create a resumable upload session of object, "POST /resumable?name=<object name>&bucket=<bucket>",
+// bucket is optional, the total size of object must be sent in "Upload-Length" header.
+// The session URL is returned in "Location" header
+func (s *Server) CreateSession(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	name := r.URL.Query().Get("name")
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if name == "" || err != nil || length < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	if !s.isBucket(w, bucket) {
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	dp, err := s.selectDataProvider(nil)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	sess := metadata.Session{
+		Id:          uuid2.Must(uuid2.NewV4()).String(),
+		Bucket:      bucket,
+		Name:        name,
+		ContentType: contentType,
+		Length:      length,
+		Addr:        dp.addr,
+		Created:     time.Now().UTC(),
+	}
+
+	resp, err := stagingRequest("POST", sess, nil, -1)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			err = fmt.Errorf("data server returned status code %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to create staging file at %s, error: %s", dp.addr, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	err = s.meta.CreateSession(sess)
+	if err != nil {
+		log.Printf("Failed to save session of object %s, error: %s", name, err)
+		deleteStaging(sess)
+		if err == metadata.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("Created upload session %s of object %s, %d bytes, staged at %s", sess.Id, name, length, dp.addr)
+	w.Header().Set("Location", "/resumable/"+sess.Id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Get the committed offset of session, "HEAD /resumable/:id", returned in "Upload-Offset"
+// header with the total size in "Upload-Length" header, a client resumes from there
+func (s *Server) HeadSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	sess, ok := s.getSession(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+
+	offset, err := stagingOffset(sess)
+	if err != nil {
+		log.Printf("Failed to get offset of session %s, error: %s", sess.Id, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(sess.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// Append a chunk to session, "PATCH /resumable/:id", the "Upload-Offset" header must equal
+// the committed offset, otherwise 409 is returned. A chunk going beyond the total size is
+// rejected with 400. The new committed offset is returned in "Upload-Offset" header, also
+// when the chunk is interrupted or rejected after part of it was appended
+func (s *Server) PatchSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	sess, ok := s.getSession(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 || offset > sess.Length {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// bytes beyond the total size are never written
+	remaining := sess.Length - offset
+	if r.ContentLength > remaining {
+		log.Printf("Chunk of session %s at offset %d goes beyond length %d", sess.Id, offset, sess.Length)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	chunk := &chunkReader{r: bufio.NewReader(r.Body), remaining: remaining}
+	resp, err := stagingRequest("PATCH", sess, chunk, offset)
+	if chunk.err == errChunkTooLarge {
+		if err == nil {
+			resp.Body.Close()
+		}
+		log.Printf("Chunk of session %s at offset %d goes beyond length %d", sess.Id, offset, sess.Length)
+		if committed, err := stagingOffset(sess); err == nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(committed, 10))
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to append to session %s, error: %s", sess.Id, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	resp.Body.Close()
+
+	if committed := resp.Header.Get("Upload-Offset"); committed != "" {
+		w.Header().Set("Upload-Offset", committed)
+	}
+	w.WriteHeader(resp.StatusCode)
+}
+
+// chunkReader reads a chunk of unknown length up to the bytes remaining to the total size of
+// session, and fails with errChunkTooLarge if the chunk holds more. The read reaching the
+// total size is held back until the end of the chunk is seen, so an oversized chunk never
+// fills the session as if it fitted
+type chunkReader struct {
+	r         *bufio.Reader
+	remaining int64
+
+	// errChunkTooLarge once the chunk is found too large, or the read error
+	err error
+}
+
+// Implements the Read method
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	if cr.remaining == 0 {
+		cr.err = cr.end()
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if cr.remaining == 0 && err == nil {
+		cr.err = cr.end()
+		if cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	return n, err
+}
+
+// Check that the chunk ends, returns errChunkTooLarge if more bytes follow
+func (cr *chunkReader) end() error {
+	_, err := cr.r.Peek(1)
+	if err == nil {
+		return errChunkTooLarge
+	} else if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Finish session, "POST /resumable/:id", the SHA-256 hash of object must be sent in
+// "Digest" header like PutObject. The session is claimed, so it only finishes once, then the
+// staged content is stored and saved as a new version of object, and the staging file is
+// deleted. The session is given back if storing fails, so the client may retry
+func (s *Server) FinishSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	sess, ok := s.getSession(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+
+	hash := util.GetHashFromHeader(r.Header)
+	if hash == "" {
+		log.Printf("Missing or malformed Digest header of session %s", sess.Id)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	offset, err := stagingOffset(sess)
+	if err != nil {
+		log.Printf("Failed to get offset of session %s, error: %s", sess.Id, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if offset != sess.Length {
+		log.Printf("Session %s is incomplete, %d of %d bytes", sess.Id, offset, sess.Length)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// a session may only finish once
+	_, err = s.meta.DeleteSession(sess.Id)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to claim session %s, error: %s", sess.Id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rec, status := s.finishSession(sess, hash)
+	if status != http.StatusOK {
+		err = s.meta.CreateSession(sess)
+		if err != nil {
+			log.Printf("Failed to give back session %s, error: %s", sess.Id, err)
+			deleteStaging(sess)
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	deleteStaging(sess)
+	w.Header().Set(versionIdHeader, versionId(rec))
+	log.Printf("Finished upload session %s, object %s version %d saved, hash %s", sess.Id, sess.Name, rec.Version, hash)
+}
+
+// Store the staged content of claimed session and save it as a new version of object,
+// returns the saved record and the response status
+func (s *Server) finishSession(sess metadata.Session, hash string) (metadata.Record, int) {
+	stream, err := streams.NewGetStream(sess.Addr + "/staging/" + sess.Id)
+	if err != nil {
+		log.Printf("Failed to read staging file of session %s, error: %s", sess.Id, err)
+		return metadata.Record{}, http.StatusServiceUnavailable
+	}
+	defer stream.Close()
+
+	s.lockContent(sess.Bucket, hash)
+	content, err := s.putContent(sess.Bucket, hash, stream)
+	if err != nil {
+		s.unlockContent(sess.Bucket, hash)
+		log.Printf("Failed to put object %s of session %s, error: %s", sess.Name, sess.Id, err)
+		return metadata.Record{}, putContentErrorStatus(err)
+	}
+
+	rec := metadata.Record{
+		Name:        sess.Name,
+		Content:     content,
+		ContentType: sess.ContentType,
+	}
+	rec, err = s.meta.PutVersion(rec)
+	s.unlockContent(sess.Bucket, hash)
+	if err != nil {
+		log.Printf("Failed to save metadata of object %s, error: %s", sess.Name, err)
+		// the content is stored again from staging file when the client retries
+		s.deleteUnreferenced([]metadata.Content{content})
+		if err == metadata.ErrNotFound {
+			// the bucket was deleted meanwhile
+			return metadata.Record{}, http.StatusNotFound
+		}
+		return metadata.Record{}, http.StatusInternalServerError
+	}
+	return rec, http.StatusOK
+}
+
+// Abort session, "DELETE /resumable/:id", the staging file is deleted
+func (s *Server) AbortSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	sess, err := s.meta.DeleteSession(p.ByName("id"))
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to remove session %s, error: %s", p.ByName("id"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	deleteStaging(sess)
+	log.Printf("Aborted upload session %s of object %s", sess.Id, sess.Name)
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"../metadata"
+	"../util"
+)
+
+// Create a session of object name with total size length on h, returns the session path
+func createSession(t *testing.T, h http.Handler, name string, length int) string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/resumable?name="+name, nil)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") == "" {
+		t.Fatalf("creating session returned %d", w.Code)
+	}
+	return w.Header().Get("Location")
+}
+
+// Append chunk read from body to session path on h at offset, returns the recorded response
+func patchSession(h http.Handler, path string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("PATCH", path, body)
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Finish session path on h with the "Digest" header of content, returns the recorded response
+func finishSession(h http.Handler, path string, content string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, nil)
+	r.Header.Set("Digest", util.DigestHeader(hashOf(content)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+
+	path := createSession(t, h, "obj", 11)
+	if w := patchSession(h, path, 0, strings.NewReader("hello ")); w.Code != http.StatusNoContent ||
+		w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("PATCH is %d at offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// a chunk at a stale offset is refused with the committed one
+	w := patchSession(h, path, 0, strings.NewReader("hello "))
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("PATCH at stale offset is %d at offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	w = serve(h, "HEAD", path, "")
+	if w.Header().Get("Upload-Offset") != "6" || w.Header().Get("Upload-Length") != "11" {
+		t.Errorf("HEAD headers are %v", w.Header())
+	}
+
+	if w := finishSession(h, path, "hello"); w.Code != http.StatusConflict {
+		t.Errorf("finishing incomplete session returned %d", w.Code)
+	}
+
+	patchSession(h, path, 6, strings.NewReader("world"))
+	if w := finishSession(h, path, "hello wrong"); w.Code != http.StatusBadRequest {
+		t.Errorf("finishing with wrong digest returned %d", w.Code)
+	}
+	if w := finishSession(h, path, "hello world"); w.Code != http.StatusOK {
+		t.Fatalf("finishing returned %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "hello world" {
+		t.Errorf("GET of finished object is %q", w.Body.String())
+	}
+
+	// a session only finishes once
+	if w := finishSession(h, path, "hello world"); w.Code != http.StatusNotFound {
+		t.Errorf("finishing twice returned %d", w.Code)
+	}
+	if rec, _ := s.meta.Get("", "obj"); rec.Version != 1 {
+		t.Errorf("object version is %d", rec.Version)
+	}
+}
+
+func TestPatchSessionRejectsOversizedChunk(t *testing.T) {
+	s := NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+	path := createSession(t, h, "obj", 5)
+
+	if w := patchSession(h, path, 0, strings.NewReader("too long")); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH of oversized chunk is %d", w.Code)
+	}
+
+	// the length of a chunked body is only known at its end
+	w := patchSession(h, path, 0, ioutil.NopCloser(strings.NewReader("too long")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH of oversized chunked body is %d", w.Code)
+	}
+	if offset := w.Header().Get("Upload-Offset"); offset == "5" {
+		t.Errorf("oversized chunk filled the session")
+	}
+
+	// the data server may still be busy with the rejected chunk, resume like a client would
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		offset, _ := strconv.Atoi(serve(h, "HEAD", path, "").Header().Get("Upload-Offset"))
+		if w := patchSession(h, path, offset, strings.NewReader("fits!"[offset:])); w.Code == http.StatusNoContent {
+			break
+		}
+	}
+	if w := finishSession(h, path, "fits!"); w.Code != http.StatusOK {
+		t.Errorf("finishing after oversized chunk returned %d", w.Code)
+	}
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	root := t.TempDir()
+	meta, err := metadata.NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := apiRouter(NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta}))
+	path := createSession(t, h, "obj", 14)
+	patchSession(h, path, 0, strings.NewReader("before, "))
+
+	meta, err = metadata.NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = apiRouter(NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta}))
+	if w := patchSession(h, path, 8, strings.NewReader("after!")); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH after restart is %d", w.Code)
+	}
+	if w := finishSession(h, path, "before, after!"); w.Code != http.StatusOK {
+		t.Fatalf("finishing after restart returned %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "before, after!" {
+		t.Errorf("GET of finished object is %q", w.Body.String())
+	}
+}
+
+func TestAbortAndExpireSessions(t *testing.T) {
+	s := NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+
+	aborted := createSession(t, h, "aborted", 4)
+	patchSession(h, aborted, 0, strings.NewReader("some"))
+	if w := serve(h, "DELETE", aborted, ""); w.Code != http.StatusOK {
+		t.Fatalf("aborting returned %d", w.Code)
+	}
+	if w := serve(h, "DELETE", aborted, ""); w.Code != http.StatusNotFound {
+		t.Errorf("aborting twice returned %d", w.Code)
+	}
+	if w := finishSession(h, aborted, "some"); w.Code != http.StatusNotFound {
+		t.Errorf("finishing aborted session returned %d", w.Code)
+	}
+
+	stale := createSession(t, h, "stale", 4)
+	time.Sleep(10 * time.Millisecond)
+	deadline := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	fresh := createSession(t, h, "fresh", 4)
+
+	s.expireSessionsBefore(deadline)
+	if w := serve(h, "HEAD", stale, ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of expired session is %d", w.Code)
+	}
+	if w := serve(h, "HEAD", fresh, ""); w.Code != http.StatusOK {
+		t.Errorf("HEAD of fresh session is %d", w.Code)
+	}
+}
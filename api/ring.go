@@ -0,0 +1,134 @@
+package api
+
+import (
+	"../metadata"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// hashRing is a consistent hash ring of data provider servers, each of them owns
+// virtual nodes at pseudo random points of the ring. A key belongs to the servers owning
+// the first points after the hash of key, so adding or removing a server only moves
+// the keys of its own points
+type hashRing struct {
+	points []ringPoint
+}
+
+// ringPoint is a virtual node of data provider server by id
+type ringPoint struct {
+	hash uint64
+	id   string
+}
+
+// Returns the position of s on ring
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Create hashRing of data provider servers by ids, each with vnodes virtual nodes
+func newHashRing(ids []string, vnodes int) *hashRing {
+	r := &hashRing{points: make([]ringPoint, 0, len(ids)*vnodes)}
+	for _, id := range ids {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{ringHash(id + "#" + strconv.Itoa(i)), id})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// Returns up to n distinct ids of data provider servers owning key in ring order,
+// servers for which accept returns false are skipped
+func (r *hashRing) owners(key string, n int, accept func(id string) bool) []string {
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	ids := make([]string, 0, n)
+	seen := map[string]bool{}
+	for i := 0; i < len(r.points) && len(ids) < n; i++ {
+		id := r.points[(start+i)%len(r.points)].id
+		if seen[id] {
+			continue
+		}
+
+		seen[id] = true
+		if accept(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Rebuild ring from data provider servers, must be called with mutex held whenever
+// they are added or removed
+func (s *Server) rebuildRing() {
+	if s.ringVirtualNodes <= 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(s.dp))
+	for id := range s.dp {
+		ids = append(ids, id)
+	}
+	s.ring = newHashRing(ids, s.ringVirtualNodes)
+}
+
+// Returns up to n distinct data provider servers owning content by hash on ring, servers
+// for which accept returns false are skipped. Returns nil if ring is not used
+func (s *Server) ringOwners(hash string, n int, accept func(dp DataProvider) bool) []DataProvider {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ring == nil {
+		return nil
+	}
+
+	ids := s.ring.owners(hash, n, func(id string) bool {
+		return accept(s.dp[id])
+	})
+
+	dps := make([]DataProvider, len(ids))
+	for i, id := range ids {
+		dps[i] = s.dp[id]
+	}
+	return dps
+}
+
+// Select n distinct DataProviders to store content by hash, owners of content on ring if
+// ring is used, by placement policy otherwise
+func (s *Server) selectDataProvidersFor(hash string, n int) []DataProvider {
+	if s.ringVirtualNodes > 0 {
+		return s.ringOwners(hash, n, func(dp DataProvider) bool {
+			return dp.alive() && dp.hasRoom() && dp.status == RUNNING
+		})
+	}
+	return s.selectDataProviders(n)
+}
+
+// Returns the addresses content by hash is read from, the owners of content on ring if
+// ring is used, then the recorded locations, which differ if servers joined or left
+// since content was written
+func (s *Server) replicaAddrs(content metadata.Content) []string {
+	addrs := make([]string, 0, s.replicas+len(content.Locations))
+	seen := map[string]bool{}
+	for _, dp := range s.ringOwners(content.Hash, s.replicas, DataProvider.alive) {
+		addrs = append(addrs, dp.addr)
+		seen[dp.addr] = true
+	}
+
+	for _, addr := range content.Locations {
+		if !seen[addr] {
+			addrs = append(addrs, addr)
+			seen[addr] = true
+		}
+	}
+	return addrs
+}
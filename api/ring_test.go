@@ -0,0 +1,134 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"testing"
+
+	"../bus"
+	"../metadata"
+)
+
+// Returns ids "dp0" to "dp<n-1>"
+func testIds(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = "dp" + strconv.Itoa(i)
+	}
+	return ids
+}
+
+// Accepts every id
+func acceptAll(id string) bool {
+	return true
+}
+
+func TestHashRingOwnersAreDistinctAndStable(t *testing.T) {
+	r := newHashRing(testIds(5), 16)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		owners := r.owners(key, 3, acceptAll)
+		if len(owners) != 3 {
+			t.Fatalf("%d owners of %s, want 3", len(owners), key)
+		}
+
+		seen := map[string]bool{}
+		for _, id := range owners {
+			if seen[id] {
+				t.Errorf("owners of %s repeat %s: %v", key, id, owners)
+			}
+			seen[id] = true
+		}
+
+		// a ring built from the same servers in another order agrees
+		again := newHashRing([]string{"dp4", "dp3", "dp2", "dp1", "dp0"}, 16).owners(key, 3, acceptAll)
+		for j := range owners {
+			if owners[j] != again[j] {
+				t.Errorf("owners of %s are %v then %v", key, owners, again)
+				break
+			}
+		}
+	}
+
+	if owners := r.owners("key", 10, acceptAll); len(owners) != 5 {
+		t.Errorf("%d owners out of 5 servers", len(owners))
+	}
+	if owners := newHashRing(nil, 16).owners("key", 3, acceptAll); len(owners) != 0 {
+		t.Errorf("owners %v on empty ring", owners)
+	}
+}
+
+func TestHashRingOwnersSkipsRejected(t *testing.T) {
+	r := newHashRing(testIds(5), 16)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		all := r.owners(key, 5, acceptAll)
+		owners := r.owners(key, 2, func(id string) bool {
+			return id != all[0]
+		})
+
+		// the rejected server is replaced by the next one on ring
+		if len(owners) != 2 || owners[0] != all[1] || owners[1] != all[2] {
+			t.Errorf("owners of %s are %v without %s, all are %v", key, owners, all[0], all)
+		}
+	}
+}
+
+func TestHashRingRemovingServerOnlyMovesItsKeys(t *testing.T) {
+	before := newHashRing(testIds(5), 64)
+	after := newHashRing(testIds(4), 64)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		owner := before.owners(key, 1, acceptAll)[0]
+		if owner == "dp4" {
+			moved++
+			continue
+		}
+		if now := after.owners(key, 1, acceptAll)[0]; now != owner {
+			t.Errorf("key %s moved from %s to %s", key, owner, now)
+		}
+	}
+
+	if moved < 100 || moved > 300 {
+		t.Errorf("%d keys of 1000 owned by one of 5 servers", moved)
+	}
+}
+
+func TestRingPlacesContentOnOwnersAndReadsDirectly(t *testing.T) {
+	addrs := startDataServers(t, 4, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateBus: bus.NewMemoryBus(), Metadata: meta,
+		Replicas: 2, RingVirtualNodes: 16})
+	h := apiRouter(s)
+
+	for i := 0; i < 10; i++ {
+		name, content := "obj"+strconv.Itoa(i), "content "+strconv.Itoa(i)
+		if w := put(h, "/objects/"+name, content); w.Code != http.StatusOK {
+			t.Fatalf("PUT of %s is %d", name, w.Code)
+		}
+
+		owners := make([]string, 0)
+		for _, dp := range s.ringOwners(hashOf(content), 2, DataProvider.alive) {
+			owners = append(owners, dp.addr)
+		}
+		held := holders(s, addrs, hashOf(content))
+		sort.Strings(owners)
+		sort.Strings(held)
+		if len(held) != 2 || held[0] != owners[0] || held[1] != owners[1] {
+			t.Errorf("%s held by %v, owners are %v", name, held, owners)
+		}
+
+		// without recorded locations content is read from its owners, no data provider
+		// server answers location queries
+		_, err := meta.PutVersion(metadata.Record{Name: name,
+			Content: metadata.Content{Size: int64(len(content)), Hash: hashOf(content)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := serve(h, "GET", "/objects/"+name, ""); w.Body.String() != content {
+			t.Errorf("GET of %s is %q", name, w.Body.String())
+		}
+	}
+}
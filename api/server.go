@@ -1,16 +1,15 @@
 package api
 
 import (
-	"../sqs"
-	"../streams"
+	"../bus"
+	"../metadata"
+	"../util"
 	"encoding/json"
-	"errors"
 	"github.com/julienschmidt/httprouter"
 	uuid2 "github.com/satori/go.uuid"
-	"io"
 	"log"
-	"math/rand"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -21,8 +20,35 @@ const (
 	PENDING Status = iota
 	RUNNING
 	STOPPING
+
+	// Data provider servers drained of all content
+	DECOMMISSIONED
 )
 
+func (st Status) String() string {
+	switch st {
+	case PENDING:
+		return "pending"
+	case RUNNING:
+		return "running"
+	case STOPPING:
+		return "stopping"
+	case DECOMMISSIONED:
+		return "decommissioned"
+	}
+	return "unknown"
+}
+
+// Returns the status by name, PENDING if unknown
+func parseStatus(name string) Status {
+	for _, st := range []Status{RUNNING, STOPPING, DECOMMISSIONED} {
+		if st.String() == name {
+			return st
+		}
+	}
+	return PENDING
+}
+
 // API server struct holds the API server information
 type Server struct {
 	// API server version
@@ -31,8 +57,57 @@ type Server struct {
 	// API server status
 	status Status
 
-	// SQS
-	sqs sqs.SQS
+	// Bus carrying object location queries and replies
+	locateBus bus.LocateBus
+
+	// How objects are located, LocateByBus or LocateByHTTP
+	locateMode string
+
+	// Object metadata store
+	meta metadata.Store
+
+	// Number of data and parity shards of erasure coded objects
+	dataShards   int
+	parityShards int
+
+	// Number of copies of objects not erasure coded, and write quorum of them
+	replicas    int
+	writeQuorum int
+
+	// Locks of contents being stored or deleted, by bucket and hash
+	contentLocks map[string]*contentLock
+
+	// mutex on contentLocks
+	contentLocksMutex sync.Mutex
+
+	// Location requests waiting for a reply, by request uid
+	pending map[string]chan string
+
+	// mutex on pending
+	pendingMutex sync.Mutex
+
+	// Selects data provider servers for new objects
+	placement PlacementPolicy
+
+	// Consistent hash ring of data provider servers, and virtual nodes of each server,
+	// nil if not used
+	ring             *hashRing
+	ringVirtualNodes int
+
+	// Moves content after data provider servers join or leave, nil if disabled
+	rebalancer *rebalancer
+
+	// Restores content below its replication or erasure coding target, nil if disabled
+	repairer *repairer
+
+	// Data provider servers being drained or drained, by id
+	drains map[string]*drain
+
+	// mutex on drains
+	drainsMutex sync.Mutex
+
+	// Bytes per second copied when moving content between data provider servers
+	copyRate int64
 
 	// Data provider serve details
 	dp map[string]DataProvider
@@ -50,36 +125,166 @@ type DataProvider struct {
 	// Data provider server address
 	addr string
 
-	// Last pinged
+	// RUNNING, or STOPPING while drained and DECOMMISSIONED after, new content is only
+	// placed on RUNNING servers
+	status Status
+
+	// Last pinged, unix time of the last heartbeat answered
 	lastPing int64
+
+	// Heartbeats missed in a row, the server is down after maxMissedHeartbeats
+	missed int
+
+	// Free space and load reported by the last heartbeat
+	freeBytes   uint64
+	totalInodes uint64
+	freeInodes  uint64
+	requests    int64
+
+	// Objects, replicas and shards placed on the server since the last heartbeat, they
+	// add to its load until the next heartbeat samples it
+	placed int64
+}
+
+// Config holds the settings API server is created with
+type Config struct {
+	// Data provider server addresses
+	DataProviders []string
+
+	// Bus carrying object location queries and replies
+	LocateBus bus.LocateBus
+
+	// How objects are located, LocateByBus or LocateByHTTP
+	LocateMode string
+
+	// Object metadata store
+	Metadata metadata.Store
+
+	// Number of data and parity shards of erasure coded objects, objects are not
+	// erasure coded if DataShards is 0
+	DataShards   int
+	ParityShards int
+
+	// Number of copies written for objects not erasure coded, and how many of them
+	// must succeed for a PUT to succeed, a majority of Replicas if WriteQuorum is 0
+	Replicas    int
+	WriteQuorum int
+
+	// How often data provider servers are probed, never if 0
+	HeartbeatInterval time.Duration
+
+	// Selects data provider servers for new objects, randomly if nil
+	Placement PlacementPolicy
+
+	// Virtual nodes of each data provider server on consistent hash ring, content is
+	// placed and looked up on the ring instead of by Placement if not 0
+	RingVirtualNodes int
+
+	// Multipart uploads not completed this long after initiated are aborted, never if 0
+	UploadExpiry time.Duration
+
+	// Resumable upload sessions not finished this long after created are aborted, never if 0
+	SessionExpiry time.Duration
+
+	// Bytes per second copied when moving content after data provider servers join
+	// or leave, content is not moved if 0. Content of drained data provider servers is
+	// copied at the same rate, or as fast as possible if 0
+	RebalanceRate int64
+
+	// Bytes per second copied when restoring replicas and shards lost with data provider
+	// servers down or corrupt objects, content is not repaired if 0
+	RepairRate int64
 }
 
 // Create and return API server instance
-func NewServer(dp []string) *Server {
+func NewServer(config Config) *Server {
 	dps := map[string]DataProvider{}
-	for i := range dp {
-		if dp[i] != "" {
-			provider := newDataProvider(dp[i])
+	for _, addr := range config.DataProviders {
+		if addr != "" {
+			provider := newDataProvider(addr)
 			dps[provider.id] = *provider
 		}
 	}
 
-	return &Server{
-		version: int64(1),
-		status:  RUNNING,
-		dp:      dps,
-		sqs:     *sqs.NewSQS(),
+	replicas := config.Replicas
+	if replicas <= 0 {
+		replicas = 1
+	}
+
+	writeQuorum := config.WriteQuorum
+	if writeQuorum <= 0 || writeQuorum > replicas {
+		writeQuorum = replicas/2 + 1
+	}
+
+	placement := config.Placement
+	if placement == nil {
+		placement = randomPlacement{}
+	}
+
+	s := &Server{
+		version:          int64(1),
+		status:           RUNNING,
+		dp:               dps,
+		locateBus:        config.LocateBus,
+		locateMode:       config.LocateMode,
+		meta:             config.Metadata,
+		dataShards:       config.DataShards,
+		parityShards:     config.ParityShards,
+		replicas:         replicas,
+		writeQuorum:      writeQuorum,
+		placement:        placement,
+		ringVirtualNodes: config.RingVirtualNodes,
+		contentLocks:     map[string]*contentLock{},
+		drains:           map[string]*drain{},
+		copyRate:         config.RebalanceRate,
+		pending:          map[string]chan string{},
+	}
+
+	s.rebuildRing()
+
+	if config.RebalanceRate > 0 {
+		s.startRebalancer(config.RebalanceRate)
+	}
+
+	if config.RepairRate > 0 {
+		s.startRepairer(config.RepairRate)
+	}
+
+	if s.locateBus != nil {
+		go s.listenToLocateReplies()
+	}
+
+	if config.HeartbeatInterval > 0 {
+		go s.monitorDataProviders(config.HeartbeatInterval)
+	}
+
+	go s.collectOrphans()
+
+	if config.UploadExpiry > 0 {
+		go s.expireUploads(config.UploadExpiry)
 	}
+
+	if config.SessionExpiry > 0 {
+		go s.expireSessions(config.SessionExpiry)
+	}
+
+	return s
 }
 
 // Serves "/" index page, returns API server info
 func (s *Server) Index(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 	info := map[string]interface{}{
-		"version": s.version,
-		"status":  s.status,
+		"version":       s.version,
+		"status":        s.status,
+		"dataProviders": s.dataProviderInfo(),
 	}
 
-	resp, _ := json.Marshal(info)
+	writeJSON(w, info)
+}
+
+// Write v as JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	resp, _ := json.Marshal(v)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
 }
@@ -91,105 +296,202 @@ func newDataProvider(addr string) *DataProvider {
 	return &DataProvider{
 		id:       uuid.String(),
 		addr:     addr,
+		status:   RUNNING,
 		lastPing: int64(0),
 	}
 }
 
-// Select a DataProvider randomly for incoming PUT operation
-func (s *Server) selectDataProvider() (DataProvider, error) {
+// Returns a snapshot of all known DataProviders
+func (s *Server) dataProviders() []DataProvider {
 	s.mutex.Lock()
-	dps := make([]DataProvider, 0)
+	defer s.mutex.Unlock()
+
+	dps := make([]DataProvider, 0, len(s.dp))
 	for _, dp := range s.dp {
 		dps = append(dps, dp)
 	}
-	s.mutex.Unlock()
+	return dps
+}
+
+// Select a DataProvider running, alive and with room for incoming PUT operation by placement policy,
+// providers in exclude (by id) are skipped
+func (s *Server) selectDataProvider(exclude map[string]bool) (DataProvider, error) {
+	dps := make([]DataProvider, 0)
+	for _, dp := range s.liveDataProviders() {
+		if !exclude[dp.id] && dp.hasRoom() && dp.status == RUNNING {
+			dps = append(dps, dp)
+		}
+	}
 
 	if len(dps) == 0 {
-		return DataProvider{}, errors.New("no data server available")
+		return DataProvider{}, errNoDataProvider
+	}
+
+	selected := s.placement.Select(dps)
+
+	s.mutex.Lock()
+	if dp, ok := s.dp[selected.id]; ok {
+		dp.placed++
+		s.dp[selected.id] = dp
 	}
+	s.mutex.Unlock()
 
-	i := rand.Intn(len(dps))
-	//log.Printf("Selected data provider server %s, addr: %s", dps[i].id, dps[i].addr)
-	return dps[i], nil
+	return selected, nil
 }
 
-// Get object from data provider server
+// Select n distinct DataProviders for incoming PUT operation, returns less than n
+// DataProviders if there are not enough of them
+func (s *Server) selectDataProviders(n int) []DataProvider {
+	selected := make([]DataProvider, 0, n)
+	exclude := map[string]bool{}
+	for len(selected) < n {
+		dp, err := s.selectDataProvider(exclude)
+		if err != nil {
+			break
+		}
+
+		selected = append(selected, dp)
+		exclude[dp.id] = true
+	}
+	return selected
+}
+
+// Get object from data provider server. Object name is resolved to the hash of its content
+// from metadata, then the content is fetched by hash. "Range" and "If-Range" headers are
+// supported, only the requested ranges are fetched from data provider servers.
+// The latest version is returned, or the version given by "versionId" query
 func (s *Server) GetObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	name := p.ByName("name")
-	uuid := uuid2.Must(uuid2.NewV4()).String()
-	msg := map[string]string{
-		"name": name,
-		"uid":  uuid,
+	bucket, name, ok := s.objectName(w, p)
+	if !ok {
+		return
 	}
 
-	locateSQS := sqs.NewSQSFromUrl(s.sqs.Url, s.sqs.ReplyUrl)
-	_, err := locateSQS.SendMessage(msg, s.sqs.Url)
-	if err != nil {
-		log.Printf("Unable to send location query message, error: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	rec, err := s.getRecord(bucket, name, r)
+	if err == metadata.ErrNotFound {
+		log.Printf("Object %s not found", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Unable to get metadata of object %s, error: %s", name, err)
+		w.WriteHeader(getRecordErrorStatus(err))
 		return
 	}
 
-	c := locateSQS.Consume(s.sqs.ReplyUrl)
-	go func() {
-		// If not found in 100 ms, return 404
-		time.Sleep(20 * time.Second)
-		locateSQS.Close()
-	}()
+	reader, err := s.newObjectReader(rec)
+	if err != nil {
+		log.Printf("Failed to get object %s, error: %s", name, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	setObjectHeaders(w, rec)
+	http.ServeContent(w, r, "", rec.Created, reader)
+	if reader.err != nil {
+		log.Printf("Failed to read object %s version %d, error: %s", name, rec.Version, reader.err)
+		// the response may look complete where it was cut short, abort the connection
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("Successfully get object %s version %d", name, rec.Version)
+}
 
-	for r := range c {
-		log.Printf("Consume message %s", *r.Body)
-		req := make(map[string]string)
-		err := json.Unmarshal([]byte(*r.Body), &req)
-		if err != nil {
-			log.Printf("Failed to unmarshal string to JSON, error: %s", err)
-			continue
-		}
+// Get object headers from metadata without the content, clients use it to check
+// existence and size of object, or of the version given by "versionId" query
+func (s *Server) HeadObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bucket, name, ok := s.objectName(w, p)
+	if !ok {
+		return
+	}
 
-		log.Println(req["name"])
-		log.Println(req["uid"])
-		if req["name"] == name && req["uid"] == uuid {
-			// object successfully located
-			objNameWithAddr := req["addr"] + "/objects/" + name
-			getStream, err := streams.NewGetStream(objNameWithAddr)
-			if err != nil {
-				log.Printf("Failed to get object %s, error: %s", objNameWithAddr, err)
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-
-			io.Copy(w, getStream)
-			log.Printf("Successfully get object from %s (%s)", name, req["addr"])
-			return
-		}
+	rec, err := s.getRecord(bucket, name, r)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Unable to get metadata of object %s, error: %s", name, err)
+		w.WriteHeader(getRecordErrorStatus(err))
+		return
 	}
 
-	log.Printf("Query object %s location timeout", name)
-	// TODO: delete message
-	w.WriteHeader(http.StatusNotFound)
+	setObjectHeaders(w, rec)
+}
+
+// Set Content-Length, Last-Modified, ETag, Content-Type and version ID headers of object
+// from its metadata
+func setObjectHeaders(w http.ResponseWriter, rec metadata.Record) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(rec.Size, 10))
+	w.Header().Set("Last-Modified", rec.Created.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", `"`+rec.Hash+`"`)
+	w.Header().Set("Content-Type", rec.ContentType)
+	w.Header().Set(versionIdHeader, versionId(rec))
 }
 
-// Put object to data provider server
+// Put object to data provider servers, then records it as a new version in metadata.
+// Client must send the SHA-256 hash of content in "Digest: SHA-256=<base64 hash>" header,
+// data provider servers store content by hash, so identical content is stored once
 func (s *Server) PutObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	name := p.ByName("name")
-	dataSrv, err := s.selectDataProvider()
-	if err != nil {
-		log.Printf("Unable to select data server, error: %s", err)
-		w.WriteHeader(http.StatusServiceUnavailable)
+	bucket, name, ok := s.objectName(w, p)
+	if !ok {
 		return
 	}
 
-	objNameWithAddr := dataSrv.addr + "/objects/" + name
-	putStream := streams.NewPutStream(objNameWithAddr)
+	hash := util.GetHashFromHeader(r.Header)
+	if hash == "" {
+		log.Printf("Missing or malformed Digest header of object %s", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	io.Copy(putStream, r.Body)
-	err = putStream.Close()
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
 
+	s.lockContent(bucket, hash)
+	content, err := s.putContent(bucket, hash, newChecksumReader(r, hash))
 	if err != nil {
-		log.Printf("Failed to put object %s, error: %s", objNameWithAddr, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		s.unlockContent(bucket, hash)
+		log.Printf("Failed to put object %s, error: %s", name, err)
+		w.WriteHeader(putContentErrorStatus(err))
+		return
+	}
+
+	rec := metadata.Record{
+		Name:        name,
+		Content:     content,
+		ContentType: contentType,
+	}
+	rec, err = s.meta.PutVersion(rec)
+	s.unlockContent(bucket, hash)
+	if err != nil {
+		log.Printf("Failed to save metadata of object %s, error: %s", name, err)
+		// the bucket was deleted meanwhile, or the content may be referenced by nothing else
+		s.deleteUnreferenced([]metadata.Content{content})
+		if err == metadata.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set(versionIdHeader, versionId(rec))
+	log.Printf("Object %s version %d saved, hash %s", name, rec.Version, hash)
+}
+
+// Delete object, "DELETE /objects/:name" writes a delete marker, so the object is not found
+// but its versions are kept. With "versionId" query, that version is deleted permanently
+func (s *Server) DeleteObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bucket, name, ok := s.objectName(w, p)
+	if !ok {
+		return
+	}
+
+	if id := r.URL.Query().Get("versionId"); id != "" {
+		s.deleteVersion(w, bucket, name, id)
 		return
 	}
 
-	log.Printf("Successfully put object %s to data server %s (%s)", name, dataSrv.id, dataSrv.addr)
+	s.putDeleteMarker(w, bucket, name)
 }
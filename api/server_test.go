@@ -0,0 +1,385 @@
+package api
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../bus"
+	"../metadata"
+	"../provider"
+	"../util"
+)
+
+// Storage folders of data provider servers started by startDataServers, by address
+var dataStorages = map[string]string{}
+
+// Start n data provider servers on local ports, routed like main.go does, answering
+// location queries of locateBus unless nil, returns their addresses
+func startDataServers(t *testing.T, n int, locateBus bus.LocateBus) []string {
+	addrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		srv := httptest.NewUnstartedServer(nil)
+		addr := srv.Listener.Addr().String()
+		storage := filepath.Join(t.TempDir(), "storage")
+		dataStorages[addr] = storage
+		dataSrv := provider.NewServer(addr, storage, locateBus)
+		if locateBus != nil {
+			go dataSrv.ListenToObjectLocateQueue()
+		}
+
+		router := httprouter.New()
+		router.GET("/objects/:name", dataSrv.GetObject)
+		router.HEAD("/objects/:name", dataSrv.HeadObject)
+		router.PUT("/objects/:name", dataSrv.PutObject)
+		router.DELETE("/objects/:name", dataSrv.DeleteObject)
+		router.GET("/buckets/:bucket/objects/:name", dataSrv.GetObject)
+		router.HEAD("/buckets/:bucket/objects/:name", dataSrv.HeadObject)
+		router.PUT("/buckets/:bucket/objects/:name", dataSrv.PutObject)
+		router.DELETE("/buckets/:bucket/objects/:name", dataSrv.DeleteObject)
+		router.POST("/staging/:id", dataSrv.CreateStaging)
+		router.HEAD("/staging/:id", dataSrv.HeadStaging)
+		router.PATCH("/staging/:id", dataSrv.PatchStaging)
+		router.GET("/staging/:id", dataSrv.GetStaging)
+		router.DELETE("/staging/:id", dataSrv.DeleteStaging)
+		router.GET("/status", dataSrv.GetStatus)
+		router.PUT("/state", dataSrv.PutState)
+		srv.Config.Handler = dataSrv.TrackLoad(router)
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Open a metadata store in a temporary folder
+func newTestMetadata(t *testing.T) *metadata.DiskStore {
+	store, err := metadata.NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Route the RESTful API of API server s like main.go does
+func apiRouter(s *Server) http.Handler {
+	router := httprouter.New()
+	router.GET("/", s.Index)
+	router.GET("/objects/:name", s.GetObject)
+	router.HEAD("/objects/:name", s.HeadObject)
+	router.PUT("/objects/:name", s.PutObject)
+	router.DELETE("/objects/:name", s.DeleteObject)
+	router.GET("/versions/:name", s.ListVersions)
+	router.GET("/buckets", s.ListBuckets)
+	router.PUT("/buckets/:bucket", s.CreateBucket)
+	router.DELETE("/buckets/:bucket", s.DeleteBucket)
+	router.GET("/buckets/:bucket", s.ListObjects)
+	router.GET("/buckets/:bucket/objects/*key", s.GetObject)
+	router.HEAD("/buckets/:bucket/objects/*key", s.HeadObject)
+	router.PUT("/buckets/:bucket/objects/*key", s.PutObject)
+	router.DELETE("/buckets/:bucket/objects/*key", s.DeleteObject)
+	router.GET("/buckets/:bucket/versions/*key", s.ListVersions)
+	router.POST("/uploads", s.CreateUpload)
+	router.PUT("/uploads/:id/parts/:part", s.UploadPart)
+	router.GET("/uploads/:id", s.ListParts)
+	router.POST("/uploads/:id", s.CompleteUpload)
+	router.DELETE("/uploads/:id", s.AbortUpload)
+	router.POST("/resumable", s.CreateSession)
+	router.HEAD("/resumable/:id", s.HeadSession)
+	router.PATCH("/resumable/:id", s.PatchSession)
+	router.POST("/resumable/:id", s.FinishSession)
+	router.DELETE("/resumable/:id", s.AbortSession)
+	router.GET("/providers", s.ListDataProviders)
+	router.POST("/providers", s.RegisterDataProvider)
+	router.DELETE("/providers/:id", s.DeregisterDataProvider)
+	router.POST("/providers/:id/drain", s.DrainDataProvider)
+	router.GET("/providers/:id/drain", s.GetDrainStatus)
+	router.GET("/admin/rebalance", s.GetRebalanceStatus)
+	router.POST("/admin/rebalance", s.StartRebalance)
+	router.GET("/admin/repair", s.GetRepairStatus)
+	router.POST("/admin/repair", s.StartRepair)
+	return router
+}
+
+// Returns the hex encoded SHA-256 hash of content
+func hashOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Put content to path on h with its "Digest" header, returns the recorded response
+func put(h http.Handler, path string, content string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("PUT", path, strings.NewReader(content))
+	r.Header.Set("Digest", util.DigestHeader(hashOf(content)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Serve request method path with body on h, returns the recorded response
+func serve(h http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestPutAndGetObject(t *testing.T) {
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: startDataServers(t, 3, nil), LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+
+	w := put(h, "/objects/obj", "some content")
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT status is %d", w.Code)
+	}
+
+	w = serve(h, "GET", "/objects/obj", "")
+	if w.Code != http.StatusOK || w.Body.String() != "some content" {
+		t.Errorf("GET is %d %q", w.Code, w.Body.String())
+	}
+
+	w = serve(h, "GET", "/objects/missing", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of missing object is %d", w.Code)
+	}
+}
+
+func TestPutObjectRecordsVersions(t *testing.T) {
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: startDataServers(t, 2, nil), LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+
+	for _, content := range []string{"first", "second"} {
+		r := httptest.NewRequest("PUT", "/objects/obj", strings.NewReader(content))
+		r.Header.Set("Content-Type", "text/plain")
+		r.Header.Set("Digest", util.DigestHeader(hashOf(content)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT status is %d", w.Code)
+		}
+	}
+
+	versions, err := meta.Versions("", "obj")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("versions are %v, error: %v", versions, err)
+	}
+	latest := versions[1]
+	if latest.Version != 2 || latest.Size != 6 || latest.Hash != hashOf("second") ||
+		latest.ContentType != "text/plain" || len(latest.Locations) != 1 {
+		t.Errorf("latest version is %v", latest)
+	}
+
+	w := serve(h, "GET", "/objects/obj", "")
+	if w.Body.String() != "second" {
+		t.Errorf("GET is %q", w.Body.String())
+	}
+}
+
+func TestPutObjectVerifiesDigest(t *testing.T) {
+	s := NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+
+	w := serve(h, "PUT", "/objects/obj", "content")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT without Digest is %d", w.Code)
+	}
+
+	r := httptest.NewRequest("PUT", "/objects/obj", strings.NewReader("other content"))
+	r.Header.Set("Digest", util.DigestHeader(hashOf("content")))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with wrong Digest is %d", w.Code)
+	}
+
+	if w := serve(h, "GET", "/objects/obj", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of rejected object is %d", w.Code)
+	}
+}
+
+func TestPutObjectVerifiesChecksums(t *testing.T) {
+	addrs := startDataServers(t, 1, nil)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: newTestMetadata(t)})
+	h := apiRouter(s)
+	md5sum := md5.Sum([]byte("content"))
+
+	for _, tc := range []struct {
+		header  string
+		value   string
+		trailer bool
+		status  int
+	}{
+		{"Content-MD5", util.EncodeChecksum(md5sum[:]), false, http.StatusOK},
+		{"Content-MD5", util.EncodeChecksum([]byte("0123456789abcdef")), false, http.StatusBadRequest},
+		{"Content-MD5", util.EncodeChecksum([]byte("0123456789abcdef")), true, http.StatusBadRequest},
+		{util.ChecksumSHA256Header, util.EncodeHexChecksum(hashOf("other")), false, http.StatusBadRequest},
+		{util.ChecksumCRC32CHeader, util.EncodeHexChecksum("00000000"), true, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("PUT", "/objects/obj", strings.NewReader("content"))
+		r.Header.Set("Digest", util.DigestHeader(hashOf("content")))
+		if tc.trailer {
+			r.Trailer = http.Header{}
+			r.Trailer.Set(tc.header, tc.value)
+		} else {
+			r.Header.Set(tc.header, tc.value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("PUT with %s %q, trailer %v is %d, want %d", tc.header, tc.value, tc.trailer, w.Code, tc.status)
+		}
+	}
+
+	if rec, _ := s.meta.Get("", "obj"); rec.Version != 1 {
+		t.Errorf("object version is %d", rec.Version)
+	}
+}
+
+// Returns the addresses among addrs of data provider servers holding content by hash
+func holders(s *Server, addrs []string, hash string) []string {
+	result := make([]string, 0)
+	for _, addr := range addrs {
+		if s.isObjectExistsAt(addr, "/objects/"+hash) {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+func TestPutObjectStoresIdenticalContentOnce(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if w := put(h, "/objects/"+name, "same content"); w.Code != http.StatusOK {
+			t.Fatalf("PUT of %s is %d", name, w.Code)
+		}
+	}
+
+	if held := holders(s, addrs, hashOf("same content")); len(held) != 1 {
+		t.Errorf("content held by %v", held)
+	}
+	if w := serve(h, "GET", "/objects/d", ""); w.Body.String() != "same content" {
+		t.Errorf("GET is %q", w.Body.String())
+	}
+}
+
+func TestPutObjectProbesEveryLocation(t *testing.T) {
+	addrs := startDataServers(t, 3, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+
+	// the first location of the content is down, the second still holds it
+	hash := putObjectAt(t, addrs[0], "content")
+	_, err := meta.PutVersion(metadata.Record{Name: "old", Content: metadata.Content{Hash: hash, Size: 7,
+		Locations: []string{"127.0.0.1:1", addrs[0]}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := put(h, "/objects/new", "content"); w.Code != http.StatusOK {
+		t.Fatalf("PUT is %d", w.Code)
+	}
+	if held := holders(s, addrs, hash); len(held) != 1 || held[0] != addrs[0] {
+		t.Errorf("content held by %v", held)
+	}
+	rec, err := meta.Get("", "new")
+	if err != nil || len(rec.Locations) != 2 || rec.Locations[1] != addrs[0] {
+		t.Errorf("record is %v, error: %v", rec, err)
+	}
+}
+
+func TestDeleteObject(t *testing.T) {
+	addrs := startDataServers(t, 2, nil)
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: addrs, LocateMode: LocateByHTTP, Metadata: meta, Replicas: 2})
+	h := apiRouter(s)
+
+	put(h, "/objects/a", "shared content")
+	own := put(h, "/objects/a", "own content").Header().Get(versionIdHeader)
+	put(h, "/objects/b", "shared content")
+
+	// a delete marker is written, the versions and their content are kept
+	if w := serve(h, "DELETE", "/objects/a", ""); w.Code != http.StatusOK || w.Header().Get(versionIdHeader) == "" {
+		t.Fatalf("DELETE is %d, version ID %q", w.Code, w.Header().Get(versionIdHeader))
+	}
+	if w := serve(h, "GET", "/objects/a", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of deleted object is %d", w.Code)
+	}
+	if versions, err := meta.Versions("", "a"); err != nil || len(versions) != 3 || !versions[2].DeleteMarker {
+		t.Errorf("versions of deleted object are %v, error: %v", versions, err)
+	}
+	if held := holders(s, addrs, hashOf("own content")); len(held) != 2 {
+		t.Errorf("content of deleted object held by %v", held)
+	}
+	if w := serve(h, "DELETE", "/objects/a", ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of deleted object is %d", w.Code)
+	}
+
+	// deleting a version permanently deletes its content, unless b still references it
+	if w := serve(h, "DELETE", "/objects/a?versionId="+own, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE of version is %d", w.Code)
+	}
+	if held := holders(s, addrs, hashOf("own content")); len(held) != 0 {
+		t.Errorf("content of deleted version held by %v", held)
+	}
+	versions, _ := meta.Versions("", "a")
+	if w := serve(h, "DELETE", "/objects/a?versionId="+versionId(versions[0]), ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE of version is %d", w.Code)
+	}
+	if held := holders(s, addrs, hashOf("shared content")); len(held) != 2 {
+		t.Errorf("shared content held by %v", held)
+	}
+	if w := serve(h, "GET", "/objects/b", ""); w.Body.String() != "shared content" {
+		t.Errorf("GET of b is %q", w.Body.String())
+	}
+}
+
+func TestHeadObject(t *testing.T) {
+	meta := newTestMetadata(t)
+	s := NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP, Metadata: meta})
+	h := apiRouter(s)
+
+	r := httptest.NewRequest("PUT", "/objects/obj", strings.NewReader("content"))
+	r.Header.Set("Digest", util.DigestHeader(hashOf("content")))
+	r.Header.Set("Content-Type", "text/plain")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	rec, _ := meta.Get("", "obj")
+
+	for _, method := range []string{"HEAD", "GET"} {
+		w := serve(h, method, "/objects/obj", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s is %d", method, w.Code)
+		}
+		for header, want := range map[string]string{
+			"Content-Length": "7",
+			"ETag":           `"` + hashOf("content") + `"`,
+			"Content-Type":   "text/plain",
+			"Last-Modified":  rec.Created.UTC().Format(http.TimeFormat),
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("%s header %s is %q, want %q", method, header, got, want)
+			}
+		}
+		if method == "HEAD" && w.Body.Len() != 0 {
+			t.Errorf("HEAD returned %d bytes of content", w.Body.Len())
+		}
+	}
+
+	if w := serve(h, "HEAD", "/objects/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of missing object is %d", w.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"../metadata"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Response header holding the version ID of object
+const versionIdHeader = "X-Version-Id"
+
+// Returned when "versionId" query is not a version ID
+var errInvalidVersionId = errors.New("invalid version ID")
+
+// VersionInfo is a version entry in version listing
+type VersionInfo struct {
+	VersionId    string    `json:"versionId"`
+	IsLatest     bool      `json:"isLatest"`
+	DeleteMarker bool      `json:"deleteMarker"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// Returns the version ID of rec
+func versionId(rec metadata.Record) string {
+	return strconv.FormatInt(rec.Version, 10)
+}
+
+// Get the version of object given by "versionId" query, or the latest version. Returns
+// metadata.ErrNotFound if there is no such version or it is a delete marker
+func (s *Server) getRecord(bucket string, name string, r *http.Request) (metadata.Record, error) {
+	var rec metadata.Record
+	var err error
+	if id := r.URL.Query().Get("versionId"); id != "" {
+		version, parseErr := strconv.ParseInt(id, 10, 64)
+		if parseErr != nil || version <= 0 {
+			return rec, errInvalidVersionId
+		}
+		rec, err = s.meta.GetVersion(bucket, name, version)
+	} else {
+		rec, err = s.meta.Get(bucket, name)
+	}
+
+	if err == nil && rec.DeleteMarker {
+		return rec, metadata.ErrNotFound
+	}
+	return rec, err
+}
+
+// Returns the response status of errors getting object metadata
+func getRecordErrorStatus(err error) int {
+	switch err {
+	case metadata.ErrNotFound:
+		return http.StatusNotFound
+	case errInvalidVersionId:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// List versions of object, "GET /versions/:name", or "GET /buckets/:bucket/versions/*key"
+// for objects of a bucket, newest first, delete markers included
+func (s *Server) ListVersions(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bucket, name, ok := s.objectName(w, p)
+	if !ok {
+		return
+	}
+
+	versions, err := s.meta.Versions(bucket, name)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Unable to get versions of object %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]VersionInfo, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		rec := versions[i]
+		infos = append(infos, VersionInfo{
+			VersionId:    versionId(rec),
+			IsLatest:     i == len(versions)-1,
+			DeleteMarker: rec.DeleteMarker,
+			Size:         rec.Size,
+			Hash:         rec.Hash,
+			LastModified: rec.Created,
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"name":     name,
+		"versions": infos,
+	})
+}
+
+// Write a delete marker as the latest version of object, older versions are kept and
+// can still be read by version ID
+func (s *Server) putDeleteMarker(w http.ResponseWriter, bucket string, name string) {
+	latest, err := s.meta.Get(bucket, name)
+	if err == nil && latest.DeleteMarker {
+		err = metadata.ErrNotFound
+	}
+	if err != nil {
+		if err != metadata.ErrNotFound {
+			log.Printf("Unable to get metadata of object %s, error: %s", name, err)
+		}
+		w.WriteHeader(getRecordErrorStatus(err))
+		return
+	}
+
+	rec, err := s.meta.PutVersion(metadata.Record{
+		Name:         name,
+		Content:      metadata.Content{Bucket: bucket},
+		DeleteMarker: true,
+	})
+	if err == metadata.ErrNotFound {
+		// the bucket was deleted meanwhile
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to save delete marker of object %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(versionIdHeader, versionId(rec))
+	log.Printf("Object %s deleted, delete marker version %d", name, rec.Version)
+}
+
+// Delete version of object permanently, content no longer referenced by any other
+// object is deleted from every data provider server
+func (s *Server) deleteVersion(w http.ResponseWriter, bucket string, name string, id string) {
+	version, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || version <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rec, err := s.meta.DeleteVersion(bucket, name, version)
+	if err == metadata.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete version %d of object %s, error: %s", version, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.deleteUnreferenced(rec.Contents())
+	w.Header().Set(versionIdHeader, versionId(rec))
+	log.Printf("Deleted object %s version %d", name, version)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// List versions of object name on h
+func listVersions(t *testing.T, h http.Handler, name string) []VersionInfo {
+	t.Helper()
+	w := serve(h, "GET", "/versions/"+name, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing versions of %s returned %d", name, w.Code)
+	}
+	var result struct {
+		Versions []VersionInfo `json:"versions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result.Versions
+}
+
+func TestGetObjectVersions(t *testing.T) {
+	h := apiRouter(NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t)}))
+
+	v1 := put(h, "/objects/obj", "first").Header().Get(versionIdHeader)
+	v2 := put(h, "/objects/obj", "second").Header().Get(versionIdHeader)
+	if v1 == "" || v1 == v2 {
+		t.Fatalf("version IDs are %q and %q", v1, v2)
+	}
+
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "second" || w.Header().Get(versionIdHeader) != v2 {
+		t.Errorf("GET is %q, version %q", w.Body.String(), w.Header().Get(versionIdHeader))
+	}
+	if w := serve(h, "GET", "/objects/obj?versionId="+v1, ""); w.Body.String() != "first" {
+		t.Errorf("GET of version %s is %q", v1, w.Body.String())
+	}
+	if w := serve(h, "HEAD", "/objects/obj?versionId="+v1, ""); w.Header().Get("Content-Length") != "5" {
+		t.Errorf("HEAD of version %s has length %q", v1, w.Header().Get("Content-Length"))
+	}
+	if w := serve(h, "GET", "/objects/obj?versionId=x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET of invalid version is %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/obj?versionId=99", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of missing version is %d", w.Code)
+	}
+}
+
+func TestDeleteMarkerHidesObjectUntilDeleted(t *testing.T) {
+	h := apiRouter(NewServer(Config{DataProviders: startDataServers(t, 1, nil), LocateMode: LocateByHTTP,
+		Metadata: newTestMetadata(t)}))
+	v1 := put(h, "/objects/obj", "content").Header().Get(versionIdHeader)
+	marker := serve(h, "DELETE", "/objects/obj", "").Header().Get(versionIdHeader)
+
+	versions := listVersions(t, h, "obj")
+	if len(versions) != 2 || versions[0].VersionId != marker || !versions[0].DeleteMarker || !versions[0].IsLatest ||
+		versions[1].VersionId != v1 || versions[1].DeleteMarker || versions[1].Hash != hashOf("content") {
+		t.Errorf("versions are %+v", versions)
+	}
+	if w := serve(h, "GET", "/objects/obj?versionId="+marker, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of delete marker is %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/obj?versionId="+v1, ""); w.Body.String() != "content" {
+		t.Errorf("GET of version before delete marker is %q", w.Body.String())
+	}
+
+	// deleting the delete marker restores the object
+	if w := serve(h, "DELETE", "/objects/obj?versionId="+marker, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE of delete marker is %d", w.Code)
+	}
+	if w := serve(h, "GET", "/objects/obj", ""); w.Body.String() != "content" {
+		t.Errorf("GET of restored object is %q", w.Body.String())
+	}
+	if w := serve(h, "DELETE", "/objects/obj?versionId="+marker, ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of deleted version is %d", w.Code)
+	}
+	if w := serve(h, "GET", "/versions/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("listing versions of missing object is %d", w.Code)
+	}
+}
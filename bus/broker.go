@@ -0,0 +1,182 @@
+package bus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Broker exposes a MemoryBus over HTTP, so API server and data provider servers running
+// in different processes can share a bus without AWS:
+//		POST /topics/:topic		publish the JSON message in request body
+//		GET /topics/:topic		stream messages of topic, one JSON message per line
+type Broker struct {
+	bus *MemoryBus
+}
+
+// BrokerBus is a LocateBus talking to a Broker
+type BrokerBus struct {
+	// Broker address, e.g. "localhost:8040"
+	addr string
+}
+
+type brokerSubscription struct {
+	msgC   chan Message
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// Create and return Broker instance
+func NewBroker() *Broker {
+	return &Broker{bus: NewMemoryBus()}
+}
+
+// RESTful API, publish message to topic
+func (b *Broker) Publish(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	msg := make(map[string]string)
+	err := json.NewDecoder(r.Body).Decode(&msg)
+	if err != nil {
+		log.Printf("Failed to unmarshal string to JSON, error: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b.bus.publish(p.ByName("topic"), msg)
+}
+
+// RESTful API, stream messages of topic until the subscriber disconnects
+func (b *Broker) Subscribe(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	topic := p.ByName("topic")
+	sub := b.bus.subscribe(topic)
+	defer sub.Close()
+	log.Printf("New subscriber of topic %s from %s", topic, r.RemoteAddr)
+
+	// Send headers now, the subscriber returns once it receives them
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case msg := <-sub.msgC:
+			err := encoder.Encode(msg.Body)
+			if err != nil {
+				log.Printf("Failed to send message to subscriber %s, error: %s", r.RemoteAddr, err)
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Create and return BrokerBus connecting to broker at addr
+func NewBrokerBus(addr string) *BrokerBus {
+	return &BrokerBus{addr: addr}
+}
+
+func (b *BrokerBus) PublishQuery(msg map[string]string) error {
+	return b.publish(QueryTopic, msg)
+}
+
+func (b *BrokerBus) SubscribeQueries() (Subscription, error) {
+	return b.subscribe(QueryTopic)
+}
+
+func (b *BrokerBus) PublishReply(msg map[string]string) error {
+	return b.publish(ReplyTopic, msg)
+}
+
+func (b *BrokerBus) SubscribeReplies() (Subscription, error) {
+	return b.subscribe(ReplyTopic)
+}
+
+func (b *BrokerBus) publish(topic string, msg map[string]string) error {
+	msgStr, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post("http://"+b.addr+"/topics/"+topic, "application/json", bytes.NewReader(msgStr))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("broker returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (b *BrokerBus) subscribe(topic string) (Subscription, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", "http://"+b.addr+"/topics/"+topic, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("broker returned status code %d", resp.StatusCode)
+	}
+
+	sub := &brokerSubscription{
+		msgC:   make(chan Message),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(sub.msgC)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			body := make(map[string]string)
+			err := json.Unmarshal(scanner.Bytes(), &body)
+			if err != nil {
+				log.Printf("Failed to unmarshal string to JSON, error: %s", err)
+				continue
+			}
+
+			select {
+			case sub.msgC <- Message{Body: body}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+func (s *brokerSubscription) Messages() <-chan Message {
+	return s.msgC
+}
+
+func (s *brokerSubscription) Close() {
+	s.once.Do(s.cancel)
+}
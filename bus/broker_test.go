@@ -0,0 +1,76 @@
+package bus
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Start a Broker on a local port, returns the BrokerBus talking to it
+func newTestBroker(t *testing.T) *BrokerBus {
+	broker := NewBroker()
+	router := httprouter.New()
+	router.GET("/topics/:topic", broker.Subscribe)
+	router.POST("/topics/:topic", broker.Publish)
+
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return NewBrokerBus(strings.TrimPrefix(srv.URL, "http://"))
+}
+
+func TestBrokerBusQueriesAndReplies(t *testing.T) {
+	b := newTestBroker(t)
+	queries, err := b.SubscribeQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queries.Close()
+
+	replies, err := b.SubscribeReplies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replies.Close()
+
+	err = b.PublishQuery(map[string]string{"bucket": "b", "name": "obj", "uid": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, queries)
+	if msg.Body["bucket"] != "b" || msg.Body["name"] != "obj" || msg.Body["uid"] != "1" {
+		t.Errorf("unexpected query %v", msg.Body)
+	}
+
+	err = b.PublishReply(map[string]string{"uid": "1", "addr": "localhost:8031"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = receive(t, replies)
+	if msg.Body["uid"] != "1" || msg.Body["addr"] != "localhost:8031" {
+		t.Errorf("unexpected reply %v", msg.Body)
+	}
+}
+
+func TestBrokerBusSubscriptionClose(t *testing.T) {
+	b := newTestBroker(t)
+	sub, err := b.SubscribeQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub.Close()
+	sub.Close()
+	for range sub.Messages() {
+	}
+}
+
+func TestBrokerBusUnreachable(t *testing.T) {
+	b := NewBrokerBus("127.0.0.1:1")
+	if _, err := b.SubscribeQueries(); err == nil {
+		t.Error("subscribed to unreachable broker")
+	}
+	if err := b.PublishQuery(map[string]string{"uid": "1"}); err == nil {
+		t.Error("published to unreachable broker")
+	}
+}
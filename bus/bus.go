@@ -0,0 +1,49 @@
+package bus
+
+// Message is a message carried by a LocateBus, for a location query it looks like:
+// 		{"bucket": "somebucket", "name": "someobject", "uid": <UUID>}
+// and for a location reply:
+//		{"uid": <UUID>, "addr": "localhost:8031", "bucket": "somebucket", "name": "someobject"}
+// bucket is empty for objects outside buckets
+type Message struct {
+	// Message body
+	Body map[string]string
+
+	// Acknowledge function, nil if the bus does not need acknowledgement
+	ack func() error
+}
+
+// Ack tells the bus that the message has been handled, so it won't be delivered again.
+// For buses that broadcast messages, this is a no-op
+func (m Message) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+
+	return m.ack()
+}
+
+// Subscription delivers messages until it is closed
+type Subscription interface {
+	// Messages returns the message channel, it is closed after Close is called
+	Messages() <-chan Message
+
+	// Close stops the subscription
+	Close()
+}
+
+// LocateBus carries object location queries from API server to data provider servers,
+// and location replies back from data provider servers to API server
+type LocateBus interface {
+	// PublishQuery publishes a location query, used by API server
+	PublishQuery(msg map[string]string) error
+
+	// SubscribeQueries subscribes to location queries, used by data provider server
+	SubscribeQueries() (Subscription, error)
+
+	// PublishReply publishes a location reply, used by data provider server
+	PublishReply(msg map[string]string) error
+
+	// SubscribeReplies subscribes to location replies, used by API server
+	SubscribeReplies() (Subscription, error)
+}
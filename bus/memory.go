@@ -0,0 +1,105 @@
+package bus
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	// Topic of location queries
+	QueryTopic = "locate"
+
+	// Topic of location replies
+	ReplyTopic = "located"
+
+	// Buffer size of each subscription
+	subscriptionBufferSize = 64
+)
+
+// MemoryBus is an in-process LocateBus, every message is broadcast to all subscribers
+// of its topic. It only works when API server and data provider servers live in the
+// same process, or behind a Broker
+type MemoryBus struct {
+	// Subscriptions by topic
+	topics map[string]map[*memorySubscription]bool
+
+	// mutex on topics
+	mutex sync.Mutex
+}
+
+type memorySubscription struct {
+	bus   *MemoryBus
+	topic string
+	msgC  chan Message
+}
+
+// Create and return an empty MemoryBus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		topics: map[string]map[*memorySubscription]bool{},
+	}
+}
+
+func (b *MemoryBus) PublishQuery(msg map[string]string) error {
+	b.publish(QueryTopic, msg)
+	return nil
+}
+
+func (b *MemoryBus) SubscribeQueries() (Subscription, error) {
+	return b.subscribe(QueryTopic), nil
+}
+
+func (b *MemoryBus) PublishReply(msg map[string]string) error {
+	b.publish(ReplyTopic, msg)
+	return nil
+}
+
+func (b *MemoryBus) SubscribeReplies() (Subscription, error) {
+	return b.subscribe(ReplyTopic), nil
+}
+
+// Deliver message to every subscriber of topic, a slow subscriber whose buffer is full
+// misses the message rather than blocking the publisher
+func (b *MemoryBus) publish(topic string, msg map[string]string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.topics[topic] {
+		select {
+		case sub.msgC <- Message{Body: msg}:
+		default:
+			log.Printf("Subscription buffer of topic %s is full, dropping message", topic)
+		}
+	}
+}
+
+func (b *MemoryBus) subscribe(topic string) *memorySubscription {
+	sub := &memorySubscription{
+		bus:   b,
+		topic: topic,
+		msgC:  make(chan Message, subscriptionBufferSize),
+	}
+
+	b.mutex.Lock()
+	if b.topics[topic] == nil {
+		b.topics[topic] = map[*memorySubscription]bool{}
+	}
+	b.topics[topic][sub] = true
+	b.mutex.Unlock()
+
+	return sub
+}
+
+func (s *memorySubscription) Messages() <-chan Message {
+	return s.msgC
+}
+
+func (s *memorySubscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	if s.bus.topics[s.topic][s] {
+		delete(s.bus.topics[s.topic], s)
+		close(s.msgC)
+	}
+}
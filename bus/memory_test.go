@@ -0,0 +1,90 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+// Receive a message from subscription, fails the test if none arrives in time
+func receive(t *testing.T, sub Subscription) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-sub.Messages():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+func TestMemoryBusBroadcastsToAllSubscribers(t *testing.T) {
+	b := NewMemoryBus()
+	sub1, _ := b.SubscribeQueries()
+	sub2, _ := b.SubscribeQueries()
+	replies, _ := b.SubscribeReplies()
+	defer sub1.Close()
+	defer sub2.Close()
+	defer replies.Close()
+
+	err := b.PublishQuery(map[string]string{"name": "obj", "uid": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []Subscription{sub1, sub2} {
+		msg := receive(t, sub)
+		if msg.Body["name"] != "obj" || msg.Body["uid"] != "1" {
+			t.Errorf("unexpected message %v", msg.Body)
+		}
+		if msg.Ack() != nil {
+			t.Error("ack of broadcast message failed")
+		}
+	}
+
+	select {
+	case msg := <-replies.Messages():
+		t.Errorf("query delivered to replies subscriber: %v", msg.Body)
+	default:
+	}
+}
+
+func TestMemoryBusCloseEndsSubscription(t *testing.T) {
+	b := NewMemoryBus()
+	sub, _ := b.SubscribeReplies()
+	sub.Close()
+	sub.Close()
+
+	if _, ok := <-sub.Messages(); ok {
+		t.Error("message received after close")
+	}
+
+	// publishing with no subscriber left does not block nor panic
+	b.PublishReply(map[string]string{"uid": "1"})
+}
+
+func TestMemoryBusDropsMessagesOfFullSubscription(t *testing.T) {
+	b := NewMemoryBus()
+	sub, _ := b.SubscribeQueries()
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriptionBufferSize*2; i++ {
+			b.PublishQuery(map[string]string{"uid": "x"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher blocked by slow subscriber")
+	}
+
+	if n := len(sub.Messages()); n != subscriptionBufferSize {
+		t.Errorf("buffered %d messages, want %d", n, subscriptionBufferSize)
+	}
+}
@@ -0,0 +1,105 @@
+package bus
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"../sqs"
+)
+
+// SQSBus is a LocateBus backed by the AWS SQS queues "godos-test" and "godos-test-located".
+// Unlike MemoryBus, every message is consumed by one subscriber only, a data provider
+// server that holds the object acknowledges (deletes) the query message
+type SQSBus struct {
+	// SQS client used to publish messages
+	sqs *sqs.SQS
+}
+
+type sqsSubscription struct {
+	sqs   *sqs.SQS
+	msgC  chan Message
+	doneC chan bool
+	once  sync.Once
+}
+
+// Create and return SQSBus, returns error if the queues are unreachable
+func NewSQSBus() (*SQSBus, error) {
+	q, err := sqs.NewSQS()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQSBus{sqs: q}, nil
+}
+
+func (b *SQSBus) PublishQuery(msg map[string]string) error {
+	_, err := b.sqs.SendMessage(msg, b.sqs.Url)
+	return err
+}
+
+func (b *SQSBus) SubscribeQueries() (Subscription, error) {
+	return b.subscribe(b.sqs.Url)
+}
+
+func (b *SQSBus) PublishReply(msg map[string]string) error {
+	_, err := b.sqs.SendMessage(msg, b.sqs.ReplyUrl)
+	return err
+}
+
+func (b *SQSBus) SubscribeReplies() (Subscription, error) {
+	return b.subscribe(b.sqs.ReplyUrl)
+}
+
+// Each subscription owns its own consumer, since a SQS consumer has a single message channel
+func (b *SQSBus) subscribe(url string) (Subscription, error) {
+	q, err := sqs.NewSQSFromUrl(b.sqs.Url, b.sqs.ReplyUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &sqsSubscription{
+		sqs:   q,
+		msgC:  make(chan Message),
+		doneC: make(chan bool),
+	}
+
+	go func() {
+		defer close(sub.msgC)
+		for m := range q.Consume(url) {
+			m := m
+			body := make(map[string]string)
+			err := json.Unmarshal([]byte(*m.Body), &body)
+			if err != nil {
+				log.Printf("Failed to unmarshal string to JSON, error: %s", err)
+				continue
+			}
+
+			msg := Message{
+				Body: body,
+				ack: func() error {
+					return q.DeleteMessage(m, url)
+				},
+			}
+
+			// keep draining the consumer after close, so it can notice the close signal
+			select {
+			case sub.msgC <- msg:
+			case <-sub.doneC:
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+func (s *sqsSubscription) Messages() <-chan Message {
+	return s.msgC
+}
+
+func (s *sqsSubscription) Close() {
+	s.once.Do(func() {
+		close(s.doneC)
+		s.sqs.Close()
+	})
+}
@@ -2,65 +2,295 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"./api"
+	"./bus"
+	"./metadata"
 	"./provider"
 	"./util"
 )
 
+// How often data servers announce themselves to API servers
+const registerInterval = 10 * time.Second
+
 func main() {
 	addr := flag.String("address", ":8030", "The server will listen on this address")
 	storage := flag.String("storage", "/data", "The storage path will be used to store files")
 	dps := flag.String("dps", "",
 		"The comma seperated ip address of data provider servers, e.g. \"localhost:8030,localhost:8031\"")
+	busKind := flag.String("bus", "sqs",
+		"The locate bus, one of \"sqs\", \"broker\" or \"memory\" (single process only)")
+	broker := flag.String("broker", "localhost:8040", "The address of locate bus broker, used by \"-bus=broker\"")
+	locate := flag.String("locate", api.LocateByBus,
+		"How API server locates objects, \"bus\" (query the locate bus) or \"http\" (ask every data server)")
+	meta := flag.String("metadata", "/data/metadata", "The path API server will use to store object metadata")
+	ec := flag.String("ec", "",
+		"Erasure code objects into data+parity shards across data servers, e.g. \"4+2\", disabled if empty")
+	replicas := flag.Int("replicas", 1, "The number of copies written for objects not erasure coded")
+	quorum := flag.Int("quorum", 0, "The number of copies that must be written for a PUT to succeed, a majority if 0")
+	heartbeat := flag.Duration("heartbeat", 5*time.Second,
+		"How often API server probes data servers, a data server is down after missing 3 probes")
+	scrubRate := flag.Int64("scrub-rate", 16<<20,
+		"The bytes per second data server reads when scrubbing objects for corruption, disabled if 0")
+	scrubInterval := flag.Duration("scrub-interval", 24*time.Hour, "The pause between scrub passes of data server")
+	apis := flag.String("api", "",
+		"The comma separated addresses of API servers data server registers with, e.g. \"localhost:8030\"")
+	advertise := flag.String("advertise", "", "The address API servers reach data server at, \"-address\" if empty")
+	placement := flag.String("placement", api.PlaceByFreeSpace,
+		"How API server selects data servers for new objects, \"random\", \"weighted\" (by free space), "+
+			"\"least-loaded\", \"p2c\" (the one with more free space of two picked randomly) "+
+			"or \"ring\" (consistent hash ring, objects are read from where they belong without locating them)")
+	vnodes := flag.Int("vnodes", 100, "The virtual nodes of each data server on consistent hash ring, used by \"-placement=ring\"")
+	uploadExpiry := flag.Duration("upload-expiry", 24*time.Hour,
+		"How long multipart uploads may stay incomplete before they are aborted, never if 0")
+	sessionExpiry := flag.Duration("session-expiry", 24*time.Hour,
+		"How long resumable upload sessions may stay unfinished before they are aborted, and staging files are kept, never if 0")
+	rebalanceRate := flag.Int64("rebalance-rate", 32<<20,
+		"The bytes per second API server copies when moving objects after data servers join or leave, disabled if 0")
+	repairRate := flag.Int64("repair-rate", 32<<20,
+		"The bytes per second API server copies when restoring objects lost with data servers down or corrupt, disabled if 0")
 	flag.Parse()
 
 	switch flag.Arg(0) {
 	case "dataserver":
-		startDataServer(*addr, *storage)
-	case "server":
-		startAPIServer(*addr, *dps)
+		var locateBus bus.LocateBus
+		if *locate == api.LocateByBus {
+			locateBus = newLocateBus(*busKind, *broker)
+		}
+		dataSrv := newDataServer(*addr, *advertise, *storage, locateBus)
+		if *apis != "" {
+			registerDataServer(dataSrv, util.ProcessIP(*apis))
+		}
+		startDataServer(*addr, dataSrv, locateBus != nil, *scrubRate, *scrubInterval, *sessionExpiry)
+	case "broker":
+		startBroker(*addr)
 	default:
-		startAPIServer(*addr, *dps)
+		config := api.Config{
+			DataProviders: util.ProcessIP(*dps),
+			LocateMode:    *locate,
+			Metadata:      newMetadataStore(*meta),
+			Replicas:      *replicas,
+			WriteQuorum:   *quorum,
+		}
+		config.HeartbeatInterval = *heartbeat
+		config.UploadExpiry = *uploadExpiry
+		config.SessionExpiry = *sessionExpiry
+		config.RebalanceRate = *rebalanceRate
+		config.RepairRate = *repairRate
+		if *placement == api.PlaceByRing {
+			config.RingVirtualNodes = *vnodes
+		} else {
+			config.Placement = newPlacementPolicy(*placement)
+		}
+		if *ec != "" {
+			_, err := fmt.Sscanf(*ec, "%d+%d", &config.DataShards, &config.ParityShards)
+			if err != nil || config.DataShards <= 0 || config.ParityShards < 0 {
+				log.Fatalf("Invalid erasure code setting %s, expecting \"<data shards>+<parity shards>\"", *ec)
+			}
+		}
+		if *locate == api.LocateByBus {
+			config.LocateBus = newLocateBus(*busKind, *broker)
+		}
+		startAPIServer(*addr, config)
 	}
 }
 
-func startAPIServer(addr string, dps string) {
+// Create the locate bus by kind, exits if the bus is unavailable
+func newLocateBus(kind string, broker string) bus.LocateBus {
+	var locateBus bus.LocateBus
+	var err error
+	switch kind {
+	case "sqs":
+		locateBus, err = bus.NewSQSBus()
+	case "broker":
+		log.Printf("Using locate bus broker %s", broker)
+		locateBus = bus.NewBrokerBus(broker)
+	case "memory":
+		locateBus = bus.NewMemoryBus()
+	default:
+		err = fmt.Errorf("unknown locate bus %s", kind)
+	}
+
+	if err != nil {
+		log.Printf("Unable to create locate bus, error: %s", err)
+		log.Fatal("Now exiting...")
+	}
+
+	return locateBus
+}
+
+// Create the placement policy by name, exits if there is no such policy
+func newPlacementPolicy(name string) api.PlacementPolicy {
+	placement, err := api.NewPlacementPolicy(name)
+	if err != nil {
+		log.Printf("Unable to create placement policy, error: %s", err)
+		log.Fatal("Now exiting...")
+	}
+
+	return placement
+}
+
+// Open the metadata store at path, exits if the store is unavailable
+func newMetadataStore(path string) metadata.Store {
+	store, err := metadata.NewDiskStore(path)
+	if err != nil {
+		log.Printf("Unable to open metadata store %s, error: %s", path, err)
+		log.Fatal("Now exiting...")
+	}
+
+	return store
+}
+
+func startAPIServer(addr string, config api.Config) {
 	log.Printf("Starting API server on %s", addr)
-	dpList := util.ProcessIP(dps)
-	log.Printf("Data provider servers: %s", dpList)
+	log.Printf("Data provider servers: %s", config.DataProviders)
 
 	// We initialize the API server with data providers
-	apiSrv := api.NewServer(dpList)
+	apiSrv := api.NewServer(config)
 
 	// Routers
 	router := httprouter.New()
-	router.GET("/", apiSrv.Index)                  // Index, returns the server version, status
-	router.GET("/objects/:name", apiSrv.GetObject) // RESTful API, get object by name
-	router.PUT("/objects/:name", apiSrv.PutObject) // RESTful API, put object by name
+	router.GET("/", apiSrv.Index)                        // Index, returns the server version, status
+	router.GET("/objects", apiSrv.ListObjects)           // RESTful API, list objects
+	router.GET("/objects/:name", apiSrv.GetObject)       // RESTful API, get object by name
+	router.HEAD("/objects/:name", apiSrv.HeadObject)     // RESTful API, get object headers by name
+	router.PUT("/objects/:name", apiSrv.PutObject)       // RESTful API, put object by name
+	router.DELETE("/objects/:name", apiSrv.DeleteObject) // RESTful API, delete object by name
+	router.GET("/versions/:name", apiSrv.ListVersions)   // RESTful API, list versions of object by name
+
+	// Buckets, objects of a bucket are isolated from objects outside it and of other buckets
+	router.GET("/buckets", apiSrv.ListBuckets)                          // List buckets
+	router.PUT("/buckets/:bucket", apiSrv.CreateBucket)                 // Create bucket
+	router.DELETE("/buckets/:bucket", apiSrv.DeleteBucket)              // Delete bucket, if empty
+	router.GET("/buckets/:bucket", apiSrv.ListObjects)                  // List objects of bucket
+	router.GET("/buckets/:bucket/objects/*key", apiSrv.GetObject)       // Get object by key
+	router.HEAD("/buckets/:bucket/objects/*key", apiSrv.HeadObject)     // Get object headers by key
+	router.PUT("/buckets/:bucket/objects/*key", apiSrv.PutObject)       // Put object by key
+	router.DELETE("/buckets/:bucket/objects/*key", apiSrv.DeleteObject) // Delete object by key
+	router.GET("/buckets/:bucket/versions/*key", apiSrv.ListVersions)   // List versions of object by key
+
+	// Multipart upload
+	router.POST("/uploads", apiSrv.CreateUpload)              // Initiate upload, object name in query "name"
+	router.PUT("/uploads/:id/parts/:part", apiSrv.UploadPart) // Upload part by number
+	router.GET("/uploads/:id", apiSrv.ListParts)              // List uploaded parts
+	router.POST("/uploads/:id", apiSrv.CompleteUpload)        // Complete upload with manifest
+	router.DELETE("/uploads/:id", apiSrv.AbortUpload)         // Abort upload
+
+	// Data provider servers
+	router.GET("/providers", apiSrv.ListDataProviders)             // List data servers
+	router.POST("/providers", apiSrv.RegisterDataProvider)         // Register data server
+	router.DELETE("/providers/:id", apiSrv.DeregisterDataProvider) // Deregister data server
+	router.POST("/providers/:id/drain", apiSrv.DrainDataProvider)  // Drain and decommission data server
+	router.GET("/providers/:id/drain", apiSrv.GetDrainStatus)      // Draining progress
+
+	// Admin
+	router.GET("/admin/rebalance", apiSrv.GetRebalanceStatus) // Rebalancer progress
+	router.POST("/admin/rebalance", apiSrv.StartRebalance)    // Start a rebalance pass now
+	router.GET("/admin/repair", apiSrv.GetRepairStatus)       // Repairer progress
+	router.POST("/admin/repair", apiSrv.StartRepair)          // Start a repair pass now
+
+	// Resumable upload
+	router.POST("/resumable", apiSrv.CreateSession)      // Create session, object name in query "name"
+	router.HEAD("/resumable/:id", apiSrv.HeadSession)    // Get committed offset
+	router.PATCH("/resumable/:id", apiSrv.PatchSession)  // Append chunk at offset
+	router.POST("/resumable/:id", apiSrv.FinishSession)  // Finish session with Digest header
+	router.DELETE("/resumable/:id", apiSrv.AbortSession) // Abort session
 
 	// Start serving
 	log.Fatal(http.ListenAndServe(addr, router))
 }
 
-func startDataServer(addr string, storage string) {
+// Create data provider server listening on addr, reached by API servers at advertise
+func newDataServer(addr string, advertise string, storage string, locateBus bus.LocateBus) *provider.DataProviderServer {
 	log.Printf("Starting data provider server on %s, storage root: %s", addr, storage)
+	if advertise == "" {
+		advertise = addr
+	}
 
 	// We initialize the data server with addr and storage
-	dataSrv := provider.NewServer(addr, storage)
+	return provider.NewServer(advertise, storage, locateBus)
+}
+
+// Register data server with API servers at apis, it deregisters when the process is
+// interrupted or terminated
+func registerDataServer(dataSrv *provider.DataProviderServer, apis []string) {
+	dataSrv.StartRegistration(apis, registerInterval)
 
-	// Listen to the object location query queue
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		dataSrv.ListenToObjectLocateQueue()
+		<-signals
+		dataSrv.Deregister()
+		os.Exit(0)
 	}()
+}
+
+func startDataServer(addr string, dataSrv *provider.DataProviderServer, listenToLocateQueue bool,
+	scrubRate int64, scrubInterval time.Duration, stagingExpiry time.Duration) {
+	// Listen to the object location query queue, not needed when objects are located by HTTP
+	if listenToLocateQueue {
+		go func() {
+			dataSrv.ListenToObjectLocateQueue()
+		}()
+	}
+
+	// Scrub objects for corruption in the background
+	if scrubRate > 0 {
+		dataSrv.StartScrubber(scrubRate, scrubInterval)
+	}
+
+	// Remove staging files of sessions long expired
+	if stagingExpiry > 0 {
+		dataSrv.StartStagingSweeper(stagingExpiry)
+	}
+
+	// Routers
+	router := httprouter.New()
+	router.GET("/objects/:name", dataSrv.GetObject)       // RESTful API, get object by name
+	router.HEAD("/objects/:name", dataSrv.HeadObject)     // RESTful API, get object headers by name
+	router.PUT("/objects/:name", dataSrv.PutObject)       // RESTful API, put object by name
+	router.DELETE("/objects/:name", dataSrv.DeleteObject) // RESTful API, delete object by name
+
+	// Objects of buckets, kept in a folder per bucket
+	router.GET("/buckets/:bucket/objects/:name", dataSrv.GetObject)
+	router.HEAD("/buckets/:bucket/objects/:name", dataSrv.HeadObject)
+	router.PUT("/buckets/:bucket/objects/:name", dataSrv.PutObject)
+	router.DELETE("/buckets/:bucket/objects/:name", dataSrv.DeleteObject)
+
+	// Staging files of resumable uploads
+	router.POST("/staging/:id", dataSrv.CreateStaging)   // Create empty staging file
+	router.HEAD("/staging/:id", dataSrv.HeadStaging)     // Get committed offset
+	router.PATCH("/staging/:id", dataSrv.PatchStaging)   // Append chunk at offset
+	router.GET("/staging/:id", dataSrv.GetStaging)       // Get staged content
+	router.DELETE("/staging/:id", dataSrv.DeleteStaging) // Delete staging file
+
+	// Admin
+	router.GET("/status", dataSrv.GetStatus)           // Capacity and load, probed by API servers
+	router.PUT("/state", dataSrv.PutState)             // Set state, by API servers draining it
+	router.GET("/admin/scrub", dataSrv.GetScrubStatus) // Scrubber progress and findings
+	router.POST("/admin/scrub", dataSrv.StartScrub)    // Start a scrub pass now
+
+	// Start serving
+	log.Fatal(http.ListenAndServe(addr, dataSrv.TrackLoad(router)))
+}
+
+func startBroker(addr string) {
+	log.Printf("Starting locate bus broker on %s", addr)
+
+	broker := bus.NewBroker()
 
 	// Routers
 	router := httprouter.New()
-	router.GET("/objects/:name", dataSrv.GetObject) // RESTful API, get object by name
-	router.PUT("/objects/:name", dataSrv.PutObject) // RESTful API, put object by name
+	router.GET("/topics/:topic", broker.Subscribe) // Stream messages of topic
+	router.POST("/topics/:topic", broker.Publish)  // Publish message to topic
 
 	// Start serving
 	log.Fatal(http.ListenAndServe(addr, router))
@@ -0,0 +1,913 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskStore is an embedded Store, versions of each object are kept in one JSON file
+// under the store root, and all records are cached in memory. Objects of a bucket are
+// kept under "buckets/<bucket>", next to the bucket file "buckets/<bucket>.json".
+// Uploads are kept in "uploads/<upload ID>.json", sessions in "sessions/<session ID>.json",
+// orphans in "system/orphans.json" and the last version number assigned in "system/sequence"
+type DiskStore struct {
+	// Store root path
+	root string
+
+	// Versions by bucket and object name, oldest first
+	objects map[string]map[string][]Record
+
+	// Buckets by name
+	buckets map[string]Bucket
+
+	// Uploads in progress by ID
+	uploads map[string]Upload
+
+	// Sessions in progress by ID
+	sessions map[string]Session
+
+	// Objects left on data provider servers
+	orphans []Orphan
+
+	// The last version number assigned, versions are numbered across all objects so
+	// numbers of deleted versions are never assigned again
+	sequence int64
+
+	// mutex on objects, buckets, uploads, sessions, orphans, sequence and files
+	mutex sync.RWMutex
+}
+
+// Open the DiskStore at root, creates root if it does not exist
+func NewDiskStore(root string) (*DiskStore, error) {
+	for _, folder := range []string{"buckets", "uploads", "sessions", "system"} {
+		err := os.MkdirAll(filepath.Join(root, folder), os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	store := &DiskStore{
+		root:     root,
+		objects:  map[string]map[string][]Record{},
+		buckets:  map[string]Bucket{},
+		uploads:  map[string]Upload{},
+		sessions: map[string]Session{},
+	}
+
+	err := store.load("")
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "buckets"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(root, "buckets", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var bucket Bucket
+		err = json.Unmarshal(data, &bucket)
+		if err != nil {
+			log.Printf("Skipping corrupted bucket file %s, error: %s", f.Name(), err)
+			continue
+		}
+
+		store.buckets[bucket.Name] = bucket
+		err = store.load(bucket.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = store.loadUploads()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.loadSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(store.orphansFile())
+	if err == nil {
+		err = json.Unmarshal(data, &store.orphans)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = store.loadSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	for _, objects := range store.objects {
+		count += len(objects)
+	}
+	log.Printf("Loaded metadata of %d buckets, %d objects, %d uploads, %d sessions from %s",
+		len(store.buckets), count, len(store.uploads), len(store.sessions), root)
+	return store, nil
+}
+
+// Load metadata files of objects in bucket
+func (d *DiskStore) load(bucket string) error {
+	files, err := ioutil.ReadDir(d.bucketDir(bucket))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	objects := map[string][]Record{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(d.bucketDir(bucket), f.Name()))
+		if err != nil {
+			return err
+		}
+
+		var versions []Record
+		err = json.Unmarshal(data, &versions)
+		if err != nil {
+			log.Printf("Skipping corrupted metadata file %s, error: %s", f.Name(), err)
+			continue
+		}
+
+		if len(versions) == 0 {
+			continue
+		}
+
+		// the folder of objects outside buckets is the store root, files of anything else
+		// found there are not records
+		if filepath.Base(d.fileName(bucket, versions[0].Name)) != f.Name() {
+			log.Printf("Skipping metadata file %s, not holding object versions", f.Name())
+			continue
+		}
+		objects[versions[0].Name] = versions
+	}
+
+	if len(objects) > 0 {
+		d.objects[bucket] = objects
+	}
+	return nil
+}
+
+// Load upload files
+func (d *DiskStore) loadUploads() error {
+	files, err := ioutil.ReadDir(filepath.Join(d.root, "uploads"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(d.root, "uploads", f.Name()))
+		if err != nil {
+			return err
+		}
+
+		var u Upload
+		err = json.Unmarshal(data, &u)
+		if err != nil {
+			log.Printf("Skipping corrupted upload file %s, error: %s", f.Name(), err)
+			continue
+		}
+		d.uploads[u.Id] = u
+	}
+	return nil
+}
+
+// Load session files
+func (d *DiskStore) loadSessions() error {
+	files, err := ioutil.ReadDir(filepath.Join(d.root, "sessions"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(d.root, "sessions", f.Name()))
+		if err != nil {
+			return err
+		}
+
+		var sess Session
+		err = json.Unmarshal(data, &sess)
+		if err != nil {
+			log.Printf("Skipping corrupted session file %s, error: %s", f.Name(), err)
+			continue
+		}
+		d.sessions[sess.Id] = sess
+	}
+	return nil
+}
+
+func (d *DiskStore) PutVersion(rec Record) (Record, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.putVersion(rec)
+}
+
+// Store rec as the latest version of its object, the caller holds mutex
+func (d *DiskStore) putVersion(rec Record) (Record, error) {
+	if _, ok := d.buckets[rec.Bucket]; rec.Bucket != "" && !ok {
+		return Record{}, ErrNotFound
+	}
+
+	// the sequence is saved first, so a number is never assigned twice even if saving the
+	// version fails
+	err := d.saveSequence(d.sequence + 1)
+	if err != nil {
+		return Record{}, err
+	}
+	d.sequence++
+
+	versions := d.objects[rec.Bucket][rec.Name]
+	rec.Version = d.sequence
+	if rec.Created.IsZero() {
+		rec.Created = time.Now().UTC()
+	}
+
+	updated := append(versions[:len(versions):len(versions)], rec)
+	err = d.save(rec.Bucket, rec.Name, updated)
+	if err != nil {
+		return Record{}, err
+	}
+
+	d.setVersions(rec.Bucket, rec.Name, updated)
+	return rec, nil
+}
+
+func (d *DiskStore) Get(bucket string, name string) (Record, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	versions := d.objects[bucket][name]
+	if len(versions) == 0 {
+		return Record{}, ErrNotFound
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+func (d *DiskStore) GetVersion(bucket string, name string, version int64) (Record, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	for _, rec := range d.objects[bucket][name] {
+		if rec.Version == version {
+			return rec, nil
+		}
+	}
+
+	return Record{}, ErrNotFound
+}
+
+func (d *DiskStore) Versions(bucket string, name string) ([]Record, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	versions := d.objects[bucket][name]
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return append([]Record(nil), versions...), nil
+}
+
+func (d *DiskStore) FindContent(bucket string, hash string) (Content, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	for _, versions := range d.objects[bucket] {
+		for i := len(versions) - 1; i >= 0; i-- {
+			for _, content := range versions[i].Contents() {
+				if content.Hash == hash {
+					return content, nil
+				}
+			}
+		}
+	}
+
+	for _, u := range d.uploads {
+		for _, part := range u.Parts {
+			if part.Bucket == bucket && part.Hash == hash {
+				return part.Content, nil
+			}
+		}
+	}
+
+	return Content{}, ErrNotFound
+}
+
+func (d *DiskStore) Contents() ([]Content, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	contents := make([]Content, 0)
+	seen := map[string]bool{}
+	for _, objects := range d.objects {
+		for _, versions := range objects {
+			for i := len(versions) - 1; i >= 0; i-- {
+				for _, content := range versions[i].Contents() {
+					if !seen[content.Bucket+"/"+content.Hash] {
+						seen[content.Bucket+"/"+content.Hash] = true
+						contents = append(contents, content)
+					}
+				}
+			}
+		}
+	}
+
+	for _, u := range d.uploads {
+		for _, part := range u.Parts {
+			if !seen[part.Bucket+"/"+part.Hash] {
+				seen[part.Bucket+"/"+part.Hash] = true
+				contents = append(contents, part.Content)
+			}
+		}
+	}
+
+	return contents, nil
+}
+
+func (d *DiskStore) UpdateLocations(bucket string, hash string, old []string, locations []string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	found := false
+	for _, versions := range d.objects[bucket] {
+		for _, rec := range versions {
+			for _, current := range rec.locationsOf(hash) {
+				if !equalAddrs(current, old) {
+					return ErrConflict
+				}
+				found = true
+			}
+		}
+	}
+	for _, u := range d.uploads {
+		for _, part := range u.Parts {
+			if part.Bucket == bucket && part.Hash == hash {
+				if !equalAddrs(part.Locations, old) {
+					return ErrConflict
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+
+	for name, versions := range d.objects[bucket] {
+		var updated []Record
+		for i, rec := range versions {
+			if !rec.setLocations(hash, locations) {
+				continue
+			}
+
+			if updated == nil {
+				updated = append([]Record(nil), versions...)
+			}
+			updated[i] = rec
+		}
+
+		if updated == nil {
+			continue
+		}
+
+		err := d.save(bucket, name, updated)
+		if err != nil {
+			return err
+		}
+		d.objects[bucket][name] = updated
+	}
+
+	for id, u := range d.uploads {
+		parts := append([]Part(nil), u.Parts...)
+		found := false
+		for i := range parts {
+			if parts[i].Bucket == bucket && parts[i].Hash == hash {
+				parts[i].Locations = locations
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+
+		u.Parts = parts
+		err := d.saveUpload(u)
+		if err != nil {
+			return err
+		}
+		d.uploads[id] = u
+	}
+
+	return nil
+}
+
+func (d *DiskStore) DeleteVersion(bucket string, name string, version int64) (Record, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	versions := d.objects[bucket][name]
+	for i, rec := range versions {
+		if rec.Version != version {
+			continue
+		}
+
+		updated := append(append([]Record(nil), versions[:i]...), versions[i+1:]...)
+		var err error
+		if len(updated) == 0 {
+			err = os.Remove(d.fileName(bucket, name))
+		} else {
+			err = d.save(bucket, name, updated)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return Record{}, err
+		}
+
+		d.setVersions(bucket, name, updated)
+		return rec, nil
+	}
+
+	return Record{}, ErrNotFound
+}
+
+func (d *DiskStore) List(bucket string, prefix string, marker string) ([]Record, error) {
+	d.mutex.RLock()
+	records := make([]Record, 0)
+	for name, versions := range d.objects[bucket] {
+		latest := versions[len(versions)-1]
+		if strings.HasPrefix(name, prefix) && name > marker && !latest.DeleteMarker {
+			records = append(records, latest)
+		}
+	}
+	d.mutex.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+	return records, nil
+}
+
+func (d *DiskStore) CreateBucket(name string) (Bucket, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.buckets[name]; ok {
+		return Bucket{}, ErrBucketExists
+	}
+
+	bucket := Bucket{Name: name, Created: time.Now().UTC()}
+	err := os.MkdirAll(d.bucketDir(name), os.ModePerm)
+	if err != nil {
+		return Bucket{}, err
+	}
+
+	// the bucket exists once its file does
+	err = writeFile(d.bucketDir(name)+".json", bucket)
+	if err != nil {
+		return Bucket{}, err
+	}
+
+	d.buckets[name] = bucket
+	return bucket, nil
+}
+
+func (d *DiskStore) GetBucket(name string) (Bucket, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	bucket, ok := d.buckets[name]
+	if !ok {
+		return Bucket{}, ErrNotFound
+	}
+	return bucket, nil
+}
+
+func (d *DiskStore) Buckets() ([]Bucket, error) {
+	d.mutex.RLock()
+	buckets := make([]Bucket, 0, len(d.buckets))
+	for _, bucket := range d.buckets {
+		buckets = append(buckets, bucket)
+	}
+	d.mutex.RUnlock()
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	return buckets, nil
+}
+
+func (d *DiskStore) DeleteBucket(name string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.buckets[name]; !ok {
+		return ErrNotFound
+	}
+	if len(d.objects[name]) > 0 {
+		return ErrBucketNotEmpty
+	}
+	for _, u := range d.uploads {
+		if u.Bucket == name {
+			return ErrBucketNotEmpty
+		}
+	}
+	for _, sess := range d.sessions {
+		if sess.Bucket == name {
+			return ErrBucketNotEmpty
+		}
+	}
+
+	err := os.Remove(d.bucketDir(name) + ".json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(d.bucketDir(name))
+
+	delete(d.buckets, name)
+	return nil
+}
+
+func (d *DiskStore) CreateUpload(u Upload) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.buckets[u.Bucket]; u.Bucket != "" && !ok {
+		return ErrNotFound
+	}
+	if u.Parts == nil {
+		u.Parts = []Part{}
+	}
+
+	err := d.saveUpload(u)
+	if err != nil {
+		return err
+	}
+	d.uploads[u.Id] = u
+	return nil
+}
+
+func (d *DiskStore) GetUpload(id string) (Upload, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	u, ok := d.uploads[id]
+	if !ok {
+		return Upload{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (d *DiskStore) Uploads() ([]Upload, error) {
+	d.mutex.RLock()
+	uploads := make([]Upload, 0, len(d.uploads))
+	for _, u := range d.uploads {
+		uploads = append(uploads, u)
+	}
+	d.mutex.RUnlock()
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Created.Before(uploads[j].Created)
+	})
+	return uploads, nil
+}
+
+func (d *DiskStore) PutPart(id string, part Part) (Upload, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	old, ok := d.uploads[id]
+	if !ok {
+		return Upload{}, ErrNotFound
+	}
+
+	u := old
+	u.Parts = make([]Part, 0, len(old.Parts)+1)
+	for _, p := range old.Parts {
+		if p.Number < part.Number {
+			u.Parts = append(u.Parts, p)
+		}
+	}
+	u.Parts = append(u.Parts, part)
+	for _, p := range old.Parts {
+		if p.Number > part.Number {
+			u.Parts = append(u.Parts, p)
+		}
+	}
+
+	err := d.saveUpload(u)
+	if err != nil {
+		return Upload{}, err
+	}
+	d.uploads[id] = u
+	return old, nil
+}
+
+func (d *DiskStore) CompleteUpload(id string, rec Record) (Record, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	u, ok := d.uploads[id]
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+
+	// parts are taken from the upload, their content may have moved since rec was made
+	parts := map[int]Part{}
+	for _, part := range u.Parts {
+		parts[part.Number] = part
+	}
+	rec.Parts = append([]Part(nil), rec.Parts...)
+	for i, part := range rec.Parts {
+		if parts[part.Number].Hash != part.Hash {
+			return Record{}, ErrConflict
+		}
+		rec.Parts[i] = parts[part.Number]
+	}
+
+	rec, err := d.putVersion(rec)
+	if err != nil {
+		return Record{}, err
+	}
+
+	err = os.Remove(d.uploadFile(id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove completed upload file %s, error: %s", id, err)
+	}
+	delete(d.uploads, id)
+	return rec, nil
+}
+
+func (d *DiskStore) DeleteUpload(id string) (Upload, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	u, ok := d.uploads[id]
+	if !ok {
+		return Upload{}, ErrNotFound
+	}
+
+	err := os.Remove(d.uploadFile(id))
+	if err != nil && !os.IsNotExist(err) {
+		return Upload{}, err
+	}
+	delete(d.uploads, id)
+	return u, nil
+}
+
+func (d *DiskStore) CreateSession(sess Session) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.buckets[sess.Bucket]; sess.Bucket != "" && !ok {
+		return ErrNotFound
+	}
+
+	err := writeFile(d.sessionFile(sess.Id), sess)
+	if err != nil {
+		return err
+	}
+	d.sessions[sess.Id] = sess
+	return nil
+}
+
+func (d *DiskStore) GetSession(id string) (Session, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	sess, ok := d.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return sess, nil
+}
+
+func (d *DiskStore) Sessions() ([]Session, error) {
+	d.mutex.RLock()
+	sessions := make([]Session, 0, len(d.sessions))
+	for _, sess := range d.sessions {
+		sessions = append(sessions, sess)
+	}
+	d.mutex.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
+
+func (d *DiskStore) DeleteSession(id string) (Session, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	sess, ok := d.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+
+	err := os.Remove(d.sessionFile(id))
+	if err != nil && !os.IsNotExist(err) {
+		return Session{}, err
+	}
+	delete(d.sessions, id)
+	return sess, nil
+}
+
+func (d *DiskStore) PutOrphans(orphans []Orphan) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	updated := append([]Orphan(nil), d.orphans...)
+	for _, orphan := range orphans {
+		if !containsOrphan(updated, orphan) {
+			updated = append(updated, orphan)
+		}
+	}
+
+	err := writeFile(d.orphansFile(), updated)
+	if err != nil {
+		return err
+	}
+	d.orphans = updated
+	return nil
+}
+
+func (d *DiskStore) Orphans() ([]Orphan, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return append([]Orphan(nil), d.orphans...), nil
+}
+
+func (d *DiskStore) DeleteOrphan(orphan Orphan) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	updated := make([]Orphan, 0, len(d.orphans))
+	for _, o := range d.orphans {
+		if o != orphan {
+			updated = append(updated, o)
+		}
+	}
+	if len(updated) == len(d.orphans) {
+		return ErrNotFound
+	}
+
+	err := writeFile(d.orphansFile(), updated)
+	if err != nil {
+		return err
+	}
+	d.orphans = updated
+	return nil
+}
+
+// Determines if orphans holds orphan
+func containsOrphan(orphans []Orphan, orphan Orphan) bool {
+	for _, o := range orphans {
+		if o == orphan {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace cached versions of object, an object without versions is removed
+func (d *DiskStore) setVersions(bucket string, name string, versions []Record) {
+	if len(versions) == 0 {
+		delete(d.objects[bucket], name)
+		if len(d.objects[bucket]) == 0 {
+			delete(d.objects, bucket)
+		}
+		return
+	}
+
+	if d.objects[bucket] == nil {
+		d.objects[bucket] = map[string][]Record{}
+	}
+	d.objects[bucket][name] = versions
+}
+
+// Get the folder holding metadata files of objects in bucket, the store root for
+// objects outside buckets
+func (d *DiskStore) bucketDir(bucket string) string {
+	if bucket == "" {
+		return d.root
+	}
+	return filepath.Join(d.root, "buckets", bucket)
+}
+
+// Get metadata file name of object, object names are hashed since they may
+// contain characters not allowed in file names
+func (d *DiskStore) fileName(bucket string, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(d.bucketDir(bucket), hex.EncodeToString(sum[:])+".json")
+}
+
+// Get the file upload by ID is kept in
+func (d *DiskStore) uploadFile(id string) string {
+	return filepath.Join(d.root, "uploads", id+".json")
+}
+
+// Write upload to its file
+func (d *DiskStore) saveUpload(u Upload) error {
+	return writeFile(d.uploadFile(u.Id), u)
+}
+
+// Get the file session by ID is kept in
+func (d *DiskStore) sessionFile(id string) string {
+	return filepath.Join(d.root, "sessions", id+".json")
+}
+
+// Get the file the last version number assigned is kept in
+func (d *DiskStore) sequenceFile() string {
+	return filepath.Join(d.root, "system", "sequence")
+}
+
+// Load the last version number assigned, stores written before it was kept resume from
+// the highest version number of any object
+func (d *DiskStore) loadSequence() error {
+	data, err := ioutil.ReadFile(d.sequenceFile())
+	if err == nil {
+		err = json.Unmarshal(data, &d.sequence)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, objects := range d.objects {
+		for _, versions := range objects {
+			for _, rec := range versions {
+				if rec.Version > d.sequence {
+					d.sequence = rec.Version
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Write the last version number assigned to its file
+func (d *DiskStore) saveSequence(sequence int64) error {
+	return writeFile(d.sequenceFile(), sequence)
+}
+
+// Get the file orphans are kept in
+func (d *DiskStore) orphansFile() string {
+	return filepath.Join(d.root, "system", "orphans.json")
+}
+
+// Write versions of object to its metadata file
+func (d *DiskStore) save(bucket string, name string, versions []Record) error {
+	return writeFile(d.fileName(bucket, name), versions)
+}
+
+// Write v as JSON to fileName, the file is replaced atomically
+func writeFile(fileName string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := fileName + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fileName)
+}
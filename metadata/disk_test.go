@@ -0,0 +1,441 @@
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Open a DiskStore in a temporary folder
+func newTestStore(t *testing.T) (*DiskStore, string) {
+	root := t.TempDir()
+	store, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, root
+}
+
+// Returns a record of object name holding content by hash at locations
+func newRecord(name string, hash string, locations ...string) Record {
+	return Record{Name: name, Content: Content{Size: 1, Hash: hash, Locations: locations}}
+}
+
+func TestPutVersionAndGet(t *testing.T) {
+	store, _ := newTestStore(t)
+	v1, err := store.PutVersion(newRecord("obj", "h1", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := store.PutVersion(newRecord("obj", "h2", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.Version <= v1.Version {
+		t.Errorf("version %d after version %d", v2.Version, v1.Version)
+	}
+	if v1.Created.IsZero() {
+		t.Error("creation time not set")
+	}
+
+	latest, err := store.Get("", "obj")
+	if err != nil || latest.Hash != "h2" {
+		t.Errorf("latest is %v, error: %v", latest, err)
+	}
+	old, err := store.GetVersion("", "obj", v1.Version)
+	if err != nil || old.Hash != "h1" {
+		t.Errorf("version %d is %v, error: %v", v1.Version, old, err)
+	}
+
+	versions, err := store.Versions("", "obj")
+	if err != nil || len(versions) != 2 || versions[0].Version != v1.Version {
+		t.Errorf("versions are %v, error: %v", versions, err)
+	}
+
+	if _, err := store.Get("", "missing"); err != ErrNotFound {
+		t.Errorf("got %v for missing object", err)
+	}
+	if _, err := store.GetVersion("", "obj", 3); err != ErrNotFound {
+		t.Errorf("got %v for missing version", err)
+	}
+}
+
+func TestRecordsSurviveReopen(t *testing.T) {
+	store, root := newTestStore(t)
+	store.PutVersion(newRecord("a/b c", "h1", "a", "b"))
+	store.PutVersion(newRecord("a/b c", "h2", "b"))
+
+	reopened, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := reopened.Versions("", "a/b c")
+	if err != nil || len(versions) != 2 || versions[1].Hash != "h2" || len(versions[0].Locations) != 2 {
+		t.Errorf("versions after reopening are %v, error: %v", versions, err)
+	}
+
+	v3, _ := reopened.PutVersion(newRecord("a/b c", "h3"))
+	if v3.Version != 3 {
+		t.Errorf("version %d assigned after reopening", v3.Version)
+	}
+}
+
+func TestVersionIdsAreNeverReused(t *testing.T) {
+	store, root := newTestStore(t)
+	v1, _ := store.PutVersion(newRecord("obj", "h1"))
+	v2, _ := store.PutVersion(newRecord("obj", "h2"))
+	store.PutVersion(newRecord("other", "h1"))
+
+	// deleting the latest versions, then all of them, does not free their numbers
+	if _, err := store.DeleteVersion("", "obj", v2.Version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DeleteVersion("", "obj", v2.Version); err != ErrNotFound {
+		t.Errorf("deleting deleted version returned %v", err)
+	}
+	v3, _ := store.PutVersion(newRecord("obj", "h3"))
+	if v3.Version <= v2.Version {
+		t.Errorf("version %d assigned after deleted version %d", v3.Version, v2.Version)
+	}
+
+	store.DeleteVersion("", "obj", v1.Version)
+	store.DeleteVersion("", "obj", v3.Version)
+	if _, err := store.Get("", "obj"); err != ErrNotFound {
+		t.Errorf("got %v for object with all versions deleted", err)
+	}
+	if content, err := store.FindContent("", "h2"); err != ErrNotFound {
+		t.Errorf("found content %v of deleted version, error: %v", content, err)
+	}
+	if _, err := store.FindContent("", "h1"); err != nil {
+		t.Errorf("content shared with other object not found, error: %v", err)
+	}
+
+	reopened, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Get("", "obj"); err != ErrNotFound {
+		t.Errorf("deleted object found after reopening, error: %v", err)
+	}
+	v4, _ := reopened.PutVersion(newRecord("obj", "h4"))
+	if v4.Version <= v3.Version {
+		t.Errorf("version %d assigned after reopening, last was %d", v4.Version, v3.Version)
+	}
+	if _, err := os.Stat(filepath.Join(root, "system", "sequence")); err != nil {
+		t.Errorf("sequence not kept in system folder, error: %v", err)
+	}
+}
+
+func TestOrphansAreNotObjectsAfterReopen(t *testing.T) {
+	store, root := newTestStore(t)
+	store.PutVersion(newRecord("obj", "h1", "a"))
+	orphans := []Orphan{{Addr: "a", Hash: "h2", Path: "/objects/h2"}, {Addr: "b", Hash: "h2", Path: "/objects/h2"}}
+	if err := store.PutOrphans(append(orphans, orphans[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file of anything else in the store root
+	stray, _ := json.Marshal([]Record{newRecord("stray", "h3")})
+	if err := ioutil.WriteFile(filepath.Join(root, "stray.json"), stray, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := reopened.FindContent("", "h2"); err != ErrNotFound {
+		t.Errorf("found content %v of orphans, error: %v", content, err)
+	}
+	if rec, err := reopened.Get("", "stray"); err != ErrNotFound {
+		t.Errorf("found stray object %v, error: %v", rec, err)
+	}
+	if _, err := reopened.Get("", "obj"); err != nil {
+		t.Errorf("object lost after reopening, error: %v", err)
+	}
+
+	left, err := reopened.Orphans()
+	if err != nil || len(left) != 2 || left[0] != orphans[0] || left[1] != orphans[1] {
+		t.Errorf("orphans after reopening are %v, error: %v", left, err)
+	}
+	if err := reopened.DeleteOrphan(orphans[0]); err != nil {
+		t.Error(err)
+	}
+	if err := reopened.DeleteOrphan(orphans[0]); err != ErrNotFound {
+		t.Errorf("deleting deleted orphan returned %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	store, _ := newTestStore(t)
+	for _, name := range []string{"b/2", "a", "b/1", "c"} {
+		store.PutVersion(newRecord(name, "h1"))
+	}
+	store.PutVersion(newRecord("b/1", "h2"))
+
+	// objects whose latest version is a delete marker are left out
+	store.PutVersion(Record{Name: "c", DeleteMarker: true})
+
+	for _, tc := range []struct {
+		prefix string
+		marker string
+		want   []string
+	}{
+		{"", "", []string{"a", "b/1", "b/2"}},
+		{"b/", "", []string{"b/1", "b/2"}},
+		{"", "a", []string{"b/1", "b/2"}},
+		{"b/", "b/1", []string{"b/2"}},
+		{"d", "", []string{}},
+	} {
+		records, err := store.List("", tc.prefix, tc.marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, rec := range records {
+			names = append(names, rec.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("listing %q after %q is %v, want %v", tc.prefix, tc.marker, names, tc.want)
+		}
+	}
+
+	// the latest version is listed
+	records, _ := store.List("", "b/1", "")
+	if len(records) != 1 || records[0].Hash != "h2" {
+		t.Errorf("listed %v", records)
+	}
+}
+
+// Create a part numbered number of content with hash
+func TestContentsAndUpdateLocations(t *testing.T) {
+	store, _ := newTestStore(t)
+	store.PutVersion(newRecord("obj1", "h1", "a", "b"))
+	store.PutVersion(newRecord("obj2", "h1", "a", "b"))
+	store.CreateUpload(Upload{Id: "u1", Name: "big"})
+	store.PutPart("u1", Part{Number: 1, Content: Content{Size: 1, Hash: "h1", Locations: []string{"a", "b"}}})
+	store.PutPart("u1", Part{Number: 2, Content: Content{Size: 1, Hash: "h2", Locations: []string{"c"}}})
+
+	contents, err := store.Contents()
+	if err != nil || len(contents) != 2 {
+		t.Fatalf("contents are %v, error: %v", contents, err)
+	}
+
+	err = store.UpdateLocations("", "h1", []string{"a", "c"}, []string{"c", "d"})
+	if err != ErrConflict {
+		t.Errorf("updated locations from stale ones, error: %v", err)
+	}
+	err = store.UpdateLocations("", "h3", nil, []string{"c"})
+	if err != ErrNotFound {
+		t.Errorf("updated locations of missing content, error: %v", err)
+	}
+
+	err = store.UpdateLocations("", "h1", []string{"a", "b"}, []string{"c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"obj1", "obj2"} {
+		rec, _ := store.Get("", name)
+		if len(rec.Locations) != 2 || rec.Locations[0] != "c" || rec.Locations[1] != "d" {
+			t.Errorf("locations of %s are %v", name, rec.Locations)
+		}
+	}
+	u, _ := store.GetUpload("u1")
+	if u.Parts[0].Locations[0] != "c" || u.Parts[1].Locations[0] != "c" {
+		t.Errorf("locations of upload parts are %v, %v", u.Parts[0].Locations, u.Parts[1].Locations)
+	}
+}
+
+func newPart(number int, hash string) Part {
+	return Part{Number: number, Content: Content{Size: 1, Hash: hash, Locations: []string{"a"}}}
+}
+
+func TestUploadsSurviveReopen(t *testing.T) {
+	store, root := newTestStore(t)
+	store.CreateUpload(Upload{Id: "u1", Name: "big"})
+	store.PutPart("u1", newPart(2, "h2"))
+	store.PutPart("u1", newPart(1, "h1"))
+	if _, err := store.PutPart("missing", newPart(1, "h1")); err != ErrNotFound {
+		t.Errorf("put part of missing upload, error: %v", err)
+	}
+
+	reopened, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, _ := reopened.Uploads()
+	if len(uploads) != 1 || uploads[0].Name != "big" || len(uploads[0].Parts) != 2 ||
+		uploads[0].Parts[0].Number != 1 || uploads[0].Parts[1].Number != 2 {
+		t.Fatalf("uploads after reopening are %v", uploads)
+	}
+
+	// parts are referenced content, but not objects
+	if _, err := reopened.FindContent("", "h2"); err != nil {
+		t.Errorf("content of part not found, error: %v", err)
+	}
+	if _, err := reopened.Get("", "big"); err != ErrNotFound {
+		t.Errorf("upload found as object, error: %v", err)
+	}
+
+	if _, err := reopened.DeleteUpload("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.DeleteUpload("u1"); err != ErrNotFound {
+		t.Errorf("deleted upload twice, error: %v", err)
+	}
+	if _, err := reopened.FindContent("", "h2"); err != ErrNotFound {
+		t.Errorf("content of deleted upload found, error: %v", err)
+	}
+}
+
+func TestCompleteUpload(t *testing.T) {
+	store, root := newTestStore(t)
+	store.CreateUpload(Upload{Id: "u1", Name: "big"})
+	store.PutPart("u1", newPart(1, "h1"))
+	store.PutPart("u1", newPart(2, "h2"))
+
+	rec := Record{Name: "big", Content: Content{Size: 2, Hash: "h-2"}, Parts: []Part{newPart(1, "h1"), newPart(2, "h2")}}
+
+	// a part replaced after the manifest was checked
+	old, _ := store.PutPart("u1", newPart(2, "h3"))
+	if len(old.Parts) != 2 || old.Parts[1].Hash != "h2" {
+		t.Errorf("upload before replacing part is %v", old)
+	}
+	if _, err := store.CompleteUpload("u1", rec); err != ErrConflict {
+		t.Errorf("completed upload with replaced part, error: %v", err)
+	}
+
+	// parts moved after the manifest was checked are saved where they are now
+	rec.Parts[1].Hash = "h3"
+	store.UpdateLocations("", "h1", []string{"a"}, []string{"b"})
+	saved, err := store.CompleteUpload("u1", rec)
+	if err != nil || saved.Version != 1 {
+		t.Fatalf("saved %v, error: %v", saved, err)
+	}
+	if saved.Parts[0].Locations[0] != "b" {
+		t.Errorf("part saved at %v", saved.Parts[0].Locations)
+	}
+	if _, err := store.GetUpload("u1"); err != ErrNotFound {
+		t.Errorf("upload kept after completing, error: %v", err)
+	}
+	if _, err := store.CompleteUpload("u1", rec); err != ErrNotFound {
+		t.Errorf("completed upload twice, error: %v", err)
+	}
+
+	reopened, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploads, _ := reopened.Uploads(); len(uploads) != 0 {
+		t.Errorf("uploads after reopening are %v", uploads)
+	}
+	if got, err := reopened.Get("", "big"); err != nil || len(got.Parts) != 2 {
+		t.Errorf("object is %v, error: %v", got, err)
+	}
+}
+
+func TestSessionsSurviveReopen(t *testing.T) {
+	store, root := newTestStore(t)
+	created := time.Now().UTC().Round(time.Second)
+	store.CreateSession(Session{Id: "s2", Name: "second", Length: 2, Addr: "a", Created: created.Add(time.Second)})
+	store.CreateSession(Session{Id: "s1", Name: "first", Length: 1, Addr: "a", Created: created})
+
+	reopened, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := reopened.Sessions()
+	if len(sessions) != 2 || sessions[0].Id != "s1" || sessions[1].Name != "second" || !sessions[0].Created.Equal(created) {
+		t.Fatalf("sessions after reopening are %v", sessions)
+	}
+	if _, err := reopened.Get("", "first"); err != ErrNotFound {
+		t.Errorf("session found as object, error: %v", err)
+	}
+
+	if sess, err := reopened.DeleteSession("s1"); err != nil || sess.Name != "first" {
+		t.Fatalf("deleted session %v, error: %v", sess, err)
+	}
+	if _, err := reopened.DeleteSession("s1"); err != ErrNotFound {
+		t.Errorf("deleted session twice, error: %v", err)
+	}
+
+	reopened, err = NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.GetSession("s1"); err != ErrNotFound {
+		t.Errorf("deleted session found after reopening, error: %v", err)
+	}
+	if sess, err := reopened.GetSession("s2"); err != nil || sess.Length != 2 {
+		t.Errorf("session is %v, error: %v", sess, err)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	store, root := newTestStore(t)
+	if _, err := store.CreateBucket("team"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateBucket("team"); err != ErrBucketExists {
+		t.Errorf("created bucket twice, error: %v", err)
+	}
+
+	inBucket := newRecord("obj", "h1")
+	inBucket.Bucket = "team"
+	rec, _ := store.PutVersion(inBucket)
+	store.PutVersion(newRecord("obj", "h2"))
+	if err := store.DeleteBucket("team"); err != ErrBucketNotEmpty {
+		t.Errorf("deleted bucket holding objects, error: %v", err)
+	}
+	missing := newRecord("obj", "h1")
+	missing.Bucket = "missing"
+	if _, err := store.PutVersion(missing); err != ErrNotFound {
+		t.Errorf("put to missing bucket returned %v", err)
+	}
+
+	// objects of a bucket are apart from objects outside buckets, and survive reopening
+	reopened, err := NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.Get("team", "obj"); err != nil || got.Hash != "h1" {
+		t.Errorf("object of bucket is %v, error: %v", got, err)
+	}
+	if got, err := reopened.Get("", "obj"); err != nil || got.Hash != "h2" {
+		t.Errorf("object outside buckets is %v, error: %v", got, err)
+	}
+	if _, err := reopened.FindContent("", "h1"); err != ErrNotFound {
+		t.Errorf("content of bucket found outside it, error: %v", err)
+	}
+	if buckets, _ := reopened.Buckets(); len(buckets) != 1 || buckets[0].Name != "team" {
+		t.Errorf("buckets after reopening are %v", buckets)
+	}
+
+	reopened.DeleteVersion("team", "obj", rec.Version)
+	if err := reopened.CreateUpload(Upload{Id: "u1", Bucket: "team", Name: "obj"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.DeleteBucket("team"); err != ErrBucketNotEmpty {
+		t.Errorf("deleted bucket targeted by upload, error: %v", err)
+	}
+	reopened.DeleteUpload("u1")
+
+	if err := reopened.CreateSession(Session{Id: "s1", Bucket: "team", Name: "obj"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.DeleteBucket("team"); err != ErrBucketNotEmpty {
+		t.Errorf("deleted bucket targeted by session, error: %v", err)
+	}
+	reopened.DeleteSession("s1")
+
+	if err := reopened.DeleteBucket("team"); err != nil {
+		t.Errorf("failed to delete empty bucket, error: %v", err)
+	}
+	if err := reopened.CreateUpload(Upload{Id: "u2", Bucket: "team"}); err != ErrNotFound {
+		t.Errorf("created upload in deleted bucket, error: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package metadata
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// Returned when the object, version or bucket does not exist
+	ErrNotFound = errors.New("metadata not found")
+
+	// Returned when creating a bucket that exists already
+	ErrBucketExists = errors.New("bucket already exists")
+
+	// Returned when deleting a bucket still holding objects, or targeted by uploads
+	// or sessions in progress
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+
+	// Returned when metadata changed since it was read, the change is not applied
+	ErrConflict = errors.New("metadata changed concurrently")
+)
+
+// Bucket is a namespace of objects, objects in different buckets never share content
+type Bucket struct {
+	// Bucket name
+	Name string `json:"name"`
+
+	// When the bucket was created
+	Created time.Time `json:"created"`
+}
+
+// Content describes a piece of content stored on data provider servers
+type Content struct {
+	// Bucket the content is stored in, empty for objects outside buckets
+	Bucket string `json:"bucket,omitempty"`
+
+	// Content size in bytes
+	Size int64 `json:"size"`
+
+	// Hex encoded SHA-256 hash of content
+	Hash string `json:"hash"`
+
+	// Addresses of data provider servers holding the content, for erasure coded
+	// content, Locations[i] holds shard i, an empty address means the shard is lost
+	Locations []string `json:"locations"`
+
+	// Number of data and parity shards of erasure coded content, 0 if not erasure coded
+	DataShards   int `json:"dataShards,omitempty"`
+	ParityShards int `json:"parityShards,omitempty"`
+}
+
+// Part is a part of an object uploaded by multipart upload
+type Part struct {
+	// Part number given by the client, parts are joined in ascending order
+	Number int `json:"partNumber"`
+
+	Content
+}
+
+// Upload is a multipart upload in progress, its parts are referenced like contents of
+// object versions until the upload completes or is aborted
+type Upload struct {
+	// Upload ID, bucket and name of object
+	Id     string `json:"id"`
+	Bucket string `json:"bucket,omitempty"`
+	Name   string `json:"name"`
+
+	// Content type given when the upload was initiated
+	ContentType string `json:"contentType"`
+
+	// When the upload was initiated
+	Created time.Time `json:"created"`
+
+	// Uploaded parts, in ascending order
+	Parts []Part `json:"parts"`
+}
+
+// Session is a resumable upload in progress, its content is appended to a staging file on
+// one data provider server until the session is finished
+type Session struct {
+	// Session ID, also the name of staging file
+	Id string `json:"id"`
+
+	// Bucket, name and content type of object given when the session was created
+	Bucket      string `json:"bucket,omitempty"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+
+	// Total size of object
+	Length int64 `json:"length"`
+
+	// Address of the data provider server holding the staging file
+	Addr string `json:"addr"`
+
+	// When the session was created
+	Created time.Time `json:"created"`
+}
+
+// Orphan is an object left on a data provider server after its content was deleted, because
+// deleting it failed. Deletion is retried until it succeeds or the content is stored again
+type Orphan struct {
+	// Address of data provider server holding the object
+	Addr string `json:"addr"`
+
+	// Bucket and hash of the deleted content
+	Bucket string `json:"bucket,omitempty"`
+	Hash   string `json:"hash"`
+
+	// Path of the object on data provider server, a replica or a shard of content
+	Path string `json:"path"`
+}
+
+// Record describes one version of an object
+type Record struct {
+	// Object name, unique in its bucket
+	Name string `json:"name"`
+
+	// Object version, increases on every PUT or DELETE and is never assigned again, even
+	// after the version is deleted, it is the version ID clients use to get older versions
+	Version int64 `json:"version"`
+
+	// The version is a delete marker written by DELETE, it has no content and the
+	// object is not found while it is the latest version
+	DeleteMarker bool `json:"deleteMarker,omitempty"`
+
+	// Content of object, its Bucket is the bucket of object. For a multipart object,
+	// Size is the total size of parts, Hash is "<SHA-256 hash of part hashes>-<number
+	// of parts>", and the content is stored by parts
+	Content
+
+	// Content type given by the client
+	ContentType string `json:"contentType"`
+
+	// When this version was created
+	Created time.Time `json:"created"`
+
+	// Parts of a multipart object, in ascending order
+	Parts []Part `json:"parts,omitempty"`
+}
+
+// Contents returns the stored contents of object, in order, none for a delete marker
+func (rec Record) Contents() []Content {
+	if rec.DeleteMarker {
+		return nil
+	}
+
+	if len(rec.Parts) == 0 {
+		return []Content{rec.Content}
+	}
+
+	contents := make([]Content, len(rec.Parts))
+	for i := range rec.Parts {
+		contents[i] = rec.Parts[i].Content
+	}
+	return contents
+}
+
+// Returns the locations of each content by hash in rec
+func (rec Record) locationsOf(hash string) [][]string {
+	locations := make([][]string, 0)
+	if rec.Hash == hash {
+		locations = append(locations, rec.Locations)
+	}
+	for _, part := range rec.Parts {
+		if part.Hash == hash {
+			locations = append(locations, part.Locations)
+		}
+	}
+	return locations
+}
+
+// Determines if a and b are the same addresses in the same order
+func equalAddrs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Replace the locations of content by hash in rec, returns false if rec does not hold it.
+// Parts are copied, so records sharing them are not changed
+func (rec *Record) setLocations(hash string, locations []string) bool {
+	found := false
+	if rec.Hash == hash {
+		rec.Locations = locations
+		found = true
+	}
+
+	parts := append([]Part(nil), rec.Parts...)
+	for i := range parts {
+		if parts[i].Hash == hash {
+			parts[i].Locations = locations
+			found = true
+		}
+	}
+	rec.Parts = parts
+	return found
+}
+
+// Store keeps versioned object records by bucket, objects outside buckets are in bucket ""
+type Store interface {
+	// PutVersion stores rec as the latest version of rec.Name in rec.Bucket, the version
+	// number is assigned by the store, returns the stored record
+	PutVersion(rec Record) (Record, error)
+
+	// Get returns the latest version of object
+	Get(bucket string, name string) (Record, error)
+
+	// GetVersion returns the given version of object
+	GetVersion(bucket string, name string, version int64) (Record, error)
+
+	// Versions returns all versions of object, oldest first
+	Versions(bucket string, name string) ([]Record, error)
+
+	// FindContent returns the content of bucket with the given hash of any object version
+	// or upload part, used to deduplicate content and to tell if content is still referenced
+	FindContent(bucket string, hash string) (Content, error)
+
+	// Contents returns every distinct content of all object versions and upload parts,
+	// by bucket and hash
+	Contents() ([]Content, error)
+
+	// UpdateLocations replaces the locations of content of bucket by hash in every object
+	// version and upload part holding it, after content is moved between data provider servers.
+	// Returns ErrConflict unless content is at old everywhere, ErrNotFound if nothing holds it
+	UpdateLocations(bucket string, hash string, old []string, locations []string) error
+
+	// DeleteVersion removes the given version of object permanently, returns the
+	// removed record
+	DeleteVersion(bucket string, name string, version int64) (Record, error)
+
+	// List returns the latest versions of objects in bucket whose name starts with prefix
+	// and sorts after marker, sorted by name, objects whose latest version is a delete
+	// marker are left out
+	List(bucket string, prefix string, marker string) ([]Record, error)
+
+	// CreateBucket creates bucket by name, returns ErrBucketExists if it exists
+	CreateBucket(name string) (Bucket, error)
+
+	// GetBucket returns bucket by name
+	GetBucket(name string) (Bucket, error)
+
+	// Buckets returns all buckets, sorted by name
+	Buckets() ([]Bucket, error)
+
+	// DeleteBucket removes bucket by name, returns ErrBucketNotEmpty if it holds any
+	// object version, or uploads or sessions in progress target it
+	DeleteBucket(name string) error
+
+	// CreateUpload stores a new upload, returns ErrNotFound if its bucket does not exist
+	CreateUpload(u Upload) error
+
+	// GetUpload returns upload by ID
+	GetUpload(id string) (Upload, error)
+
+	// Uploads returns all uploads in progress
+	Uploads() ([]Upload, error)
+
+	// PutPart adds part to upload, replacing the part with the same number, returns the
+	// upload as it was before
+	PutPart(id string, part Part) (Upload, error)
+
+	// CompleteUpload stores rec made of parts of upload as the latest version of its object
+	// and removes the upload, returns ErrConflict if a part of rec was replaced meanwhile
+	CompleteUpload(id string, rec Record) (Record, error)
+
+	// DeleteUpload removes upload by ID, returns the removed upload
+	DeleteUpload(id string) (Upload, error)
+
+	// CreateSession stores a new session, returns ErrNotFound if its bucket does not exist
+	CreateSession(sess Session) error
+
+	// GetSession returns session by ID
+	GetSession(id string) (Session, error)
+
+	// Sessions returns all sessions in progress
+	Sessions() ([]Session, error)
+
+	// DeleteSession removes session by ID, returns the removed session. Only one caller
+	// removes a session, so removing it claims the session
+	DeleteSession(id string) (Session, error)
+
+	// PutOrphans records objects left on data provider servers, to delete them later
+	PutOrphans(orphans []Orphan) error
+
+	// Orphans returns the objects left on data provider servers
+	Orphans() ([]Orphan, error)
+
+	// DeleteOrphan removes orphan once it is deleted or no longer to be deleted
+	DeleteOrphan(orphan Orphan) error
+}
@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"../util"
+)
+
+// Size of blocks whose CRC32C is kept in sidecar, ranged reads verify whole blocks
+const checksumBlockSize = 64 << 10
+
+// objectChecksums are the checksums of an object computed when it was written, kept in
+// a sidecar file in the checksums folder under the same name as the object
+type objectChecksums struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	CRC32C string `json:"crc32c"`
+
+	// CRC32C of each BlockSize block of object, the last block may be shorter. Objects
+	// written before blocks were kept have none
+	BlockSize int64    `json:"blockSize,omitempty"`
+	Blocks    []string `json:"blocks,omitempty"`
+}
+
+// Write checksums of object to sidecar file name, through tempName, blocks are the
+// CRC32C of each checksumBlockSize block of object
+func writeChecksums(name string, tempName string, size int64, sums util.Checksums, blocks []string) error {
+	data, _ := json.Marshal(objectChecksums{
+		Size:      size,
+		SHA256:    sums.SHA256,
+		CRC32C:    sums.CRC32C,
+		BlockSize: checksumBlockSize,
+		Blocks:    blocks,
+	})
+
+	file, err := os.Create(tempName)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempName, name)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	return syncDir(filepath.Dir(name))
+}
+
+// Read checksums of object from sidecar file name
+func readChecksums(name string) (objectChecksums, error) {
+	var sums objectChecksums
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return sums, err
+	}
+
+	err = json.Unmarshal(data, &sums)
+	return sums, err
+}
+
+// blockChecksumWriter computes the CRC32C of each checksumBlockSize block written to it
+type blockChecksumWriter struct {
+	crc32c hash.Hash32
+
+	// Bytes written to the current block
+	n int64
+
+	// CRC32C of complete blocks
+	blocks []string
+}
+
+// Create blockChecksumWriter
+func newBlockChecksumWriter() *blockChecksumWriter {
+	return &blockChecksumWriter{crc32c: util.NewCRC32C(), blocks: []string{}}
+}
+
+// Implements the Write method
+func (bw *blockChecksumWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := checksumBlockSize - bw.n
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+
+		bw.crc32c.Write(p[:n])
+		bw.n += n
+		p = p[n:]
+		if bw.n == checksumBlockSize {
+			bw.blocks = append(bw.blocks, util.CRC32CHex(bw.crc32c))
+			bw.crc32c.Reset()
+			bw.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Returns the CRC32C of every block written, the last one may be shorter
+func (bw *blockChecksumWriter) Sums() []string {
+	if bw.n == 0 {
+		return bw.blocks
+	}
+	return append(bw.blocks, util.CRC32CHex(bw.crc32c))
+}
+
+// blockVerifier reads an object a block at a time and verifies each block against its
+// CRC32C before any of it is returned, so corrupt bytes are never sent. It implements
+// io.ReadSeeker for http.ServeContent
+type blockVerifier struct {
+	file *os.File
+	size int64
+	sums objectChecksums
+
+	// Read offset
+	offset int64
+
+	// The verified block and its index, -1 if none
+	block []byte
+	index int64
+
+	// *corruptObjectError once a block does not match, or the read error
+	err error
+}
+
+// Create blockVerifier of file with size, sums must hold block checksums
+func newBlockVerifier(file *os.File, size int64, sums objectChecksums) *blockVerifier {
+	return &blockVerifier{file: file, size: size, sums: sums, index: -1}
+}
+
+// Implements the Read method
+func (bv *blockVerifier) Read(p []byte) (int, error) {
+	if bv.err != nil {
+		return 0, bv.err
+	}
+	if bv.offset >= bv.size {
+		return 0, io.EOF
+	}
+
+	index := bv.offset / bv.sums.BlockSize
+	if index != bv.index {
+		bv.err = bv.load(index)
+		if bv.err != nil {
+			return 0, bv.err
+		}
+	}
+
+	n := copy(p, bv.block[bv.offset-index*bv.sums.BlockSize:])
+	bv.offset += int64(n)
+	return n, nil
+}
+
+// Read block by index and verify it
+func (bv *blockVerifier) load(index int64) error {
+	if index >= int64(len(bv.sums.Blocks)) {
+		return &corruptObjectError{fmt.Sprintf("%d blocks", len(bv.sums.Blocks)), fmt.Sprintf("block %d", index)}
+	}
+
+	start := index * bv.sums.BlockSize
+	length := bv.sums.BlockSize
+	if start+length > bv.size {
+		length = bv.size - start
+	}
+
+	block := make([]byte, length)
+	_, err := bv.file.ReadAt(block, start)
+	if err != nil {
+		return err
+	}
+
+	crc32c := util.NewCRC32C()
+	crc32c.Write(block)
+	if actual := util.CRC32CHex(crc32c); actual != bv.sums.Blocks[index] {
+		return &corruptObjectError{
+			fmt.Sprintf("block %d crc32c %s", index, bv.sums.Blocks[index]),
+			fmt.Sprintf("block %d crc32c %s", index, actual),
+		}
+	}
+
+	bv.block = block
+	bv.index = index
+	return nil
+}
+
+// Implements the Seek method
+func (bv *blockVerifier) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += bv.offset
+	case io.SeekEnd:
+		offset += bv.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	bv.offset = offset
+	return offset, nil
+}
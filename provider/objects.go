@@ -1,35 +1,233 @@
 package provider
 
 import (
+	"crypto/sha256"
+	"io"
+	"log"
 	"net/http"
 	"os"
-	"log"
-	"io"
+	"path/filepath"
+	"strconv"
+
+	"../util"
 )
 
-// The real handler to get an object by object name
-func GetObjectByName(name string, w http.ResponseWriter) {
+// corruptObjectError is returned when an object read does not match its hash
+type corruptObjectError struct {
+	expected string
+	actual   string
+}
+
+func (e *corruptObjectError) Error() string {
+	return "object hash mismatch, expected " + e.expected + ", actual " + e.actual
+}
+
+// The real handler to get an object by object name, "Range" and "If-Range" headers are
+// supported, single and multiple ranges are returned as 206, unsatisfiable ranges as 416.
+// Whole objects are verified while sent, see getVerifiedObject, ranges are verified by block
+// checksums, sumName is the sidecar file holding the checksums, if any. Returns
+// *corruptObjectError if the object is corrupt, the response is cut short then
+func GetObjectByName(name string, sumName string, w http.ResponseWriter, r *http.Request) error {
 	file, err := os.Open(name)
 	if err != nil {
 		log.Printf("Unable to open file %s, error: %s", name, err)
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return err
 	}
 
 	defer file.Close()
-	io.Copy(w, file)
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("Unable to stat file %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	if r.Method == "GET" && r.Header.Get("Range") == "" {
+		return getVerifiedObject(file, info, sumName, w)
+	}
+
+	setObjectHeaders(w, info)
+	sums, err := readChecksums(sumName)
+	if err != nil || len(sums.Blocks) == 0 || sums.BlockSize <= 0 {
+		// objects written before block checksums were kept are sent unverified
+		http.ServeContent(w, r, "", info.ModTime(), file)
+		return nil
+	}
+
+	bv := newBlockVerifier(file, info.Size(), sums)
+	http.ServeContent(w, r, "", info.ModTime(), bv)
+	if _, ok := bv.err.(*corruptObjectError); ok {
+		log.Printf("Object %s is corrupt, %s", name, bv.err)
+	}
+	return bv.err
 }
 
-// The real handler to put an object by object name
-func PutObjectByName(name string, w http.ResponseWriter, r *http.Request) {
-	file, err := os.Create(name)
+// Send whole object while verifying it against the SHA-256 hash recorded when it was
+// written, or its name if it has no sidecar and is named by hash. Objects with block checksums
+// are read through blockVerifier, so the response is cut short before a corrupt block. The
+// checksums of content sent are returned in "X-Checksum-Sha256" and "X-Checksum-Crc32c"
+// trailers, so the response has no Content-Length. If the object is corrupt the trailers are
+// left empty, which readers take as a checksum mismatch
+func getVerifiedObject(file *os.File, info os.FileInfo, sumName string, w http.ResponseWriter) error {
+	var content io.Reader = file
+	expected := ""
+	if sums, err := readChecksums(sumName); err == nil {
+		expected = sums.SHA256
+		if len(sums.Blocks) > 0 && sums.BlockSize > 0 {
+			content = newBlockVerifier(file, info.Size(), sums)
+		}
+	} else if util.IsValidHash(info.Name()) {
+		expected = info.Name()
+	}
+
+	setObjectHeaders(w, info)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Trailer", util.ChecksumSHA256Header+", "+util.ChecksumCRC32CHeader)
+
+	cw := util.NewChecksumWriter(sha256.New(), false)
+	_, err := io.Copy(w, io.TeeReader(content, cw))
+	if _, ok := err.(*corruptObjectError); ok {
+		log.Printf("Object %s is corrupt, %s", file.Name(), err)
+		return err
+	} else if err != nil {
+		log.Printf("Failed to send object %s, error: %s", file.Name(), err)
+		return err
+	}
+
+	actual := cw.Sums()
+	if expected != "" && actual.SHA256 != expected {
+		log.Printf("Object %s is corrupt, expected hash %s, actual %s", file.Name(), expected, actual.SHA256)
+		return &corruptObjectError{expected, actual.SHA256}
+	}
+
+	w.Header().Set(util.ChecksumSHA256Header, util.EncodeHexChecksum(actual.SHA256))
+	w.Header().Set(util.ChecksumCRC32CHeader, util.EncodeHexChecksum(actual.CRC32C))
+	return nil
+}
+
+// The real handler to get object headers by object name, without the content
+func HeadObjectByName(name string, w http.ResponseWriter) {
+	info, err := os.Stat(name)
 	if err != nil {
-		log.Printf("Unable to create file %s, error: %s", name, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	setObjectHeaders(w, info)
+}
+
+// Set Content-Length, Last-Modified, ETag and Content-Type headers of object,
+// the object name is its hash, so it is used as ETag
+func setObjectHeaders(w http.ResponseWriter, info os.FileInfo) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", `"`+info.Name()+`"`)
+	w.Header().Set("Content-Type", "application/octet-stream")
+}
+
+// The real handler to put an object by its hash, content is written to tempName first,
+// and moved to name only if it is complete and its SHA-256 hash equals hash, an empty hash
+// skips the check. Checksums given in "Content-MD5", "X-Checksum-Sha256" and
+// "X-Checksum-Crc32c" headers or trailers are verified as well, and the checksums of
+// content are kept in sidecar file sumName.
+// The temp file is synced before the rename and the folder after it, so a crash never
+// leaves a partially written object under name
+func PutObjectByHash(name string, sumName string, tempName string, hash string, w http.ResponseWriter, r *http.Request) {
+	file, err := os.Create(tempName)
+	if err != nil {
+		log.Printf("Unable to create file %s, error: %s", tempName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	expected := util.GetChecksums(r.Header)
+	_, md5Trailer := r.Trailer["Content-Md5"]
+	cw := util.NewChecksumWriter(sha256.New(), expected.MD5 != "" || md5Trailer)
+	bw := newBlockChecksumWriter()
+	size, err := io.Copy(io.MultiWriter(file, cw, bw), r.Body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Failed to write file %s, error: %s", tempName, err)
+		os.Remove(tempName)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.ContentLength >= 0 && size != r.ContentLength {
+		log.Printf("Object length mismatch, expected %d, actual %d", r.ContentLength, size)
+		os.Remove(tempName)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	actual := cw.Sums()
+	if hash != "" && actual.SHA256 != hash {
+		log.Printf("Object hash mismatch, expected %s, actual %s", hash, actual.SHA256)
+		os.Remove(tempName)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// trailers are only known once the whole body is read
+	if mismatch := expected.Merge(r.Trailer).Mismatch(actual); mismatch != "" {
+		log.Printf("Object %s checksum mismatch", mismatch)
+		os.Remove(tempName)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the sidecar goes first, a sidecar without object is harmless and replaced later
+	err = writeChecksums(sumName, tempName+".sum", size, actual, bw.Sums())
+	if err != nil {
+		log.Printf("Unable to write checksums %s, error: %s", sumName, err)
+		os.Remove(tempName)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// identical content may already exist, replacing it is harmless
+	err = os.Rename(tempName, name)
+	if err == nil {
+		err = syncDir(filepath.Dir(name))
+	}
+	if err != nil {
+		log.Printf("Unable to move file %s to %s, error: %s", tempName, name, err)
+		os.Remove(tempName)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	defer file.Close()
-	io.Copy(file, r.Body)
 	log.Printf("Created object %s", name)
 }
+
+// Sync folder, so entries renamed into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// The real handler to delete an object by object name
+func DeleteObjectByName(name string, w http.ResponseWriter) {
+	err := os.Remove(name)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Unable to delete file %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Deleted object %s", name)
+}
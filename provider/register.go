@@ -0,0 +1,108 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	uuid2 "github.com/satori/go.uuid"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Read node ID of data provider server from storage root, a new one is created and
+// persisted on first start, so the ID survives restarts
+func loadNodeId(storage string) (string, error) {
+	name := storage + "/node-id"
+	data, err := ioutil.ReadFile(name)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		_, err = uuid2.FromString(id)
+		if err != nil {
+			return "", fmt.Errorf("invalid node ID %q in %s", id, name)
+		}
+		return id, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := uuid2.Must(uuid2.NewV4()).String()
+	err = ioutil.WriteFile(name+".tmp", []byte(id+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Created node ID %s", id)
+	return id, nil
+}
+
+// Announce the data provider server to API servers at apis every interval, announcing
+// again is harmless and keeps it registered after an API server restarts
+func (s *DataProviderServer) StartRegistration(apis []string, interval time.Duration) {
+	s.apis = apis
+	go func() {
+		for {
+			for _, api := range s.apis {
+				err := s.register(api)
+				if err != nil {
+					log.Printf("Unable to register with API server %s, error: %s", api, err)
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Register with API server at api
+func (s *DataProviderServer) register(api string) error {
+	body, _ := json.Marshal(map[string]string{"id": s.id, "addr": s.addr, "state": s.getState()})
+	resp, err := http.Post("http://"+api+"/providers", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API server returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Ask API servers it registered with to repair content, after corrupt object by key
+// was quarantined, API servers restore it from other replicas or shards
+func (s *DataProviderServer) reportCorruption(name string) {
+	for _, api := range s.apis {
+		resp, err := http.Post("http://"+api+"/admin/repair?object="+url.QueryEscape(name), "application/json", nil)
+		if err != nil {
+			log.Printf("Unable to report corrupt object %s to API server %s, error: %s", name, api, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// Deregister from all API servers it registered with, so no more objects are placed on
+// the data provider server, called before shutting down
+func (s *DataProviderServer) Deregister() {
+	for _, api := range s.apis {
+		req, err := http.NewRequest("DELETE", "http://"+api+"/providers/"+s.id, nil)
+		if err != nil {
+			continue
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Unable to deregister from API server %s, error: %s", api, err)
+			continue
+		}
+		resp.Body.Close()
+		log.Printf("Deregistered from API server %s", api)
+	}
+}
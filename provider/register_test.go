@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeIdSurvivesRestart(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	first := NewServer("localhost:8031", storage, nil)
+	if first.id == "" {
+		t.Fatal("no node ID")
+	}
+	if again := NewServer("localhost:8031", storage, nil); again.id != first.id {
+		t.Errorf("node ID after restart is %s, was %s", again.id, first.id)
+	}
+
+	ioutil.WriteFile(filepath.Join(storage, "node-id"), []byte("not a node ID\n"), 0644)
+	if _, err := loadNodeId(storage); err == nil {
+		t.Errorf("loaded invalid node ID")
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	s := NewServer("localhost:8031", filepath.Join(t.TempDir(), "storage"), nil)
+
+	registered, deregistered := make(chan map[string]string, 10), make(chan string, 1)
+	router := httprouter.New()
+	router.POST("/providers", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var reg map[string]string
+		json.NewDecoder(r.Body).Decode(&reg)
+		select {
+		case registered <- reg:
+		default:
+		}
+	})
+	router.DELETE("/providers/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		deregistered <- p.ByName("id")
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	// registered again each interval
+	s.StartRegistration([]string{strings.TrimPrefix(srv.URL, "http://")}, 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case reg := <-registered:
+			if reg["id"] != s.id || reg["addr"] != "localhost:8031" {
+				t.Errorf("registration is %v", reg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("registration %d expected", i+1)
+		}
+	}
+
+	s.Deregister()
+	select {
+	case id := <-deregistered:
+		if id != s.id {
+			t.Errorf("deregistered %s", id)
+		}
+	default:
+		t.Errorf("not deregistered")
+	}
+}
@@ -0,0 +1,263 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+// Max findings kept by scrubber, older ones are dropped
+const maxScrubFindings = 1000
+
+// scrubber walks the objects folder in the background, recomputes the SHA-256 hash of
+// every object and quarantines objects not matching the hash recorded when they were
+// written. Objects are read at most rate bytes per second, so serving is not disturbed
+type scrubber struct {
+	// Bytes read per second, and the pause between passes
+	rate     int64
+	interval time.Duration
+
+	// Starts a pass at once when signalled
+	trigger chan struct{}
+
+	// Progress and findings
+	status ScrubStatus
+
+	// mutex on status
+	mutex sync.Mutex
+}
+
+// ScrubStatus is the progress and findings of scrubber, returned by the admin endpoint
+type ScrubStatus struct {
+	Running  bool           `json:"running"`
+	Passes   int            `json:"passes"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Total    int            `json:"total"`
+	Scanned  int            `json:"scanned"`
+	Bytes    int64          `json:"bytes"`
+	Corrupt  int            `json:"corrupt"`
+	Findings []ScrubFinding `json:"findings"`
+}
+
+// ScrubFinding is a corrupt object, found by scrubber or when it was read
+type ScrubFinding struct {
+	Name     string    `json:"name"`
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Found    time.Time `json:"found"`
+	Source   string    `json:"source"`
+}
+
+// Start the scrubber, objects are read at most rate bytes per second, a new pass starts
+// interval after the last one finished
+func (s *DataProviderServer) StartScrubber(rate int64, interval time.Duration) {
+	s.scrubber = &scrubber{
+		rate:     rate,
+		interval: interval,
+		trigger:  make(chan struct{}, 1),
+	}
+
+	go func() {
+		for {
+			s.scrub()
+
+			select {
+			case <-time.After(interval):
+			case <-s.scrubber.trigger:
+			}
+		}
+	}()
+}
+
+// Returns the keys of all objects, objects outside buckets first, then objects of
+// every bucket folder
+func (s *DataProviderServer) objectKeys() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.storage + "/objects")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	buckets := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			buckets = append(buckets, entry.Name())
+		} else if util.IsValidObjectName(entry.Name()) {
+			keys = append(keys, entry.Name())
+		}
+	}
+
+	for _, bucket := range buckets {
+		entries, err := ioutil.ReadDir(s.storage + "/objects/" + bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if util.IsValidObjectName(entry.Name()) {
+				keys = append(keys, objectKey(bucket, entry.Name()))
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Run a scrub pass over all objects
+func (s *DataProviderServer) scrub() {
+	sc := s.scrubber
+	keys, err := s.objectKeys()
+	if err != nil {
+		log.Printf("Scrubber unable to list objects, error: %s", err)
+		return
+	}
+
+	sc.mutex.Lock()
+	sc.status.Running = true
+	sc.status.Started = time.Now().UTC()
+	sc.status.Total = len(keys)
+	sc.status.Scanned = 0
+	sc.status.Bytes = 0
+	sc.mutex.Unlock()
+	log.Printf("Scrubber started, %d objects", len(keys))
+
+	throttle := util.NewThrottle(sc.rate)
+	for _, name := range keys {
+		s.scrubObject(name, throttle)
+
+		sc.mutex.Lock()
+		sc.status.Scanned++
+		sc.status.Bytes = throttle.Read()
+		sc.mutex.Unlock()
+	}
+
+	sc.mutex.Lock()
+	sc.status.Running = false
+	sc.status.Passes++
+	sc.status.Finished = time.Now().UTC()
+	sc.mutex.Unlock()
+	log.Printf("Scrubber finished, %d objects, %d bytes", len(keys), throttle.Read())
+}
+
+// Verify object by key, reading it through throttle
+func (s *DataProviderServer) scrubObject(name string, throttle *util.Throttle) {
+	expected := ""
+	if sums, err := readChecksums(s.getChecksumsName(name)); err == nil {
+		expected = sums.SHA256
+	} else if util.IsValidHash(filepath.Base(name)) {
+		expected = filepath.Base(name)
+	} else {
+		// shards written before checksums were kept, nothing to compare with
+		return
+	}
+
+	objName := s.getObjectName(name)
+	file, err := os.Open(objName)
+	if err != nil {
+		// deleted since listed
+		return
+	}
+	defer file.Close()
+
+	before, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, throttle.Reader(file))
+	if err != nil {
+		log.Printf("Scrubber unable to read object %s, error: %s", objName, err)
+		return
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual == expected {
+		return
+	}
+
+	// the object may have been replaced by an upload while it was read
+	after, err := os.Stat(objName)
+	if err != nil || !os.SameFile(before, after) {
+		return
+	}
+
+	s.quarantine(name, expected, actual, "scrub")
+}
+
+// Move corrupt object by key and its checksums out of the objects folder, so it is
+// no longer located nor read, and record it in scrubber findings
+func (s *DataProviderServer) quarantine(name string, expected string, actual string, source string) {
+	log.Printf("Quarantining corrupt object %s, expected hash %s, actual %s", name, expected, actual)
+	err := os.MkdirAll(filepath.Dir(s.storage+"/quarantine/"+name), os.ModePerm)
+	if err == nil {
+		err = os.Rename(s.getObjectName(name), s.storage+"/quarantine/"+name)
+	}
+	if err != nil {
+		log.Printf("Unable to quarantine object %s, error: %s", name, err)
+		return
+	}
+	os.Rename(s.getChecksumsName(name), s.storage+"/quarantine/"+name+".sum")
+	go s.reportCorruption(name)
+
+	sc := s.scrubber
+	if sc == nil {
+		return
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.status.Corrupt++
+	sc.status.Findings = append(sc.status.Findings, ScrubFinding{
+		Name:     name,
+		Expected: expected,
+		Actual:   actual,
+		Found:    time.Now().UTC(),
+		Source:   source,
+	})
+	if len(sc.status.Findings) > maxScrubFindings {
+		sc.status.Findings = sc.status.Findings[len(sc.status.Findings)-maxScrubFindings:]
+	}
+}
+
+// Admin API, get scrubber progress and findings
+func (s *DataProviderServer) GetScrubStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.scrubber == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	s.scrubber.mutex.Lock()
+	status := s.scrubber.status
+	status.Findings = append([]ScrubFinding{}, status.Findings...)
+	s.scrubber.mutex.Unlock()
+
+	resp, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// Admin API, start a scrub pass now, unless one is running
+func (s *DataProviderServer) StartScrub(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.scrubber == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case s.scrubber.trigger <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
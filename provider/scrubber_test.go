@@ -0,0 +1,136 @@
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Flip a byte of object name in storage
+func corruptObject(t *testing.T, storage string, name string) {
+	t.Helper()
+	file := filepath.Join(storage, "objects", name)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Get the scrubber status of s
+func scrubStatus(s *DataProviderServer) ScrubStatus {
+	w := httptest.NewRecorder()
+	s.GetScrubStatus(w, httptest.NewRequest("GET", "/admin/scrub", nil), nil)
+	var status ScrubStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	return status
+}
+
+// Wait until scrubber of s finished passes, returns its status
+func waitScrubbed(t *testing.T, s *DataProviderServer, passes int) ScrubStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := scrubStatus(s); status.Passes >= passes {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d scrub passes expected", passes)
+	return ScrubStatus{}
+}
+
+func TestScrubberQuarantinesCorruptObjects(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	w := httptest.NewRecorder()
+	if s.GetScrubStatus(w, httptest.NewRequest("GET", "/admin/scrub", nil), nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status of scrubber not started is %d", w.Code)
+	}
+
+	intact, corrupt := hashOf("intact"), hashOf("corrupt")
+	putObject(s, intact, intact, "intact")
+	putObject(s, corrupt, corrupt, "corrupt")
+	corruptObject(t, storage, corrupt)
+
+	s.StartScrubber(1<<20, time.Hour)
+	status := waitScrubbed(t, s, 1)
+	if status.Scanned != 2 || status.Corrupt != 1 || len(status.Findings) != 1 ||
+		status.Findings[0].Name != corrupt || status.Findings[0].Source != "scrub" {
+		t.Errorf("status after first pass is %+v", status)
+	}
+	if _, err := os.Stat(filepath.Join(storage, "quarantine", corrupt)); err != nil {
+		t.Errorf("corrupt object not quarantined, error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(storage, "objects", intact)); err != nil {
+		t.Errorf("intact object moved, error: %v", err)
+	}
+
+	// a pass started at once by the admin API
+	later := hashOf("later")
+	putObject(s, later, later, "later")
+	corruptObject(t, storage, later)
+	w = httptest.NewRecorder()
+	if s.StartScrub(w, httptest.NewRequest("POST", "/admin/scrub", nil), nil); w.Code != http.StatusAccepted {
+		t.Errorf("starting a pass is %d", w.Code)
+	}
+	if status := waitScrubbed(t, s, 2); status.Corrupt != 2 || status.Findings[1].Name != later {
+		t.Errorf("status after second pass is %+v", status)
+	}
+}
+
+func TestGetObjectQuarantinesCorruptObject(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	s.StartScrubber(1<<20, time.Hour)
+	waitScrubbed(t, s, 1)
+
+	hash := hashOf("content")
+	putObject(s, hash, hash, "content")
+	corruptObject(t, storage, hash)
+
+	getObject(s, hash, "")
+	status := scrubStatus(s)
+	if status.Corrupt != 1 || len(status.Findings) != 1 || status.Findings[0].Source != "read" {
+		t.Errorf("status after reading corrupt object is %+v", status)
+	}
+	if w, _ := getObject(s, hash, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of quarantined object is %d", w.Code)
+	}
+}
+
+func TestQuarantineReportsCorruptObject(t *testing.T) {
+	reported := make(chan string, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/admin/repair" {
+			reported <- r.URL.Query().Get("object")
+		}
+	}))
+	defer api.Close()
+
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	s.StartRegistration([]string{strings.TrimPrefix(api.URL, "http://")}, time.Hour)
+
+	hash := hashOf("content")
+	putObject(s, hash, hash, "content")
+	corruptObject(t, storage, hash)
+	getObject(s, hash, "")
+	select {
+	case name := <-reported:
+		if name != hash {
+			t.Errorf("reported corrupt object %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("corrupt object not reported")
+	}
+}
@@ -1,27 +1,62 @@
 package provider
 
 import (
-	"encoding/json"
 	"github.com/julienschmidt/httprouter"
+	uuid2 "github.com/satori/go.uuid"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
-	"../sqs"
+	"../bus"
+	"../util"
 )
 
+// How long to wait before subscribing to location queries again, when the locate bus is
+// unavailable
+const resubscribeInterval = time.Second
+
 type DataProviderServer struct {
+	// Requests being served, accessed atomically, kept first for 64-bit alignment
+	requests int64
+
 	// Provider server version
 	version int64
 
-	// Provider server address
+	// Node ID, persisted in storage root
+	id string
+
+	// Provider server address, as API servers reach it
 	addr string
 
+	// API servers the provider server registers with
+	apis []string
+
 	// Storage root path
 	storage string
+
+	// Bus carrying object location queries and replies
+	locateBus bus.LocateBus
+
+	// Staging files a chunk is being appended to
+	staging map[string]bool
+
+	// mutex on staging
+	stagingMutex sync.Mutex
+
+	// Background integrity scrubber, nil if not started
+	scrubber *scrubber
+
+	// State set by API servers, "" while running, persisted in storage root
+	state string
+
+	// mutex on state
+	stateMutex sync.Mutex
 }
 
-// Initialize server storage root and objects folder,
+// Initialize server storage root, objects, checksums, temp, staging and quarantine folders,
 // returns storage and error
 func initStorage(storage string) error {
 	log.Printf("Data provider server storage root: %s", storage)
@@ -32,94 +67,245 @@ func initStorage(storage string) error {
 		return err
 	}
 
-	// Create objects folder
-	err = os.Mkdir(storage+"/objects", os.ModePerm)
-	if os.IsExist(err) {
-		return nil
-	} else {
+	// Create objects folder, objects are named by their SHA-256 hash, objects of a bucket
+	// are kept in a folder named after it, created with its first object,
+	// checksums folder, checksums of objects are kept there under the same name,
+	// temp folder, objects being uploaded are written there,
+	// staging folder, resumable uploads are appended there,
+	// and quarantine folder, corrupt objects are moved there
+	for _, folder := range []string{"/objects", "/checksums", "/temp", "/staging", "/quarantine"} {
+		err = os.Mkdir(storage+folder, os.ModePerm)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	// temp files left by uploads interrupted by a crash are never renamed into objects
+	temps, err := filepath.Glob(storage + "/temp/*")
+	if err != nil {
 		return err
 	}
+	for _, temp := range temps {
+		log.Printf("Removing stale temp file %s", temp)
+		os.Remove(temp)
+	}
+
+	return nil
 }
 
 // Initialize storage and return DataProviderServer instance
-func NewServer(addr string, storage string) *DataProviderServer {
+func NewServer(addr string, storage string, locateBus bus.LocateBus) *DataProviderServer {
 	err := initStorage(storage)
 	if err != nil {
 		log.Printf("Unable to initialize storage %s, error: %s", storage, err)
 		log.Fatal("Data provider server " + addr + " exiting...")
 	}
 
+	id, err := loadNodeId(storage)
+	if err != nil {
+		log.Printf("Unable to load node ID from %s, error: %s", storage, err)
+		log.Fatal("Data provider server " + addr + " exiting...")
+	}
+
+	state, err := loadState(storage)
+	if err != nil {
+		log.Printf("Unable to load state from %s, error: %s", storage, err)
+		log.Fatal("Data provider server " + addr + " exiting...")
+	}
+
 	return &DataProviderServer{
-		version: int64(1),
-		addr:    addr,
-		storage: storage,
+		version:   int64(1),
+		id:        id,
+		addr:      addr,
+		storage:   storage,
+		locateBus: locateBus,
+		staging:   map[string]bool{},
+		state:     state,
 	}
 }
 
-// Get object name by storage and name
+// Get object name by storage and name, name is the object key, see objectKey
 func (s *DataProviderServer) getObjectName(name string) string {
 	return s.storage + "/objects/" + name
 }
 
-// RESTful API, get object by name
+// Returns the key of object name in bucket, objects of a bucket are kept in a folder
+// named after it, under objects, checksums and quarantine folders
+func objectKey(bucket string, name string) string {
+	if bucket == "" {
+		return name
+	}
+	return bucket + "/" + name
+}
+
+// Returns the key of object by bucket and name in request params, or "" if either is
+// invalid. Objects outside buckets have no bucket param
+func objectKeyOf(p httprouter.Params) string {
+	bucket, name := p.ByName("bucket"), p.ByName("name")
+	if bucket != "" && !util.IsValidBucketName(bucket) || !util.IsValidObjectName(name) {
+		return ""
+	}
+	return objectKey(bucket, name)
+}
+
+// Create the objects and checksums folders of bucket, if they do not exist
+func (s *DataProviderServer) initBucket(bucket string) error {
+	for _, folder := range []string{"/objects/", "/checksums/"} {
+		err := os.MkdirAll(s.storage+folder+bucket, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the sidecar file name holding checksums of object by name
+func (s *DataProviderServer) getChecksumsName(name string) string {
+	return s.storage + "/checksums/" + name
+}
+
+// Get a new temp file name for an object being uploaded
+func (s *DataProviderServer) getTempName() string {
+	return s.storage + "/temp/" + uuid2.Must(uuid2.NewV4()).String()
+}
+
+// RESTful API, get object by name, object names are SHA-256 hashes of their content,
+// or "<hash>.<index>" for a shard of an erasure coded object. Objects of a bucket are
+// served under "/buckets/:bucket/objects/:name"
 func (s *DataProviderServer) GetObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	name := p.ByName("name")
+	name := objectKeyOf(p)
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	log.Printf("Getting object by name: %s", name)
 	objName := s.getObjectName(name)
-	GetObjectByName(objName, w)
+	err := GetObjectByName(objName, s.getChecksumsName(name), w, r)
+	if corrupt, ok := err.(*corruptObjectError); ok {
+		s.quarantine(name, corrupt.expected, corrupt.actual, "read")
+
+		// the response may look complete where it was cut short, abort the connection
+		if r.Header.Get("Range") != "" {
+			panic(http.ErrAbortHandler)
+		}
+	}
 }
 
-// RESTful API, put object by name
-// First we will choose a data server randomly, then we PUT file to the chosen server
+// RESTful API, put object by name, the name must be the SHA-256 hash of object content,
+// and equal to the hash in "Digest" header. The object is rejected if its content
+// does not match the hash.
+// Shards named "<hash>.<index>" are accepted without "Digest" header, since their hash
+// is unknown until the whole object is encoded, they are verified if the header is present
 func (s *DataProviderServer) PutObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	name := p.ByName("name")
+	name := objectKeyOf(p)
+	if name == "" {
+		log.Printf("Invalid object name %s, expecting SHA-256 hash", p.ByName("name"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hash := util.GetHashFromHeader(r.Header)
+	if util.IsValidHash(p.ByName("name")) && hash != p.ByName("name") {
+		log.Printf("Digest header of object %s is missing or does not match", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if bucket := p.ByName("bucket"); bucket != "" {
+		err := s.initBucket(bucket)
+		if err != nil {
+			log.Printf("Unable to create folders of bucket %s, error: %s", bucket, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	objName := s.getObjectName(name)
-	PutObjectByName(objName, w, r)
+	PutObjectByHash(objName, s.getChecksumsName(name), s.getTempName(), hash, w, r)
 }
 
-// Listens to object location query queue, consume messages from API server,
+// RESTful API, delete object by name
+func (s *DataProviderServer) DeleteObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := objectKeyOf(p)
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	objName := s.getObjectName(name)
+	DeleteObjectByName(objName, w)
+	os.Remove(s.getChecksumsName(name))
+}
+
+// RESTful API, get object headers by name without returning its content,
+// also used to check if object exists
+func (s *DataProviderServer) HeadObject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := objectKeyOf(p)
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	objName := s.getObjectName(name)
+	HeadObjectByName(objName, w)
+}
+
+// Listens to object location queries on the locate bus, consume messages from API server,
 // the message looks like:
-// 		{"name": "someobject", "uid": <UUID>}
+// 		{"bucket": "somebucket", "name": "someobject", "uid": <UUID>}
+// (bucket is empty or absent for objects outside buckets)
 // the data provider server will try to find the object in its storage path,
-// if found, data provider server will send a message to "godos-test-located" queue,
-//		{"uid": <UUID>, "addr": "localhost:8031", "name": "someobject"}
+// if found, data provider server will publish a reply (the "godos-test-located" queue on SQS),
+//		{"uid": <UUID>, "addr": "localhost:8031", "bucket": "somebucket", "name": "someobject"}
 // 		(the uid is used to determine which request by API server)
-// then deletes the message from object location query queue, to prevent it being consumed again
-// if not found, ignore it
+// then acknowledges the query message, to prevent it being consumed again
+// if not found, ignore it. It subscribes again whenever the locate bus is unavailable
+// or goes away, so it never returns
 func (s *DataProviderServer) ListenToObjectLocateQueue() {
-	locateSQS := sqs.NewSQS()
-	defer locateSQS.Close()
-
-	c := locateSQS.Consume(locateSQS.Url)
-	for r := range c {
-		log.Printf("Consume message %s", *r.Body)
-		req := make(map[string]string)
-		err := json.Unmarshal([]byte(*r.Body), &req)
+	for {
+		sub, err := s.locateBus.SubscribeQueries()
 		if err != nil {
-			log.Printf("Failed to unmarshal string to JSON, error: %s", err)
+			log.Printf("Unable to subscribe to location queries, error: %s", err)
+			time.Sleep(resubscribeInterval)
 			continue
 		}
 
+		s.answerLocateQueries(sub)
+
+		// the bus went away, e.g. broker restarted
+		sub.Close()
+		log.Printf("Location query subscription closed, resubscribing")
+		time.Sleep(resubscribeInterval)
+	}
+}
+
+// Answer location queries of sub until it is closed
+func (s *DataProviderServer) answerLocateQueries(sub bus.Subscription) {
+	for r := range sub.Messages() {
+		req := r.Body
+		log.Printf("Consume message %v", req)
 		log.Printf("Trying to located object %s, request UID: %s", req["name"], req["uid"])
-		if s.isObjectExists(req["name"]) {
+		if s.isObjectExists(req["bucket"], req["name"]) {
 			log.Printf("Object %s found", req["name"])
 			// delete the message
-			go func() {
-				err := locateSQS.DeleteMessage(r, locateSQS.Url)
+			go func(r bus.Message) {
+				err := r.Ack()
 				if err != nil {
-					log.Printf("Failed to delete message %s, error: %s", *r.ReceiptHandle, err)
+					log.Printf("Failed to acknowledge message %v, error: %s", r.Body, err)
 				}
-			}()
+			}(r)
 
 			// send reply to godos-test-located queue
 			go func() {
 				msg := map[string]string{
-					"name": req["name"],
-					"uid":  req["uid"],
-					"addr": s.addr,
+					"bucket": req["bucket"],
+					"name":   req["name"],
+					"uid":    req["uid"],
+					"addr":   s.addr,
 				}
 
-				_, err := locateSQS.SendMessage(msg, locateSQS.ReplyUrl)
+				err := s.locateBus.PublishReply(msg)
 				if err != nil {
 					log.Printf("Failed to send reply message, error: %s", err)
 				}
@@ -130,8 +316,12 @@ func (s *DataProviderServer) ListenToObjectLocateQueue() {
 	}
 }
 
-// Determines if object exists
-func (s *DataProviderServer) isObjectExists(name string) bool {
-	_, err := os.Stat(s.storage + "/objects/" + name)
-	return !os.IsNotExist(err)
+// Determines if object exists in bucket
+func (s *DataProviderServer) isObjectExists(bucket string, name string) bool {
+	if bucket != "" && !util.IsValidBucketName(bucket) || !util.IsValidObjectName(name) {
+		return false
+	}
+
+	_, err := os.Stat(s.getObjectName(objectKey(bucket, name)))
+	return err == nil
 }
@@ -0,0 +1,368 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../bus"
+	"../util"
+)
+
+// flakyBus is a MemoryBus refusing the first subscriptions to location queries
+type flakyBus struct {
+	*bus.MemoryBus
+
+	mutex sync.Mutex
+
+	// Subscriptions to refuse before accepting them
+	refuse int
+
+	// Subscriptions to location queries accepted so far
+	subs []bus.Subscription
+}
+
+// Subscribe to location queries, unless some subscriptions are still to be refused
+func (b *flakyBus) SubscribeQueries() (bus.Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.refuse > 0 {
+		b.refuse--
+		return nil, errors.New("locate bus unavailable")
+	}
+
+	sub, err := b.MemoryBus.SubscribeQueries()
+	if err == nil {
+		b.subs = append(b.subs, sub)
+	}
+	return sub, err
+}
+
+// Wait until n subscriptions to location queries have been accepted, returns the last one
+func (b *flakyBus) waitSubscribed(t *testing.T, n int) bus.Subscription {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mutex.Lock()
+		subs := b.subs
+		b.mutex.Unlock()
+		if len(subs) >= n {
+			return subs[len(subs)-1]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d subscriptions to location queries expected", n)
+	return nil
+}
+
+// Returns the hex encoded SHA-256 hash of content
+func hashOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Ask the bus where object name is, returns the address of the replying server
+func locateOn(t *testing.T, b bus.LocateBus, name string) string {
+	t.Helper()
+	replies, err := b.SubscribeReplies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replies.Close()
+
+	err = b.PublishQuery(map[string]string{"name": name, "uid": name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-replies.Messages():
+		return msg.Body["addr"]
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no location reply for %s", name)
+	}
+	return ""
+}
+
+func TestListenToObjectLocateQueueResubscribes(t *testing.T) {
+	b := &flakyBus{MemoryBus: bus.NewMemoryBus(), refuse: 1}
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, b)
+	hash := hashOf("content")
+	err := ioutil.WriteFile(filepath.Join(storage, "objects", hash), []byte("content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ListenToObjectLocateQueue()
+
+	// the first subscription was refused
+	sub := b.waitSubscribed(t, 1)
+	if addr := locateOn(t, b, hash); addr != "localhost:8031" {
+		t.Errorf("object located at %s", addr)
+	}
+
+	// the bus went away
+	sub.Close()
+	b.waitSubscribed(t, 2)
+	if addr := locateOn(t, b, hash); addr != "localhost:8031" {
+		t.Errorf("object located at %s after resubscribing", addr)
+	}
+}
+
+// Put content as object name on s with the "Digest" header of hash, returns the response status
+func putObject(s *DataProviderServer, name string, hash string, content string) int {
+	r := httptest.NewRequest("PUT", "/objects/"+name, strings.NewReader(content))
+	if hash != "" {
+		r.Header.Set("Digest", util.DigestHeader(hash))
+	}
+	w := httptest.NewRecorder()
+	s.PutObject(w, r, httprouter.Params{{Key: "name", Value: name}})
+	return w.Code
+}
+
+func TestPutObjectByHash(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	hash := hashOf("content")
+
+	for _, tc := range []struct {
+		name    string
+		hash    string
+		content string
+		status  int
+	}{
+		{"obj", "", "content", http.StatusBadRequest},
+		{hash, "", "content", http.StatusBadRequest},
+		{hash, hashOf("other"), "content", http.StatusBadRequest},
+		{hash, hash, "other", http.StatusBadRequest},
+		{hash, hash, "content", http.StatusOK},
+		{hash, hash, "content", http.StatusOK},
+	} {
+		if status := putObject(s, tc.name, tc.hash, tc.content); status != tc.status {
+			t.Errorf("PUT of %q as %s is %d, want %d", tc.content, tc.name, status, tc.status)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(storage, "objects", hash))
+	if err != nil || string(data) != "content" {
+		t.Errorf("object is %q, error: %v", data, err)
+	}
+	temps, _ := ioutil.ReadDir(filepath.Join(storage, "temp"))
+	if len(temps) != 0 {
+		t.Errorf("%d temp files left", len(temps))
+	}
+}
+
+func TestPutObjectInBucket(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	hash := hashOf("content")
+
+	for _, tc := range []struct {
+		bucket string
+		status int
+	}{
+		{"..", http.StatusBadRequest},
+		{"Photos", http.StatusBadRequest},
+		{"photos", http.StatusOK},
+	} {
+		r := httptest.NewRequest("PUT", "/buckets/"+tc.bucket+"/objects/"+hash, strings.NewReader("content"))
+		r.Header.Set("Digest", util.DigestHeader(hash))
+		w := httptest.NewRecorder()
+		s.PutObject(w, r, httprouter.Params{{Key: "bucket", Value: tc.bucket}, {Key: "name", Value: hash}})
+		if w.Code != tc.status {
+			t.Errorf("PUT to bucket %s is %d, want %d", tc.bucket, w.Code, tc.status)
+		}
+	}
+
+	// objects of a bucket are kept in a folder named after it
+	data, err := ioutil.ReadFile(filepath.Join(storage, "objects", "photos", hash))
+	if err != nil || string(data) != "content" {
+		t.Errorf("object in bucket is %q, error: %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(storage, "objects", hash)); !os.IsNotExist(err) {
+		t.Errorf("object in bucket stored outside its folder, error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.GetObject(w, httptest.NewRequest("GET", "/buckets/photos/objects/"+hash, nil),
+		httprouter.Params{{Key: "bucket", Value: "photos"}, {Key: "name", Value: hash}})
+	if w.Body.String() != "content" {
+		t.Errorf("GET of object in bucket is %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteObject(t *testing.T) {
+	s := NewServer("localhost:8031", filepath.Join(t.TempDir(), "storage"), nil)
+	hash := hashOf("content")
+	putObject(s, hash, hash, "content")
+
+	for _, tc := range []struct {
+		name   string
+		status int
+	}{
+		{"../objects", http.StatusBadRequest},
+		{hash, http.StatusOK},
+		{hash, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		s.DeleteObject(w, httptest.NewRequest("DELETE", "/objects/"+tc.name, nil),
+			httprouter.Params{{Key: "name", Value: tc.name}})
+		if w.Code != tc.status {
+			t.Errorf("DELETE of %s is %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+}
+
+func TestHeadObject(t *testing.T) {
+	s := NewServer("localhost:8031", filepath.Join(t.TempDir(), "storage"), nil)
+	hash := hashOf("content")
+	putObject(s, hash, hash, "content")
+
+	for _, name := range []string{hash, hashOf("other"), "../objects"} {
+		w := httptest.NewRecorder()
+		s.HeadObject(w, httptest.NewRequest("HEAD", "/objects/"+name, nil),
+			httprouter.Params{{Key: "name", Value: name}})
+		if name != hash {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("HEAD of %s is %d", name, w.Code)
+			}
+			continue
+		}
+
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("HEAD is %d with %d bytes", w.Code, w.Body.Len())
+		}
+		if w.Header().Get("Content-Length") != "7" || w.Header().Get("ETag") != `"`+hash+`"` {
+			t.Errorf("HEAD headers are %v", w.Header())
+		}
+	}
+}
+
+func TestPutObjectVerifiesLength(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	hash := hashOf("content")
+
+	r := httptest.NewRequest("PUT", "/objects/"+hash, strings.NewReader("content"))
+	r.Header.Set("Digest", util.DigestHeader(hash))
+	r.ContentLength = 10
+	w := httptest.NewRecorder()
+	s.PutObject(w, r, httprouter.Params{{Key: "name", Value: hash}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT of truncated body is %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(storage, "objects", hash)); !os.IsNotExist(err) {
+		t.Errorf("truncated object stored, error: %v", err)
+	}
+}
+
+func TestStaleTempFilesRemoved(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	NewServer("localhost:8031", storage, nil)
+	temp := filepath.Join(storage, "temp", "interrupted")
+	if err := ioutil.WriteFile(temp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	NewServer("localhost:8031", storage, nil)
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("stale temp file kept, error: %v", err)
+	}
+}
+
+func TestPutObjectVerifiesChecksums(t *testing.T) {
+	s := NewServer("localhost:8031", filepath.Join(t.TempDir(), "storage"), nil)
+	hash := hashOf("content")
+	crc32c := util.NewCRC32C()
+	crc32c.Write([]byte("content"))
+	sum := util.EncodeHexChecksum(util.CRC32CHex(crc32c))
+
+	for _, tc := range []struct {
+		header  string
+		trailer string
+		status  int
+	}{
+		{util.EncodeHexChecksum("00000000"), "", http.StatusBadRequest},
+		{"", util.EncodeHexChecksum("00000000"), http.StatusBadRequest},
+		{sum, "", http.StatusOK},
+		{"", sum, http.StatusOK},
+	} {
+		r := httptest.NewRequest("PUT", "/objects/"+hash, strings.NewReader("content"))
+		r.Header.Set("Digest", util.DigestHeader(hash))
+		if tc.header != "" {
+			r.Header.Set(util.ChecksumCRC32CHeader, tc.header)
+		}
+		if tc.trailer != "" {
+			r.Trailer = http.Header{util.ChecksumCRC32CHeader: {tc.trailer}}
+		}
+		w := httptest.NewRecorder()
+		s.PutObject(w, r, httprouter.Params{{Key: "name", Value: hash}})
+		if w.Code != tc.status {
+			t.Errorf("PUT with checksum %q, trailer %q is %d, want %d", tc.header, tc.trailer, w.Code, tc.status)
+		}
+	}
+}
+
+// Get object name from s with header Range unless empty, returns the response and
+// whether the handler aborted it
+func getObject(s *DataProviderServer, name string, rangeHeader string) (w *httptest.ResponseRecorder, aborted bool) {
+	r := httptest.NewRequest("GET", "/objects/"+name, nil)
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	w = httptest.NewRecorder()
+	defer func() {
+		aborted = recover() == http.ErrAbortHandler
+	}()
+	s.GetObject(w, r, httprouter.Params{{Key: "name", Value: name}})
+	return w, false
+}
+
+func TestGetObjectVerifiesBlocks(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	content := strings.Repeat("0123456789abcdef", 3*checksumBlockSize/16)
+	hash := hashOf(content)
+	putObject(s, hash, hash, content)
+
+	w, _ := getObject(s, hash, "")
+	if w.Body.String() != content || w.Result().Trailer.Get(util.ChecksumSHA256Header) != util.EncodeHexChecksum(hash) {
+		t.Errorf("GET returned %d bytes, trailers %v", w.Body.Len(), w.Result().Trailer)
+	}
+
+	// store the object again with its second block corrupt
+	corrupt := func() {
+		putObject(s, hash, hash, content)
+		file := filepath.Join(storage, "objects", hash)
+		data, _ := ioutil.ReadFile(file)
+		data[checksumBlockSize+1] ^= 0xff
+		ioutil.WriteFile(file, data, 0644)
+	}
+
+	corrupt()
+	w, _ = getObject(s, hash, "")
+	if w.Body.Len() > checksumBlockSize || w.Result().Trailer.Get(util.ChecksumCRC32CHeader) != "" {
+		t.Errorf("GET of corrupt object returned %d bytes, trailers %v", w.Body.Len(), w.Result().Trailer)
+	}
+
+	// ranges are verified by block, corrupt blocks abort the response
+	corrupt()
+	if w, aborted := getObject(s, hash, "bytes=10-20"); aborted || w.Body.String() != content[10:21] {
+		t.Errorf("GET of intact range returned %q, aborted %v", w.Body.String(), aborted)
+	}
+	if w, aborted := getObject(s, hash, fmt.Sprintf("bytes=%d-", checksumBlockSize-10)); !aborted || w.Body.Len() > 10 {
+		t.Errorf("GET of corrupt range returned %d bytes, aborted %v", w.Body.Len(), aborted)
+	}
+}
@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"github.com/julienschmidt/httprouter"
+	uuid2 "github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How often staging files are checked for expiry
+const stagingSweepInterval = 10 * time.Minute
+
+// Staging files hold the content of resumable uploads, chunks are appended to them
+// at the committed offset, which is the size of the file, so an upload interrupted
+// anywhere can be resumed from what was written
+
+// Get staging file name by upload session ID, returns "" if the ID is not a UUID
+func (s *DataProviderServer) getStagingName(id string) string {
+	_, err := uuid2.FromString(id)
+	if err != nil {
+		return ""
+	}
+	return s.storage + "/staging/" + id
+}
+
+// Mark staging file busy while a chunk is appended, returns false if it is already busy
+func (s *DataProviderServer) lockStaging(name string) bool {
+	s.stagingMutex.Lock()
+	defer s.stagingMutex.Unlock()
+
+	if s.staging[name] {
+		return false
+	}
+	s.staging[name] = true
+	return true
+}
+
+// Mark staging file no longer busy
+func (s *DataProviderServer) unlockStaging(name string) {
+	s.stagingMutex.Lock()
+	defer s.stagingMutex.Unlock()
+	delete(s.staging, name)
+}
+
+// Start removing staging files not appended to for expiry, their sessions expired on API
+// servers, or were lost before the staging file was deleted
+func (s *DataProviderServer) StartStagingSweeper(expiry time.Duration) {
+	go func() {
+		for {
+			time.Sleep(stagingSweepInterval)
+			s.expireStaging(expiry)
+		}
+	}()
+}
+
+// Remove staging files not appended to for expiry, busy ones are skipped
+func (s *DataProviderServer) expireStaging(expiry time.Duration) {
+	files, err := ioutil.ReadDir(s.storage + "/staging")
+	if err != nil {
+		log.Printf("Unable to list staging files, error: %s", err)
+		return
+	}
+
+	for _, f := range files {
+		if time.Since(f.ModTime()) < expiry {
+			continue
+		}
+
+		name := s.storage + "/staging/" + f.Name()
+		if !s.lockStaging(name) {
+			continue
+		}
+		err = os.Remove(name)
+		s.unlockStaging(name)
+		if err != nil {
+			log.Printf("Unable to remove expired staging file %s, error: %s", name, err)
+			continue
+		}
+		log.Printf("Removed expired staging file %s, last appended at %s", name, f.ModTime())
+	}
+}
+
+// RESTful API, create an empty staging file for upload session ID
+func (s *DataProviderServer) CreateStaging(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := s.getStagingName(p.ByName("id"))
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Unable to create staging file %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	log.Printf("Created staging file %s", name)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// RESTful API, get the committed offset of staging file in "Upload-Offset" header
+func (s *DataProviderServer) HeadStaging(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := s.getStagingName(p.ByName("id"))
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// RESTful API, append a chunk to staging file, the "Upload-Offset" header must equal
+// the committed offset, otherwise 409 is returned and the client should ask for it again.
+// Whatever part of the chunk is received is kept, even if the connection breaks, the new
+// committed offset is returned in "Upload-Offset" header
+func (s *DataProviderServer) PatchStaging(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := s.getStagingName(p.ByName("id"))
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// chunks of one upload are appended one at a time
+	if !s.lockStaging(name) {
+		log.Printf("Staging file %s is busy", name)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer s.unlockStaging(name)
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("Unable to stat staging file %s, error: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if info.Size() != offset {
+		log.Printf("Staging file %s offset mismatch, expected %d, actual %d", name, info.Size(), offset)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size(), 10))
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	n, copyErr := io.Copy(file, r.Body)
+	err = file.Sync()
+	if copyErr == nil {
+		copyErr = err
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset+n, 10))
+	if copyErr != nil {
+		log.Printf("Chunk of staging file %s interrupted at offset %d, error: %s", name, offset+n, copyErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RESTful API, get the content of staging file
+func (s *DataProviderServer) GetStaging(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := s.getStagingName(p.ByName("id"))
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	GetObjectByName(name, "", w, r)
+}
+
+// RESTful API, delete staging file
+func (s *DataProviderServer) DeleteStaging(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := s.getStagingName(p.ByName("id"))
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	DeleteObjectByName(name, w)
+}
@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"github.com/julienschmidt/httprouter"
+	uuid2 "github.com/satori/go.uuid"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve a staging request method of session id on s, offset is sent if not negative
+func staging(s *DataProviderServer, method string, id string, offset int, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/staging/"+id, strings.NewReader(body))
+	if offset >= 0 {
+		r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	}
+	w := httptest.NewRecorder()
+	p := httprouter.Params{{Key: "id", Value: id}}
+	switch method {
+	case "POST":
+		s.CreateStaging(w, r, p)
+	case "HEAD":
+		s.HeadStaging(w, r, p)
+	case "PATCH":
+		s.PatchStaging(w, r, p)
+	case "GET":
+		s.GetStaging(w, r, p)
+	case "DELETE":
+		s.DeleteStaging(w, r, p)
+	}
+	return w
+}
+
+func TestStaging(t *testing.T) {
+	s := NewServer("localhost:8031", filepath.Join(t.TempDir(), "storage"), nil)
+	id := uuid2.Must(uuid2.NewV4()).String()
+
+	if w := staging(s, "POST", "../objects", -1, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("POST of invalid ID is %d", w.Code)
+	}
+	if w := staging(s, "POST", id, -1, ""); w.Code != http.StatusCreated {
+		t.Fatalf("POST is %d", w.Code)
+	}
+	if w := staging(s, "POST", id, -1, ""); w.Code != http.StatusConflict {
+		t.Errorf("POST twice is %d", w.Code)
+	}
+
+	if w := staging(s, "PATCH", id, 0, "first,"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("PATCH is %d at offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := staging(s, "PATCH", id, 3, "again"); w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("PATCH at wrong offset is %d at offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	staging(s, "PATCH", id, 6, "second")
+	if w := staging(s, "HEAD", id, -1, ""); w.Header().Get("Upload-Offset") != "12" {
+		t.Errorf("HEAD offset is %q", w.Header().Get("Upload-Offset"))
+	}
+	if w := staging(s, "GET", id, -1, ""); w.Body.String() != "first,second" {
+		t.Errorf("GET is %q", w.Body.String())
+	}
+
+	if w := staging(s, "DELETE", id, -1, ""); w.Code != http.StatusOK {
+		t.Errorf("DELETE is %d", w.Code)
+	}
+	if w := staging(s, "HEAD", id, -1, ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of deleted staging file is %d", w.Code)
+	}
+}
+
+func TestExpireStaging(t *testing.T) {
+	s := NewServer("localhost:8031", filepath.Join(t.TempDir(), "storage"), nil)
+	stale := uuid2.Must(uuid2.NewV4()).String()
+	busy := uuid2.Must(uuid2.NewV4()).String()
+	fresh := uuid2.Must(uuid2.NewV4()).String()
+	for _, id := range []string{stale, busy, fresh} {
+		staging(s, "POST", id, -1, "")
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(s.getStagingName(stale), old, old)
+	os.Chtimes(s.getStagingName(busy), old, old)
+
+	// a staging file being appended to is left alone
+	s.lockStaging(s.getStagingName(busy))
+	s.expireStaging(time.Hour)
+	s.unlockStaging(s.getStagingName(busy))
+
+	for id, status := range map[string]int{stale: http.StatusNotFound, busy: http.StatusOK, fresh: http.StatusOK} {
+		if w := staging(s, "HEAD", id, -1, ""); w.Code != status {
+			t.Errorf("HEAD of staging file %s is %d, want %d", id, w.Code, status)
+		}
+	}
+}
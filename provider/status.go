@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// States of data provider server set by API servers, a server being drained is "stopping"
+// and "decommissioned" once drained, no new content is placed on it then
+var states = map[string]bool{"running": true, "stopping": true, "decommissioned": true}
+
+// Status is the capacity and load of data provider server, returned to API servers
+// probing it
+type Status struct {
+	Version  int64    `json:"version"`
+	Id       string   `json:"id"`
+	Addr     string   `json:"addr"`
+	Capacity Capacity `json:"capacity"`
+
+	// State set by API servers, empty while running
+	State string `json:"state,omitempty"`
+
+	// Requests being served
+	Requests int64 `json:"requests"`
+}
+
+// Capacity of the file system holding storage root
+type Capacity struct {
+	TotalBytes  uint64 `json:"totalBytes"`
+	FreeBytes   uint64 `json:"freeBytes"`
+	TotalInodes uint64 `json:"totalInodes"`
+	FreeInodes  uint64 `json:"freeInodes"`
+}
+
+// Get capacity of the file system holding storage root
+func (s *DataProviderServer) capacity() (Capacity, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(s.storage, &st)
+	if err != nil {
+		return Capacity{}, err
+	}
+
+	return Capacity{
+		TotalBytes:  uint64(st.Blocks) * uint64(st.Bsize),
+		FreeBytes:   uint64(st.Bavail) * uint64(st.Bsize),
+		TotalInodes: uint64(st.Files),
+		FreeInodes:  uint64(st.Ffree),
+	}, nil
+}
+
+// Wrap handler h to count requests being served, reported as load
+func (s *DataProviderServer) TrackLoad(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.requests, 1)
+		defer atomic.AddInt64(&s.requests, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// RESTful API, get capacity and load of data provider server, API servers probe it
+// periodically to tell if the server is alive
+func (s *DataProviderServer) GetStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	capacity, err := s.capacity()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp, _ := json.Marshal(Status{
+		Version:  s.version,
+		Id:       s.id,
+		Addr:     s.addr,
+		Capacity: capacity,
+		State:    s.getState(),
+		// this request is not load
+		Requests: atomic.LoadInt64(&s.requests) - 1,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// Read state of data provider server from storage root, "" if it was never set
+func loadState(storage string) (string, error) {
+	data, err := ioutil.ReadFile(storage + "/state")
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Returns the state of data provider server
+func (s *DataProviderServer) getState() string {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.state
+}
+
+// RESTful API, set state of data provider server, "PUT /state" with {"state": <state>}.
+// The state is persisted, so API servers restarted or not involved learn it from status
+// and registration
+func (s *DataProviderServer) PutState(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		State string `json:"state"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || !states[body.State] {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	name := s.storage + "/state"
+	err = ioutil.WriteFile(name+".tmp", []byte(body.State+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		log.Printf("Unable to save state %s, error: %s", body.State, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if body.State != s.state {
+		log.Printf("State changed to %s", body.State)
+	}
+	s.state = body.State
+}
@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetStatusReportsCapacityAndLoad(t *testing.T) {
+	s := NewServer("localhost:8031", filepath.Join(t.TempDir(), "storage"), nil)
+
+	// a request held until released is load
+	started, release := make(chan bool), make(chan bool)
+	router := httprouter.New()
+	router.GET("/status", s.GetStatus)
+	router.GET("/slow", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		started <- true
+		<-release
+	})
+	srv := httptest.NewServer(s.TrackLoad(router))
+	defer srv.Close()
+
+	getStatus := func() Status {
+		resp, err := http.Get(srv.URL + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status Status
+		json.NewDecoder(resp.Body).Decode(&status)
+		return status
+	}
+
+	status := getStatus()
+	if status.Addr != "localhost:8031" || status.Requests != 0 || status.Capacity.TotalBytes == 0 ||
+		status.Capacity.FreeBytes > status.Capacity.TotalBytes {
+		t.Errorf("status is %+v", status)
+	}
+
+	done := make(chan bool)
+	go func() {
+		resp, err := http.Get(srv.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- true
+	}()
+	<-started
+	if status := getStatus(); status.Requests != 1 {
+		t.Errorf("requests while one is served are %d", status.Requests)
+	}
+	close(release)
+	<-done
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	s := NewServer("localhost:8031", storage, nil)
+	putState := func(body string) int {
+		r := httptest.NewRequest("PUT", "/state", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.PutState(w, r, nil)
+		return w.Code
+	}
+
+	if code := putState(`{"state": "gone"}`); code != http.StatusBadRequest {
+		t.Errorf("PUT of unknown state returned %d", code)
+	}
+	if s.getState() != "" {
+		t.Errorf("state of running server is %q", s.getState())
+	}
+	if code := putState(`{"state": "stopping"}`); code != http.StatusOK {
+		t.Fatalf("PUT of state returned %d", code)
+	}
+
+	// reported by status and registration, and kept across restarts
+	w := httptest.NewRecorder()
+	s.GetStatus(w, httptest.NewRequest("GET", "/status", nil), nil)
+	var status Status
+	json.NewDecoder(w.Body).Decode(&status)
+	if status.State != "stopping" {
+		t.Errorf("status is %+v", status)
+	}
+	if again := NewServer("localhost:8031", storage, nil); again.getState() != "stopping" {
+		t.Errorf("state after restart is %q", again.getState())
+	}
+}
@@ -51,26 +51,26 @@ func getQueueUrl(svc *sqs.SQS, name string) (*string, error) {
 	return result.QueueUrl, nil
 }
 
-func NewSQS() *SQS {
+func NewSQS() (*SQS, error) {
 	// Create session
 	svc, err := newServiceClient()
 	if err != nil {
 		log.Printf("Failed to create session, error: %s", err)
-		log.Fatal("Now exiting...")
+		return nil, err
 	}
 
 	// Get object location query queue Url
 	url, err := getQueueUrl(svc, "godos-test")
 	if err != nil {
 		log.Printf("Failed to get queue Url, error: %s", err)
-		log.Fatal("Now exiting...")
+		return nil, err
 	}
 
 	// Get object located reply queue Url
 	ReplyUrl, err := getQueueUrl(svc, "godos-test-located")
 	if err != nil {
 		log.Printf("Failed to get reply queue Url, error: %s", err)
-		log.Fatal("Now exiting...")
+		return nil, err
 	}
 
 	return &SQS{
@@ -79,15 +79,15 @@ func NewSQS() *SQS {
 		ReplyUrl: *ReplyUrl,
 		msgC:     make(chan sqs.Message),
 		closeC:   make(chan bool),
-	}
+	}, nil
 }
 
-func NewSQSFromUrl(url string, replyUrl string) *SQS {
+func NewSQSFromUrl(url string, replyUrl string) (*SQS, error) {
 	// Create session
 	svc, err := newServiceClient()
 	if err != nil {
 		log.Printf("Failed to create session, error: %s", err)
-		log.Fatal("Now exiting...")
+		return nil, err
 	}
 
 	return &SQS{
@@ -96,7 +96,7 @@ func NewSQSFromUrl(url string, replyUrl string) *SQS {
 		ReplyUrl: replyUrl,
 		msgC:     make(chan sqs.Message),
 		closeC:   make(chan bool),
-	}
+	}, nil
 }
 
 func (s *SQS) consume(url string) {
@@ -148,7 +148,10 @@ func (s *SQS) SendMessage(msg map[string]string, url string) (sqs.SendMessageOut
 		QueueUrl:    aws.String(url),
 		MessageBody: aws.String(string(msgStr)),
 	})
-	return *result, err
+	if err != nil {
+		return sqs.SendMessageOutput{}, err
+	}
+	return *result, nil
 }
 
 // Delete specified message
@@ -1,28 +1,94 @@
 package streams
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
-	"fmt"
+
+	"../util"
 )
 
+// Returned when content read does not match the checksum sent by data server, or data
+// server found its copy corrupt and sent no checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 type GetStream struct {
-	reader io.Reader
+	reader io.ReadCloser
+
+	// Body read ahead and CRC32C of content read, nil if the content is not verified
+	body    *bufio.Reader
+	crc32c  hash.Hash32
+	trailer http.Header
 }
 
 func NewGetStream(objNameWithAddr string) (*GetStream, error) {
-	resp, err := http.Get("http://" + objNameWithAddr)
+	return NewRangeGetStream(objNameWithAddr, 0)
+}
+
+// Get objNameWithAddr starting from offset, the range is forwarded to data server.
+// Whole content is verified against the "X-Checksum-Crc32c" trailer sent by data server
+func NewRangeGetStream(objNameWithAddr string, offset int64) (*GetStream, error) {
+	req, err := http.NewRequest("GET", "http://"+objNameWithAddr, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	expected := http.StatusOK
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		expected = http.StatusPartialContent
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != expected {
+		resp.Body.Close()
 		return nil, fmt.Errorf("data server returned status code %d", resp.StatusCode)
 	}
 
-	return &GetStream{resp.Body}, nil
+	gs := &GetStream{reader: resp.Body}
+	if _, ok := resp.Trailer[util.ChecksumCRC32CHeader]; ok {
+		gs.body = bufio.NewReader(resp.Body)
+		gs.crc32c = util.NewCRC32C()
+		gs.trailer = resp.Trailer
+	}
+	return gs, nil
 }
 
+// Implements the Read method, when content is verified, the last bytes are held back
+// until the checksum matches, so corrupt content never reads to the end
 func (gs *GetStream) Read(p []byte) (n int, err error) {
-	return gs.reader.Read(p)
+	if gs.body == nil {
+		return gs.reader.Read(p)
+	}
+
+	n, err = gs.body.Read(p)
+	gs.crc32c.Write(p[:n])
+	if err == nil {
+		_, err = gs.body.Peek(1)
+		if err == nil {
+			return n, nil
+		}
+	}
+
+	if err != io.EOF {
+		return 0, err
+	}
+
+	expected := util.DecodeChecksum(gs.trailer.Get(util.ChecksumCRC32CHeader))
+	if expected != util.CRC32CHex(gs.crc32c) {
+		return 0, ErrChecksumMismatch
+	}
+	return n, io.EOF
+}
+
+// Close the underlying connection, must be called if the stream is not read to the end
+func (gs *GetStream) Close() error {
+	return gs.reader.Close()
 }
@@ -1,42 +1,133 @@
 package streams
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"fmt"
+	"time"
+
+	"../util"
+)
+
+var (
+	// Returned by Abort, the data server discards the partially written object
+	errAborted = errors.New("put stream aborted")
+
+	// Returned when the data server does not take a write, or does not answer once the
+	// whole object is sent, within putTimeout
+	ErrPutTimeout = errors.New("data server timed out")
+
+	// How long a data server may take to take a write, or to answer once the whole object
+	// is sent, so a hung data server fails the stream instead of blocking it forever
+	putTimeout = 30 * time.Second
 )
 
 type PutStream struct {
 	writer *io.PipeWriter
 	errorC chan error
+
+	// Cancels the request, so a data server that stopped reading can't hold it
+	cancel context.CancelFunc
+
+	// Checksums of content written, sent as trailers of the request when it is closed
+	checksums *util.ChecksumWriter
+	trailer   http.Header
 }
 
-// Put objNameWithAddr in a goroutine and returns a PutStream struct
-func NewPutStream(objNameWithAddr string) *PutStream {
+// Put objNameWithAddr in a goroutine and returns a PutStream struct,
+// hash is the hex encoded SHA-256 hash of object, sent in "Digest" header for verification.
+// The SHA-256 and CRC32C checksums of content written are sent in "X-Checksum-Sha256" and
+// "X-Checksum-Crc32c" trailers, so the data server also verifies content whose hash is not
+// known in advance, like shards. Every write and the answer of data server must come
+// within putTimeout, otherwise the request is cancelled and ErrPutTimeout is returned
+func NewPutStream(objNameWithAddr string, hash string) *PutStream {
 	reader, writer := io.Pipe()
 	errorC := make(chan error)
 
+	// trailer values are filled in place when the stream is closed, the map is
+	// read by the request while the content is being sent
+	trailer := http.Header{
+		util.ChecksumSHA256Header: {""},
+		util.ChecksumCRC32CHeader: {""},
+	}
+
+	req, _ := http.NewRequest("PUT", "http://"+objNameWithAddr, reader)
+	if hash != "" {
+		req.Header.Set("Digest", util.DigestHeader(hash))
+	}
+	req.Trailer = trailer
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+
 	go func() {
-		req, _ := http.NewRequest("PUT", "http://"+objNameWithAddr, reader)
 		client := http.Client{}
 		resp, err := client.Do(req)
-		if err == nil && resp.StatusCode != http.StatusOK {
-			err = fmt.Errorf("data server returned status code %d", resp.StatusCode)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("data server returned status code %d", resp.StatusCode)
+			}
 		}
 
+		// unblock writers if the request ended before the whole object was sent
+		if err != nil {
+			reader.CloseWithError(err)
+		} else {
+			reader.Close()
+		}
 		errorC <- err
 	}()
 
-	return &PutStream{writer, errorC}
+	return &PutStream{
+		writer:    writer,
+		errorC:    errorC,
+		cancel:    cancel,
+		checksums: util.NewChecksumWriter(sha256.New(), false),
+		trailer:   trailer,
+	}
 }
 
 // Implements the Write method
 func (ps *PutStream) Write(data []byte) (n int, err error) {
-	return ps.writer.Write(data)
+	timer := time.AfterFunc(putTimeout, ps.expire)
+	n, err = ps.writer.Write(data)
+	if !timer.Stop() {
+		err = ErrPutTimeout
+	}
+
+	ps.checksums.Write(data[:n])
+	return n, err
+}
+
+// Fail the stream after a timeout, a write blocked on the pipe returns at once
+func (ps *PutStream) expire() {
+	ps.writer.CloseWithError(ErrPutTimeout)
+	ps.cancel()
 }
 
 // Implements the Close method, return any error during http request
 func (ps *PutStream) Close() error {
+	sums := ps.checksums.Sums()
+	ps.trailer[util.ChecksumSHA256Header][0] = util.EncodeHexChecksum(sums.SHA256)
+	ps.trailer[util.ChecksumCRC32CHeader][0] = util.EncodeHexChecksum(sums.CRC32C)
 	ps.writer.Close()
-	return <-ps.errorC
+
+	timer := time.AfterFunc(putTimeout, ps.cancel)
+	err := <-ps.errorC
+	if !timer.Stop() && err != nil {
+		err = ErrPutTimeout
+	}
+	ps.cancel()
+	return err
+}
+
+// Abort the request before the whole object is sent, so the data server won't keep it
+func (ps *PutStream) Abort() {
+	ps.writer.CloseWithError(errAborted)
+	ps.cancel()
+	<-ps.errorC
 }
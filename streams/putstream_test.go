@@ -0,0 +1,34 @@
+package streams
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPutStreamTimesOutOnHungServer(t *testing.T) {
+	timeout := putTimeout
+	putTimeout = 100 * time.Millisecond
+	defer func() { putTimeout = timeout }()
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	// writes stall once the connection buffers are full
+	ps := NewPutStream(strings.TrimPrefix(srv.URL, "http://")+"/objects/obj", "")
+	chunk := make([]byte, 1<<20)
+	var err error
+	for i := 0; i < 256 && err == nil; i++ {
+		_, err = ps.Write(chunk)
+	}
+	if err != ErrPutTimeout {
+		t.Errorf("write to hung server returned %v", err)
+	}
+	ps.Abort()
+}
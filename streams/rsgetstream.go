@@ -0,0 +1,162 @@
+package streams
+
+import (
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"log"
+)
+
+// RSGetStream reads shards of an object written by RSPutStream and decodes the object,
+// missing or failing shards are reconstructed as long as dataShards of them are readable
+type RSGetStream struct {
+	streams    []*GetStream
+	encoder    reedsolomon.Encoder
+	dataShards int
+
+	// Decoded content of current stripe and read offset in it
+	stripe []byte
+	offset int
+
+	// Bytes to skip in the first stripe, when reading from an offset
+	skip int
+
+	// Object bytes not yet decoded
+	remaining int64
+}
+
+// Open shards of object with hash in bucket at addrs and returns a RSGetStream struct, shard i is read
+// from addrs[i], an empty address means the shard is lost. size is the object size, and
+// the object is read starting from offset
+func NewRSGetStream(addrs []string, bucket string, hash string, size int64, dataShards int, parityShards int, offset int64) (*RSGetStream, error) {
+	if len(addrs) != dataShards+parityShards {
+		return nil, fmt.Errorf("need %d shard locations, got %d", dataShards+parityShards, len(addrs))
+	}
+
+	if offset > size {
+		offset = size
+	}
+
+	// shards are read from the start of the stripe holding offset
+	stripeSize := int64(dataShards * shardBlockSize)
+	stripe := offset / stripeSize
+
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]*GetStream, len(addrs))
+	available := 0
+	for i := range addrs {
+		if addrs[i] == "" {
+			continue
+		}
+
+		objNameWithAddr := addrs[i] + ObjectPath(bucket, ShardName(hash, i))
+		stream, err := NewRangeGetStream(objNameWithAddr, stripe*shardBlockSize)
+		if err != nil {
+			log.Printf("Failed to get shard %s, error: %s", objNameWithAddr, err)
+			continue
+		}
+
+		streams[i] = stream
+		available++
+	}
+
+	rs := &RSGetStream{
+		streams:    streams,
+		encoder:    encoder,
+		dataShards: dataShards,
+		remaining:  size - stripe*stripeSize,
+		skip:       int(offset - stripe*stripeSize),
+	}
+
+	if available < dataShards {
+		rs.Close()
+		return nil, fmt.Errorf("only %d of %d shards available, need %d", available, len(addrs), dataShards)
+	}
+
+	return rs, nil
+}
+
+// Implements the Read method
+func (rs *RSGetStream) Read(p []byte) (n int, err error) {
+	for rs.offset == len(rs.stripe) {
+		if rs.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		err = rs.next()
+		if err != nil {
+			return 0, err
+		}
+
+		rs.offset = rs.skip
+		rs.skip = 0
+	}
+
+	n = copy(p, rs.stripe[rs.offset:])
+	rs.offset += n
+	return n, nil
+}
+
+// Read the next stripe from every available shard, reconstruct missing data shards
+func (rs *RSGetStream) next() error {
+	shards := make([][]byte, len(rs.streams))
+	available := 0
+	for i, stream := range rs.streams {
+		if stream == nil {
+			continue
+		}
+
+		// a corrupt shard is missing like a failing one, data servers verify shards by
+		// block, whole or ranged, and cut the stream short before a corrupt block
+		block := make([]byte, shardBlockSize)
+		_, err := io.ReadFull(stream, block)
+		if err != nil {
+			log.Printf("Failed to read shard %d, error: %s", i, err)
+			stream.Close()
+			rs.streams[i] = nil
+			continue
+		}
+
+		shards[i] = block
+		available++
+	}
+
+	if available < rs.dataShards {
+		return fmt.Errorf("only %d shards readable, need %d", available, rs.dataShards)
+	}
+
+	if available < len(shards) {
+		err := rs.encoder.ReconstructData(shards)
+		if err != nil {
+			return err
+		}
+	}
+
+	// join data shards, and drop the padding of the last stripe
+	stripe := make([]byte, 0, rs.dataShards*shardBlockSize)
+	for i := 0; i < rs.dataShards; i++ {
+		stripe = append(stripe, shards[i]...)
+	}
+	if int64(len(stripe)) > rs.remaining {
+		stripe = stripe[:rs.remaining]
+	}
+
+	rs.stripe = stripe
+	rs.offset = 0
+	rs.remaining -= int64(len(stripe))
+	return nil
+}
+
+// Close every shard stream
+func (rs *RSGetStream) Close() error {
+	for _, stream := range rs.streams {
+		if stream != nil {
+			stream.Close()
+		}
+	}
+	return nil
+}
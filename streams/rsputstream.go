@@ -0,0 +1,158 @@
+package streams
+
+import (
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"sync"
+)
+
+// Size of each shard in a stripe, a stripe holds dataShards * shardBlockSize bytes of object
+const shardBlockSize = 64 * 1024
+
+// RSPutStream splits an object into data shards, computes parity shards with Reed-Solomon
+// code, and writes shard i to addrs[i] as "<hash>.<i>". Object content is encoded stripe by
+// stripe, the last stripe is padded with zeros, so the object size must be kept elsewhere
+type RSPutStream struct {
+	streams []*PutStream
+	encoder reedsolomon.Encoder
+	stripe  []byte
+	n       int
+}
+
+// Returns the data server object name of shard i of object with hash
+func ShardName(hash string, i int) string {
+	return fmt.Sprintf("%s.%d", hash, i)
+}
+
+// Returns the data server URL path of object name in bucket, objects outside buckets
+// are under "/objects"
+func ObjectPath(bucket string, name string) string {
+	if bucket == "" {
+		return "/objects/" + name
+	}
+	return "/buckets/" + bucket + "/objects/" + name
+}
+
+// Put shards of object with hash in bucket to addrs in goroutines and returns a RSPutStream struct,
+// len(addrs) must be dataShards + parityShards. Shards with an empty address are encoded but
+// not written, so lost shards are rebuilt by writing the object again
+func NewRSPutStream(addrs []string, bucket string, hash string, dataShards int, parityShards int) (*RSPutStream, error) {
+	if len(addrs) != dataShards+parityShards {
+		return nil, fmt.Errorf("need %d data servers, got %d", dataShards+parityShards, len(addrs))
+	}
+
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]*PutStream, len(addrs))
+	for i := range addrs {
+		if addrs[i] == "" {
+			continue
+		}
+		streams[i] = NewPutStream(addrs[i]+ObjectPath(bucket, ShardName(hash, i)), "")
+	}
+
+	return &RSPutStream{
+		streams: streams,
+		encoder: encoder,
+		stripe:  make([]byte, dataShards*shardBlockSize),
+	}, nil
+}
+
+// Implements the Write method, full stripes are encoded and sent to data servers
+func (rs *RSPutStream) Write(data []byte) (n int, err error) {
+	for n < len(data) {
+		copied := copy(rs.stripe[rs.n:], data[n:])
+		rs.n += copied
+		n += copied
+
+		if rs.n == len(rs.stripe) {
+			err = rs.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Encode the buffered stripe and write every shard block to its data server
+func (rs *RSPutStream) flush() error {
+	if rs.n == 0 {
+		return nil
+	}
+
+	// pad the last stripe with zeros
+	for i := rs.n; i < len(rs.stripe); i++ {
+		rs.stripe[i] = 0
+	}
+
+	shards, err := rs.encoder.Split(rs.stripe)
+	if err != nil {
+		return err
+	}
+
+	err = rs.encoder.Encode(shards)
+	if err != nil {
+		return err
+	}
+
+	// shard blocks are written in parallel, so a slow data server holds up the stripe
+	// by its own write only, instead of delaying the writes of every shard after it
+	errs := make([]error, len(rs.streams))
+	var wg sync.WaitGroup
+	for i := range rs.streams {
+		if rs.streams[i] == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = rs.streams[i].Write(shards[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	rs.n = 0
+	return nil
+}
+
+// Implements the Close method, every shard must be written, otherwise error is returned
+func (rs *RSPutStream) Close() error {
+	err := rs.flush()
+	if err != nil {
+		rs.Abort()
+		return err
+	}
+
+	for i := range rs.streams {
+		if rs.streams[i] == nil {
+			continue
+		}
+		e := rs.streams[i].Close()
+		if e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Abort every shard request, so data servers won't keep partial shards
+func (rs *RSPutStream) Abort() {
+	for i := range rs.streams {
+		if rs.streams[i] != nil {
+			rs.streams[i].Abort()
+		}
+	}
+}
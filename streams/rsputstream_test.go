@@ -0,0 +1,160 @@
+package streams
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDataServer stores the content PUT to it by path, and serves it back
+type fakeDataServer struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+// Implements http.Handler
+func (ds *fakeDataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ds.mutex.Lock()
+		ds.objects[r.URL.Path] = data
+		ds.mutex.Unlock()
+		return
+	}
+
+	ds.mutex.Lock()
+	data, ok := ds.objects[r.URL.Path]
+	ds.mutex.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// Start n fake data servers, returns their addresses
+func startDataServers(t *testing.T, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		srv := httptest.NewServer(&fakeDataServer{objects: map[string][]byte{}})
+		t.Cleanup(srv.Close)
+		addrs[i] = strings.TrimPrefix(srv.URL, "http://")
+	}
+	return addrs
+}
+
+// Read object with hash of size from shards at addrs, starting from offset
+func readShards(addrs []string, hash string, size int64, offset int64) ([]byte, error) {
+	rs, err := NewRSGetStream(addrs, "", hash, size, 4, 2, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	return ioutil.ReadAll(rs)
+}
+
+func TestRSRoundTrip(t *testing.T) {
+	addrs := startDataServers(t, 6)
+
+	// a few stripes and a partial one, written in odd sized chunks
+	data := make([]byte, 3*4*shardBlockSize+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	ps, err := NewRSPutStream(addrs, "", "hash", 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += 10000 {
+		end := i + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := ps.Write(data[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(len(data))
+	got, err := readShards(addrs, "hash", size, 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes back, error: %v", len(got), err)
+	}
+
+	// any two shards lost, data and parity
+	for _, lost := range [][]int{{0, 1}, {2, 5}, {4, 5}} {
+		degraded := append([]string{}, addrs...)
+		for _, i := range lost {
+			degraded[i] = ""
+		}
+		got, err := readShards(degraded, "hash", size, 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("read %d bytes back without shards %v, error: %v", len(got), lost, err)
+		}
+	}
+
+	for _, offset := range []int64{1, shardBlockSize, 4*shardBlockSize + 7, size - 1, size} {
+		degraded := append([]string{""}, addrs[1:]...)
+		got, err := readShards(degraded, "hash", size, offset)
+		if err != nil || !bytes.Equal(got, data[offset:]) {
+			t.Errorf("read %d bytes back from offset %d, error: %v", len(got), offset, err)
+		}
+	}
+
+	if _, err := readShards([]string{"", "", "", addrs[3], addrs[4], addrs[5]}, "hash", size, 0); err == nil {
+		t.Error("read object with 3 of 6 shards lost")
+	}
+	if _, err := readShards(addrs[:5], "hash", size, 0); err == nil {
+		t.Error("read object with 5 shard locations")
+	}
+}
+
+func TestRSPutStreamFailsOnUnreachableServer(t *testing.T) {
+	addrs := append(startDataServers(t, 5), "127.0.0.1:1")
+	ps, err := NewRSPutStream(addrs, "", "hash", 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps.Write(make([]byte, 4*shardBlockSize+1))
+	if err := ps.Close(); err == nil {
+		t.Error("stored object with a shard not written")
+	}
+}
+
+func TestRSPutStreamSkipsLostShards(t *testing.T) {
+	addrs := startDataServers(t, 6)
+	data := []byte("small object, a single padded stripe")
+
+	// shards with no address are not written
+	ps, err := NewRSPutStream(append([]string{""}, addrs[1:]...), "", "hash", 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.Write(data)
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := NewRSGetStream(addrs, "", "hash", int64(len(data)), 4, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	got, err := ioutil.ReadAll(rs)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %q back, error: %v", got, err)
+	}
+}
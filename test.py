@@ -1,5 +1,7 @@
 import requests
+import base64
 import datetime
+import hashlib
 import os
 import requests
 
@@ -15,11 +17,12 @@ def test_put_object():
         fp.write(content)
 
     with open('./test.txt', 'rb') as fp:
-        # test put object
+        # test put object, content hash is sent in Digest header
         object_name = 'obj-{}'.format(ts)
         api = 'http://{}/objects/{}'.format(addr, object_name)
+        digest = base64.b64encode(hashlib.sha256(content.encode()).digest()).decode()
         try:
-            resp = requests.put(api, data=fp)
+            resp = requests.put(api, data=fp, headers={'Digest': 'SHA-256={}'.format(digest)})
         except Exception as e:
             print('- erro: {}'.format(e))
             return
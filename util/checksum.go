@@ -0,0 +1,142 @@
+package util
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"net/http"
+)
+
+// Headers carrying base64 encoded checksums of a body, sent as headers by clients,
+// or as trailers between servers once the whole body is written
+const (
+	ChecksumSHA256Header = "X-Checksum-Sha256"
+	ChecksumCRC32CHeader = "X-Checksum-Crc32c"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Create a CRC32C (Castagnoli) hash
+func NewCRC32C() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+// Returns the base64 encoded checksum sum, the encoding of checksum headers
+func EncodeChecksum(sum []byte) string {
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// Returns the base64 encoded checksum of hex encoded sum, "" if sum is not hex
+func EncodeHexChecksum(sum string) string {
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return ""
+	}
+	return EncodeChecksum(b)
+}
+
+// Returns the hex encoded checksum of base64 encoded header value, "" if it is malformed
+func DecodeChecksum(value string) string {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns the CRC32C checksum of h, hex encoded
+func CRC32CHex(h hash.Hash32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, h.Sum32())
+	return hex.EncodeToString(b)
+}
+
+// Checksums given by client in "Content-MD5", "X-Checksum-Sha256" and "X-Checksum-Crc32c"
+// headers or trailers, hex encoded, empty if not given
+type Checksums struct {
+	MD5    string
+	SHA256 string
+	CRC32C string
+}
+
+// Returns the checksums in h
+func GetChecksums(h http.Header) Checksums {
+	return Checksums{
+		MD5:    DecodeChecksum(h.Get("Content-MD5")),
+		SHA256: DecodeChecksum(h.Get(ChecksumSHA256Header)),
+		CRC32C: DecodeChecksum(h.Get(ChecksumCRC32CHeader)),
+	}
+}
+
+// Merge checksums of trailers received after the body, headers take precedence
+func (c Checksums) Merge(trailer http.Header) Checksums {
+	t := GetChecksums(trailer)
+	if c.MD5 == "" {
+		c.MD5 = t.MD5
+	}
+	if c.SHA256 == "" {
+		c.SHA256 = t.SHA256
+	}
+	if c.CRC32C == "" {
+		c.CRC32C = t.CRC32C
+	}
+	return c
+}
+
+// ChecksumWriter computes CRC32C of everything written to it, MD5 and SHA-256 as well
+// if they are asked for, they are much slower
+type ChecksumWriter struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	crc32c hash.Hash32
+}
+
+// Create ChecksumWriter, sha256 is the hash used to compute SHA-256, nil to skip it
+func NewChecksumWriter(sha256 hash.Hash, withMD5 bool) *ChecksumWriter {
+	cw := &ChecksumWriter{sha256: sha256, crc32c: NewCRC32C()}
+	if withMD5 {
+		cw.md5 = md5.New()
+	}
+	return cw
+}
+
+// Implements the Write method
+func (cw *ChecksumWriter) Write(p []byte) (int, error) {
+	if cw.md5 != nil {
+		cw.md5.Write(p)
+	}
+	if cw.sha256 != nil {
+		cw.sha256.Write(p)
+	}
+	cw.crc32c.Write(p)
+	return len(p), nil
+}
+
+// Returns the checksums of everything written, hex encoded
+func (cw *ChecksumWriter) Sums() Checksums {
+	c := Checksums{CRC32C: CRC32CHex(cw.crc32c)}
+	if cw.sha256 != nil {
+		c.SHA256 = hex.EncodeToString(cw.sha256.Sum(nil))
+	}
+	if cw.md5 != nil {
+		c.MD5 = hex.EncodeToString(cw.md5.Sum(nil))
+	}
+	return c
+}
+
+// Returns the name of the first checksum given in c differing from actual,
+// "" if all given checksums match
+func (c Checksums) Mismatch(actual Checksums) string {
+	switch {
+	case c.MD5 != "" && c.MD5 != actual.MD5:
+		return "Content-MD5"
+	case c.SHA256 != "" && c.SHA256 != actual.SHA256:
+		return ChecksumSHA256Header
+	case c.CRC32C != "" && c.CRC32C != actual.CRC32C:
+		return ChecksumCRC32CHeader
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Throttle limits the bytes read through its readers to rate bytes per second
+// on average since it was created, shared by all its readers, not limited if rate is 0
+type Throttle struct {
+	rate  int64
+	start time.Time
+	read  int64
+	mutex sync.Mutex
+}
+
+// Create Throttle of rate bytes per second
+func NewThrottle(rate int64) *Throttle {
+	return &Throttle{rate: rate, start: time.Now()}
+}
+
+// Returns the bytes read through readers of throttle
+func (t *Throttle) Read() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.read
+}
+
+// Returns a reader of r throttled by t
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r, t}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	throttle *Throttle
+}
+
+// Implements the Read method, sleeps after reading until the average rate is reached
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > 64*1024 {
+		p = p[:64*1024]
+	}
+
+	n, err := tr.r.Read(p)
+	t := tr.throttle
+	t.mutex.Lock()
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	t.mutex.Unlock()
+
+	if elapsed := time.Since(t.start); t.rate > 0 && elapsed < due {
+		time.Sleep(due - elapsed)
+	}
+	return n, err
+}
@@ -1,6 +1,12 @@
 package util
 
-import "strings"
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
 
 func ProcessIP(ips string) []string {
 	list := strings.Split(ips, ",")
@@ -9,3 +15,71 @@ func ProcessIP(ips string) []string {
 	}
 	return list
 }
+
+// Returns the hex encoded SHA-256 hash carried by header "Digest: SHA-256=<base64 hash>",
+// or "X-Checksum-Sha256: <base64 hash>" if there is no "Digest" header,
+// returns "" if the header is absent or malformed
+func GetHashFromHeader(h http.Header) string {
+	digest := h.Get("Digest")
+	if digest == "" && h.Get(ChecksumSHA256Header) != "" {
+		digest = "SHA-256=" + h.Get(ChecksumSHA256Header)
+	}
+	if len(digest) < 9 || !strings.EqualFold(digest[:8], "SHA-256=") {
+		return ""
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(digest[8:])
+	if err != nil || len(sum) != 32 {
+		return ""
+	}
+
+	return hex.EncodeToString(sum)
+}
+
+// Returns the "Digest" header value of hex encoded SHA-256 hash
+func DigestHeader(hash string) string {
+	sum, _ := hex.DecodeString(hash)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// Determines if s is a hex encoded SHA-256 hash, data provider servers use it as file name
+func IsValidHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Determines if s is a valid object name on data provider servers, either a hex encoded
+// SHA-256 hash of whole object, or hash of object followed by ".<shard index>"
+func IsValidObjectName(s string) bool {
+	i := strings.IndexByte(s, '.')
+	if i == -1 {
+		return IsValidHash(s)
+	}
+
+	index, err := strconv.Atoi(s[i+1:])
+	return err == nil && index >= 0 && strconv.Itoa(index) == s[i+1:] && IsValidHash(s[:i])
+}
+
+// Determines if s is a valid bucket name, 3 to 63 lowercase letters, digits, '-' and '.',
+// starting and ending with a letter or digit, so it is safe as folder name and in URLs
+func IsValidBucketName(s string) bool {
+	if len(s) < 3 || len(s) > 63 {
+		return false
+	}
+
+	for i, c := range s {
+		alnum := c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+		if !alnum && (i == 0 || i == len(s)-1 || c != '-' && c != '.') {
+			return false
+		}
+	}
+	return !strings.Contains(s, "..")
+}